@@ -0,0 +1,290 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrCircuitOpen is returned by the operations of wrapped drivers and
+// connectors that their circuit breaker sheds
+var ErrCircuitOpen = errors.New("sqlmetrics: circuit breaker is open")
+
+// BreakerStateLabel is the label of circuit_breaker_state with the state
+const BreakerStateLabel = "state"
+
+// Values of BreakerStateLabel
+const (
+	BreakerClosed   = "closed"
+	BreakerHalfOpen = "half_open"
+	BreakerOpen     = "open"
+)
+
+var breakerStates = []string{BreakerClosed, BreakerHalfOpen, BreakerOpen}
+
+// Defaults of the BreakerPolicy fields that are 0
+const (
+	DefaultBreakerWindow      = 10 * time.Second
+	DefaultBreakerMinRequests = 20
+	DefaultBreakerOpenFor     = 30 * time.Second
+)
+
+// BreakerPolicy configures the circuit breakers of wrapped drivers and
+// connectors. A breaker is closed, letting every operation through, until
+// enough of the operations within a Window fail or are slow. It then opens,
+// failing prepares, begins, queries and execs with ErrCircuitOpen, for
+// OpenFor, after which it is half-open and lets HalfOpenRequests trial
+// operations through. It closes again once they all succeed, and reopens
+// if any of them fails. Commits and rollbacks are never shed.
+type BreakerPolicy struct {
+	// Window is the period over which operations are counted while
+	// closed, DefaultBreakerWindow if unset
+	Window time.Duration
+	// MinRequests is the number of operations within a Window below which
+	// the breaker doesn't open, DefaultBreakerMinRequests if unset
+	MinRequests int
+	// ErrorRatio, if set, opens the breaker once this ratio of the
+	// operations within a Window failed. Operations failing as their
+	// context was canceled don't count, as the client gave up on them.
+	ErrorRatio float64
+	// SlowThreshold and SlowRatio, if set, open the breaker once SlowRatio
+	// of the operations within a Window took at least SlowThreshold
+	SlowThreshold time.Duration
+	SlowRatio     float64
+	// OpenFor is how long the breaker stays open, DefaultBreakerOpenFor if
+	// unset
+	OpenFor time.Duration
+	// HalfOpenRequests is the number of trial operations let through while
+	// half-open, 1 if unset
+	HalfOpenRequests int
+}
+
+// breakerMetrics are the metrics of the circuit breakers of wrapped
+// drivers and connectors
+type breakerMetrics struct {
+	p        BreakerPolicy
+	events   *eventBus
+	state    *prometheus.GaugeVec
+	trips    *prometheus.CounterVec
+	rejected *prometheus.CounterVec
+}
+
+// newBreakerMetrics returns the breaker metrics for o, publishing state
+// changes to events, or nil if o.CircuitBreaker isn't set
+func newBreakerMetrics(o Options, events *eventBus) *breakerMetrics {
+	if o.CircuitBreaker == nil {
+		return nil
+	}
+	p := *o.CircuitBreaker
+	if p.Window <= 0 {
+		p.Window = DefaultBreakerWindow
+	}
+	if p.MinRequests <= 0 {
+		p.MinRequests = DefaultBreakerMinRequests
+	}
+	if p.OpenFor <= 0 {
+		p.OpenFor = DefaultBreakerOpenFor
+	}
+	if p.HalfOpenRequests <= 0 {
+		p.HalfOpenRequests = 1
+	}
+	return &breakerMetrics{
+		p:      p,
+		events: events,
+		state: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        o.MetricName("circuit_breaker_state"),
+			Help:        o.Help("circuit_breaker_state", "Whether the circuit breaker is in the state, 1 for its current state and 0 for the others"),
+			ConstLabels: o.metricConstLabels("circuit_breaker_state"),
+		}, append(append([]string(nil), o.Labels...), BreakerStateLabel)),
+		trips: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("circuit_breaker_trips_total"),
+			Help:        o.Help("circuit_breaker_trips_total", "The total number of times the circuit breaker opened"),
+			ConstLabels: o.metricConstLabels("circuit_breaker_trips_total"),
+		}, o.Labels),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("circuit_breaker_rejected_total"),
+			Help:        o.Help("circuit_breaker_rejected_total", "The total number of operations failed with ErrCircuitOpen"),
+			ConstLabels: o.metricConstLabels("circuit_breaker_rejected_total"),
+		}, o.Labels),
+	}
+}
+
+func (m *breakerMetrics) namedCollectors() []namedCollector {
+	return []namedCollector{
+		{"circuit_breaker_state", m.state},
+		{"circuit_breaker_trips_total", m.trips},
+		{"circuit_breaker_rejected_total", m.rejected},
+	}
+}
+
+// newBreaker returns the closed breaker of a wrapped driver or connector
+// with the given label values, and labels by name, or nil if m is
+func (m *breakerMetrics) newBreaker(labelValues []string, labels map[string]string) *breaker {
+	if m == nil {
+		return nil
+	}
+	b := &breaker{
+		p:        m.p,
+		events:   m.events,
+		labels:   labels,
+		state:    make(map[string]prometheus.Gauge, len(breakerStates)),
+		trips:    m.trips.WithLabelValues(labelValues...),
+		rejected: m.rejected.WithLabelValues(labelValues...),
+		now:      time.Now,
+	}
+	for _, state := range breakerStates {
+		lv := append(append(make([]string, 0, len(labelValues)+1), labelValues...), state)
+		b.state[state] = m.state.WithLabelValues(lv...)
+	}
+	b.setState(BreakerClosed)
+	return b
+}
+
+// breaker is the circuit breaker of a wrapped driver or connector
+type breaker struct {
+	p        BreakerPolicy
+	state    map[string]prometheus.Gauge
+	trips    prometheus.Counter
+	rejected prometheus.Counter
+	now      func() time.Time
+	events   *eventBus
+	labels   map[string]string
+
+	mu      sync.Mutex
+	current string
+	// changed are the state changes not yet published, which is done once
+	// mu is released
+	changed []Event
+	// The operations of the current window while closed
+	windowStart time.Time
+	total       int
+	failed      int
+	slow        int
+	// When the breaker opened
+	openedAt time.Time
+	// The trial operations in flight and succeeded while half-open
+	trials    int
+	succeeded int
+}
+
+// allow reports whether an operation may proceed, and whether it is a
+// trial of the half-open breaker. A nil breaker allows everything.
+func (b *breaker) allow() (trial bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.unlock()
+
+	if b.current == BreakerOpen && b.now().Sub(b.openedAt) >= b.p.OpenFor {
+		b.setState(BreakerHalfOpen)
+		b.trials, b.succeeded = 0, 0
+	}
+	switch b.current {
+	case BreakerOpen:
+		b.rejected.Inc()
+		return false, ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.trials+b.succeeded >= b.p.HalfOpenRequests {
+			b.rejected.Inc()
+			return false, ErrCircuitOpen
+		}
+		b.trials++
+		return true, nil
+	}
+	return false, nil
+}
+
+// record records the outcome of an allowed operation that took d.
+// Operations that returned driver.ErrSkip never reached the database and
+// aren't counted.
+func (b *breaker) record(trial bool, d time.Duration, err error) {
+	if b == nil {
+		return
+	}
+	skipped := errors.Is(err, driver.ErrSkip)
+	canceled := errors.Is(err, context.Canceled)
+	failed := err != nil && !skipped && !canceled
+	slow := b.p.SlowThreshold > 0 && d >= b.p.SlowThreshold
+
+	b.mu.Lock()
+	defer b.unlock()
+
+	if trial {
+		b.trials--
+		// A canceled trial says nothing about the DB, so it only frees
+		// its slot for another
+		if skipped || canceled || b.current != BreakerHalfOpen {
+			return
+		}
+		if failed && b.p.ErrorRatio > 0 || slow && b.p.SlowRatio > 0 {
+			b.trip()
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.p.HalfOpenRequests {
+			b.setState(BreakerClosed)
+			b.windowStart = time.Time{}
+		}
+		return
+	}
+	if skipped || b.current != BreakerClosed {
+		return
+	}
+
+	now := b.now()
+	if now.Sub(b.windowStart) >= b.p.Window {
+		b.windowStart = now
+		b.total, b.failed, b.slow = 0, 0, 0
+	}
+	b.total++
+	if failed {
+		b.failed++
+	}
+	if slow {
+		b.slow++
+	}
+	if b.total < b.p.MinRequests {
+		return
+	}
+	if b.p.ErrorRatio > 0 && float64(b.failed) >= b.p.ErrorRatio*float64(b.total) ||
+		b.p.SlowRatio > 0 && float64(b.slow) >= b.p.SlowRatio*float64(b.total) {
+		b.trip()
+	}
+}
+
+// trip opens the breaker
+func (b *breaker) trip() {
+	b.setState(BreakerOpen)
+	b.openedAt = b.now()
+	b.trips.Inc()
+}
+
+func (b *breaker) setState(state string) {
+	if b.current != "" && b.current != state && b.events.active() {
+		b.changed = append(b.changed, Event{Type: EventBreakerStateChanged, Time: b.now(), Labels: b.labels, State: state})
+	}
+	b.current = state
+	for s, g := range b.state {
+		if s == state {
+			g.Set(1)
+		} else {
+			g.Set(0)
+		}
+	}
+}
+
+// unlock releases mu and publishes the state changes made while it was
+// held, so subscribers may use the breaker
+func (b *breaker) unlock() {
+	changed := b.changed
+	b.changed = nil
+	b.mu.Unlock()
+	for _, e := range changed {
+		b.events.publish(e)
+	}
+}
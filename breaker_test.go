@@ -0,0 +1,40 @@
+package sqlmetrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerCanceledTrial(t *testing.T) {
+	m := newBreakerMetrics(Options{CircuitBreaker: &BreakerPolicy{MinRequests: 1, ErrorRatio: 0.5, OpenFor: time.Minute}}, &eventBus{})
+	b := m.newBreaker(nil, nil)
+	now := time.Unix(1e9, 0)
+	b.now = func() time.Time { return now }
+
+	record := func(err error) {
+		t.Helper()
+		trial, allowErr := b.allow()
+		if allowErr != nil {
+			t.Fatalf("allow in state %s: %v", b.current, allowErr)
+		}
+		b.record(trial, time.Millisecond, err)
+	}
+	record(errors.New("connection refused"))
+	if b.current != BreakerOpen {
+		t.Fatalf("breaker is %s after a failure, want open", b.current)
+	}
+
+	// A canceled trial neither closes nor reopens the breaker, and frees
+	// its slot for another
+	now = now.Add(time.Minute)
+	record(context.Canceled)
+	if b.current != BreakerHalfOpen {
+		t.Fatalf("breaker is %s after a canceled trial, want half_open", b.current)
+	}
+	record(nil)
+	if b.current != BreakerClosed {
+		t.Errorf("breaker is %s after a successful trial, want closed", b.current)
+	}
+}
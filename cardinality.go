@@ -0,0 +1,63 @@
+package sqlmetrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMaxQueryLabelValues is the Options.MaxQueryLabelValues used when
+// it is 0
+const DefaultMaxQueryLabelValues = 500
+
+// OverflowLabelValue replaces the values of dynamic labels past
+// Options.MaxQueryLabelValues
+const OverflowLabelValue = "other"
+
+// labelLimiter bounds the distinct values of a dynamic label, such as
+// query_fingerprint, to keep a bad configuration from making unbounded
+// series
+type labelLimiter struct {
+	max      int
+	overflow prometheus.Counter
+
+	mu   sync.RWMutex
+	seen map[string]struct{}
+}
+
+func newLabelLimiter(max int, overflows *prometheus.CounterVec, label string) *labelLimiter {
+	if max == 0 {
+		max = DefaultMaxQueryLabelValues
+	}
+	return &labelLimiter{
+		max:      max,
+		overflow: overflows.WithLabelValues(label),
+		seen:     make(map[string]struct{}),
+	}
+}
+
+// value returns v if it was seen before or there is room for it, and
+// OverflowLabelValue otherwise
+func (l *labelLimiter) value(v string) string {
+	if l.max < 0 {
+		return v
+	}
+	l.mu.RLock()
+	_, ok := l.seen[v]
+	l.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+	if len(l.seen) >= l.max {
+		l.overflow.Inc()
+		return OverflowLabelValue
+	}
+	l.seen[v] = struct{}{}
+	return v
+}
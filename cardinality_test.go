@@ -0,0 +1,106 @@
+package sqlmetrics
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestLimiter returns a limiter of the query_fingerprint label to max
+// values, and its overflows
+func newTestLimiter(max int) (*labelLimiter, *prometheus.CounterVec) {
+	overflows := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "query_label_overflows_total",
+		Help: "The total number of observations whose dynamic label value was replaced",
+	}, []string{"label"})
+	return newLabelLimiter(max, overflows, QueryFingerprintLabel), overflows
+}
+
+func TestLabelLimiter(t *testing.T) {
+	l, overflows := newTestLimiter(2)
+	for _, test := range []struct {
+		value, want string
+	}{
+		{"a", "a"},
+		{"b", "b"},
+		// Past the limit, new values overflow
+		{"c", OverflowLabelValue},
+		{"d", OverflowLabelValue},
+		// Admitted values keep their label
+		{"a", "a"},
+		{"b", "b"},
+		{"c", OverflowLabelValue},
+	} {
+		if got := l.value(test.value); got != test.want {
+			t.Errorf("value(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+	assertValue(t, gather(t, overflows), "query_label_overflows_total", map[string]string{"label": QueryFingerprintLabel}, 3)
+}
+
+func TestLabelLimiterDefaults(t *testing.T) {
+	l, _ := newTestLimiter(0)
+	for i := 0; i < DefaultMaxQueryLabelValues; i++ {
+		if v := fmt.Sprint(i); l.value(v) != v {
+			t.Fatalf("value %d of %d overflowed", i, DefaultMaxQueryLabelValues)
+		}
+	}
+	if got := l.value("past"); got != OverflowLabelValue {
+		t.Errorf("value past DefaultMaxQueryLabelValues = %q, want %q", got, OverflowLabelValue)
+	}
+
+	// A negative limit doesn't limit
+	l, overflows := newTestLimiter(-1)
+	for i := 0; i < 2*DefaultMaxQueryLabelValues; i++ {
+		if v := fmt.Sprint(i); l.value(v) != v {
+			t.Fatalf("value %d overflowed without a limit", i)
+		}
+	}
+	assertValue(t, gather(t, overflows), "query_label_overflows_total", map[string]string{"label": QueryFingerprintLabel}, 0)
+}
+
+func TestLabelLimiterConcurrent(t *testing.T) {
+	const max, values, goroutines = 10, 100, 8
+	l, overflows := newTestLimiter(max)
+	var (
+		mu       sync.Mutex
+		admitted = map[string]bool{}
+		overflow int
+		wg       sync.WaitGroup
+	)
+	for g := 0; g < goroutines; g++ {
+		wg.Go(func() {
+			for i := 0; i < values; i++ {
+				v := fmt.Sprint((i + g) % values)
+				got := l.value(v)
+				mu.Lock()
+				if got == OverflowLabelValue {
+					overflow++
+				} else if got != v {
+					t.Errorf("value(%q) = %q", v, got)
+				} else {
+					admitted[v] = true
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	if len(admitted) != max {
+		t.Errorf("%d values admitted, want %d", len(admitted), max)
+	}
+	// Admitted values keep their label, and the rest overflow for every
+	// goroutine
+	for v := range admitted {
+		if got := l.value(v); got != v {
+			t.Errorf("admitted value %q is now %q", v, got)
+		}
+	}
+	assertValue(t, gather(t, overflows), "query_label_overflows_total", map[string]string{"label": QueryFingerprintLabel}, float64(overflow))
+	if want := goroutines * (values - max); overflow != want {
+		t.Errorf("%d values overflowed, want %d", overflow, want)
+	}
+}
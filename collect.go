@@ -0,0 +1,152 @@
+package sqlmetrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// pairKey identifies the label pairs of a desc with the joined label
+// values of a DB
+type pairKey struct {
+	desc        *prometheus.Desc
+	labelValues string
+}
+
+// labelPairCache keeps the label pairs of the per-DB metrics between
+// collections, which would otherwise make up most of the allocations of
+// each one. Pairs not used by a collection are dropped by the next, so DBs
+// that were unregistered or relabeled don't stay around.
+type labelPairCache struct {
+	mu   sync.Mutex
+	cur  map[pairKey][]*dto.LabelPair
+	prev map[pairKey][]*dto.LabelPair
+}
+
+// rotate starts a collection, dropping the pairs the previous one didn't
+// use
+func (p *labelPairCache) rotate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prev = p.cur
+	p.cur = make(map[pairKey][]*dto.LabelPair, len(p.prev))
+}
+
+// get returns the label pairs of desc with labelValues, joined as key
+func (p *labelPairCache) get(desc *prometheus.Desc, labelValues []string, key string) []*dto.LabelPair {
+	k := pairKey{desc, key}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pairs, ok := p.cur[k]; ok {
+		return pairs
+	}
+	pairs, ok := p.prev[k]
+	if !ok {
+		// MustNewConstMetric validates the label values, and panics on
+		// invalid ones as the metrics built with it always have
+		var m dto.Metric
+		prometheus.MustNewConstMetric(desc, prometheus.UntypedValue, 0, labelValues...).Write(&m)
+		pairs = m.Label
+	}
+	if p.cur == nil {
+		p.cur = make(map[pairKey][]*dto.LabelPair)
+	}
+	p.cur[k] = pairs
+	return pairs
+}
+
+// cachedMetric is a const metric with cached label pairs, which must not
+// be modified
+type cachedMetric struct {
+	desc      *prometheus.Desc
+	labels    []*dto.LabelPair
+	valueType prometheus.ValueType
+	value     float64
+	// created, if set, is the created timestamp of counters
+	created time.Time
+}
+
+func (m *cachedMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m *cachedMetric) Write(out *dto.Metric) error {
+	out.Label = m.labels
+	v := m.value
+	switch m.valueType {
+	case prometheus.CounterValue:
+		out.Counter = &dto.Counter{Value: &v}
+		if !m.created.IsZero() {
+			out.Counter.CreatedTimestamp = timestamppb.New(m.created)
+		}
+	case prometheus.GaugeValue:
+		out.Gauge = &dto.Gauge{Value: &v}
+	default:
+		out.Untyped = &dto.Untyped{Value: &v}
+	}
+	return nil
+}
+
+// constMetrics emits the const metrics of a DB, or of the fleet totals,
+// with label values labelValues. They are allocated in batches and share
+// their cached label pairs.
+type constMetrics struct {
+	ch          chan<- prometheus.Metric
+	pairs       *labelPairCache
+	labelValues []string
+	key         string
+	created     time.Time
+	buf         []cachedMetric
+}
+
+// constMetrics returns the constMetrics with labelValues, whose counters
+// were created at created if Options.OpenMetrics is set
+func (c *Collector) constMetrics(ch chan<- prometheus.Metric, labelValues []string, created time.Time) *constMetrics {
+	m := &constMetrics{
+		ch:          ch,
+		pairs:       &c.pairs,
+		labelValues: labelValues,
+		key:         strings.Join(labelValues, "\xff"),
+	}
+	if c.o.OpenMetrics {
+		m.created = created
+	}
+	return m
+}
+
+// with returns the constMetrics of the metrics with the additional label
+// value v
+func (m *constMetrics) with(v string) *constMetrics {
+	labelValues := append(append(make([]string, 0, len(m.labelValues)+1), m.labelValues...), v)
+	return &constMetrics{
+		ch:          m.ch,
+		pairs:       m.pairs,
+		labelValues: labelValues,
+		key:         m.key + "\xff" + v,
+		created:     m.created,
+	}
+}
+
+// emit emits the metric of desc with value, unless desc is nil as the
+// metric is filtered out
+func (m *constMetrics) emit(desc *prometheus.Desc, valueType prometheus.ValueType, value float64) {
+	if desc == nil {
+		return
+	}
+	if len(m.buf) == cap(m.buf) {
+		// Metrics already emitted keep pointing into the previous batch
+		m.buf = make([]cachedMetric, 0, 16)
+	}
+	m.buf = append(m.buf, cachedMetric{
+		desc:      desc,
+		labels:    m.pairs.get(desc, m.labelValues, m.key),
+		valueType: valueType,
+		value:     value,
+		created:   m.created,
+	})
+	m.ch <- &m.buf[len(m.buf)-1]
+}
@@ -0,0 +1,97 @@
+package sqlmetrics
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// commenter appends sqlcommenter comments to the queries of wrapped
+// drivers, so database logs can be correlated back to the application
+type commenter struct {
+	application string
+	tags        func(context.Context) map[string]string
+}
+
+// newCommenter returns the commenter of o, or nil if o.CommentQueries isn't
+// set
+func newCommenter(o Options) *commenter {
+	if !o.CommentQueries {
+		return nil
+	}
+	return &commenter{application: o.CommentApplication, tags: o.CommentTags}
+}
+
+// comment returns query with a comment of the tags of ctx appended, in the
+// sqlcommenter format, before any trailing semicolon and whitespace.
+// Queries that already have a comment are returned as they are.
+func (c *commenter) comment(ctx context.Context, query string) string {
+	if c == nil || hasComment(query) {
+		return query
+	}
+	tags := make(map[string]string)
+	if c.tags != nil {
+		for k, v := range c.tags(ctx) {
+			tags[k] = v
+		}
+	}
+	if c.application != "" {
+		tags["application"] = c.application
+	}
+	if operation := OperationFromContext(ctx); operation != "" {
+		tags[OperationLabel] = operation
+	}
+	if len(tags) == 0 {
+		return query
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	body := strings.TrimRight(query, "; \t\r\n")
+	var b strings.Builder
+	b.WriteString(body)
+	b.WriteString(" /*")
+	for j, k := range keys {
+		if j > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(commentEscape(k))
+		b.WriteString("='")
+		b.WriteString(commentEscape(tags[k]))
+		b.WriteByte('\'')
+	}
+	b.WriteString("*/")
+	b.WriteString(query[len(body):])
+	return b.String()
+}
+
+// hasComment reports whether query has a comment outside of its string
+// literals and quoted identifiers
+func hasComment(query string) bool {
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case strings.HasPrefix(query[i:], "--"), strings.HasPrefix(query[i:], "/*"):
+			return true
+		case c == '\'' || c == '"' || c == '`':
+			// Quotes are escaped by doubling them, which this skips as
+			// two literals, or in strings with a backslash
+			for i++; i < len(query) && query[i] != c; i++ {
+				if c == '\'' && query[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return false
+}
+
+// commentEscape URL-encodes s as sqlcommenter keys and values are, which
+// also escapes the quotes and comment delimiters that would break out of
+// the comment
+func commentEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
@@ -0,0 +1,55 @@
+package sqlmetrics
+
+import (
+	"context"
+	"testing"
+)
+
+func TestComment(t *testing.T) {
+	c := newCommenter(Options{
+		CommentQueries:     true,
+		CommentApplication: "api",
+		CommentTags: func(context.Context) map[string]string {
+			return map[string]string{"route": "/users/{id}"}
+		},
+	})
+	const comment = "/*application='api',route='%2Fusers%2F%7Bid%7D'*/"
+	for _, test := range []struct {
+		query, want string
+	}{
+		{"SELECT 1", "SELECT 1 " + comment},
+		// The comment goes before trailing semicolons and whitespace
+		{"SELECT 1;", "SELECT 1 " + comment + ";"},
+		{"SELECT 1 ;\n", "SELECT 1 " + comment + " ;\n"},
+		{"SELECT 1;;  ", "SELECT 1 " + comment + ";;  "},
+		// Comment delimiters in literals and quoted identifiers aren't
+		// comments
+		{"SELECT * FROM t WHERE a = '--'", "SELECT * FROM t WHERE a = '--' " + comment},
+		{"SELECT * FROM t WHERE a = '/* x */';", "SELECT * FROM t WHERE a = '/* x */' " + comment + ";"},
+		{`SELECT "a--b" FROM t`, `SELECT "a--b" FROM t ` + comment},
+		{"SELECT * FROM t WHERE a = 'it''s -- fine'", "SELECT * FROM t WHERE a = 'it''s -- fine' " + comment},
+		{`SELECT * FROM t WHERE a = 'it\'s -- fine'`, `SELECT * FROM t WHERE a = 'it\'s -- fine' ` + comment},
+		// Queries with a comment are left as they are
+		{"SELECT 1 -- one", "SELECT 1 -- one"},
+		{"/* app */ SELECT 1", "/* app */ SELECT 1"},
+		{"SELECT 'a' /* x */", "SELECT 'a' /* x */"},
+	} {
+		if got := c.comment(context.Background(), test.query); got != test.want {
+			t.Errorf("comment(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestCommentOperation(t *testing.T) {
+	c := newCommenter(Options{CommentQueries: true})
+	if got := c.comment(context.Background(), "SELECT 1"); got != "SELECT 1" {
+		t.Errorf("query without tags commented as %q", got)
+	}
+	ctx := WithOperation(context.Background(), "list users")
+	if got, want := c.comment(ctx, "SELECT 1;"), "SELECT 1 /*operation='list%20users'*/;"; got != want {
+		t.Errorf("comment = %q, want %q", got, want)
+	}
+	if got := newCommenter(Options{}).comment(ctx, "SELECT 1"); got != "SELECT 1" {
+		t.Errorf("query commented without CommentQueries as %q", got)
+	}
+}
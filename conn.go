@@ -0,0 +1,61 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Conn is a dedicated connection checked out of a registered DB with
+// Collector.Conn. It is counted in dedicated_connections_in_use until it is
+// closed, and how long it was held is observed in
+// dedicated_connection_hold_duration_seconds then.
+type Conn struct {
+	*sql.Conn
+
+	once    sync.Once
+	start   time.Time
+	inUse   prometheus.Gauge
+	hold    prometheus.Observer
+	durUnit DurationUnit
+}
+
+// Conn checks a dedicated connection out of the registered db, as db.Conn
+// does, for session pinned work such as advisory locks and temporary
+// tables, which holds a connection of the pool for as long as the
+// connection is open. Close it to return it to the pool.
+func (c *Collector) Conn(ctx context.Context, db *sql.DB) (*Conn, error) {
+	c.l.Lock()
+	e, ok := c.dbs[db]
+	c.l.Unlock()
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+	labelValues := c.refreshLabels(e)
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inUse := c.q.dedicatedInUse.WithLabelValues(labelValues...)
+	inUse.Inc()
+	return &Conn{
+		Conn:    conn,
+		start:   time.Now(),
+		inUse:   inUse,
+		hold:    c.q.dedicatedHold.WithLabelValues(labelValues...),
+		durUnit: c.o.DurationUnit,
+	}, nil
+}
+
+// Close returns the connection to the pool, as sql.Conn.Close does
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		c.inUse.Dec()
+		c.hold.Observe(c.durUnit.value(time.Since(c.start)))
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,79 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// RegisteredDB describes a registered DB, as Registered and DebugHandler
+// report it
+type RegisteredDB struct {
+	// Labels maps each of Options.Labels, or of the labels of the DB's
+	// LabelGroup, to the DB's label value
+	Labels map[string]string `json:"labels"`
+	// Name is the name of DBs registered with RegisterNamed
+	Name string `json:"name,omitempty"`
+	// Driver is the driver name of DBs registered with one
+	Driver     string    `json:"driver,omitempty"`
+	Registered time.Time `json:"registered"`
+	// Stats are the DB's live stats
+	Stats sql.DBStats `json:"stats"`
+	// LastCollected is when the DB was last collected, if it has been, and
+	// LastCollectedStats the stats emitted for it then
+	LastCollected      *time.Time   `json:"last_collected,omitempty"`
+	LastCollectedStats *sql.DBStats `json:"last_collected_stats,omitempty"`
+}
+
+// collectedStats are the stats emitted for a DB by a collection
+type collectedStats struct {
+	at    time.Time
+	stats sql.DBStats
+}
+
+// Registered returns the registered DBs in collection order, with their
+// live and last collected stats, so operators can check that what they
+// expect to be registered is. Reading the live stats doesn't affect
+// collections. DBs whose stats can't be read are left out.
+func (c *Collector) Registered() []RegisteredDB {
+	samples := c.readSnapshot()
+	dbs := make([]RegisteredDB, len(samples))
+	for i, s := range samples {
+		dbs[i] = RegisteredDB{
+			Labels:     c.entryLabelMap(s.entry, s.labelValues),
+			Name:       s.entry.name,
+			Driver:     s.entry.driverName,
+			Registered: s.entry.registered,
+			Stats:      s.stats,
+		}
+		if collected := s.entry.collected.Load(); collected != nil {
+			dbs[i].LastCollected = &collected.at
+			dbs[i].LastCollectedStats = &collected.stats
+		}
+	}
+	return dbs
+}
+
+// DebugHandler returns an http.Handler serving the Registered DBs as JSON,
+// along with when the collector was last collected, for debugging without
+// a metrics backend.
+func (c *Collector) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dbs := c.Registered()
+
+		c.lastCollectMu.Lock()
+		var lastCollect *time.Time
+		if !c.lastCollect.IsZero() {
+			t := c.lastCollect
+			lastCollect = &t
+		}
+		c.lastCollectMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			LastCollect *time.Time     `json:"last_collect"`
+			DBs         []RegisteredDB `json:"dbs"`
+		}{lastCollect, dbs})
+	})
+}
@@ -0,0 +1,1208 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MethodLabel is the label naming the driver method a query metric
+// observed.
+const MethodLabel = "method"
+
+// ErrorClassLabel is the label classifying the error of a failed driver
+// operation.
+const ErrorClassLabel = "error_class"
+
+// Values of MethodLabel
+const (
+	MethodQuery    = "query"
+	MethodExec     = "exec"
+	MethodPrepare  = "prepare"
+	MethodBegin    = "begin"
+	MethodCommit   = "commit"
+	MethodRollback = "rollback"
+)
+
+// queryMetrics are the metrics recorded by wrapped drivers and connectors
+type queryMetrics struct {
+	duration prometheus.ObserverVec
+	errors   *prometheus.CounterVec
+	canceled *prometheus.CounterVec
+	deadline *prometheus.CounterVec
+
+	// total and sampleRate are set if QuerySampleRate samples duration
+	total      *prometheus.CounterVec
+	sampleRate float64
+
+	txBegun      *prometheus.CounterVec
+	txCommitted  *prometheus.CounterVec
+	txRolledBack *prometheus.CounterVec
+	txFailed     *prometheus.CounterVec
+	txDuration   *prometheus.HistogramVec
+	txOpen       *prometheus.GaugeVec
+
+	stmtsPrepared *prometheus.CounterVec
+	stmtsClosed   *prometheus.CounterVec
+	stmtsOpen     *prometheus.GaugeVec
+
+	rows          *prometheus.HistogramVec
+	rowsIteration *prometheus.HistogramVec
+
+	acquire *prometheus.HistogramVec
+
+	establish    *prometheus.HistogramVec
+	connLifetime *prometheus.HistogramVec
+
+	dedicatedInUse *prometheus.GaugeVec
+	dedicatedHold  *prometheus.HistogramVec
+
+	connsOpened     *prometheus.CounterVec
+	connsClosed     *prometheus.CounterVec
+	connsOpenErrors *prometheus.CounterVec
+
+	slow       *slowQueries
+	statements *statementStats
+
+	retries        *prometheus.CounterVec
+	retryExhausted *prometheus.CounterVec
+
+	breakers *breakerMetrics
+
+	// events are delivered to the subscribers of Collector.Subscribe
+	events *eventBus
+
+	labelOverflows *prometheus.CounterVec
+	fingerprints   *labelLimiter
+	operations     *labelLimiter
+	statementKinds bool
+	tables         *labelLimiter
+
+	classify func(error) string
+	exemplar func(context.Context) prometheus.Labels
+	unit     DurationUnit
+
+	// emitted are the collectors of the metrics EnabledMetrics and
+	// DisabledMetrics don't filter out
+	emitted []prometheus.Collector
+}
+
+func newQueryMetrics(o Options) *queryMetrics {
+	labels := append(append([]string(nil), o.Labels...), MethodLabel)
+	if o.FingerprintQueries {
+		labels = append(labels, QueryFingerprintLabel)
+	}
+	if o.OperationLabel {
+		labels = append(labels, OperationLabel)
+	}
+	if o.StatementKindLabel {
+		labels = append(labels, StatementKindLabel)
+	}
+	if o.TableLabel {
+		labels = append(labels, TableLabel)
+	}
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName(name),
+			Help:        o.Help(name, help),
+			ConstLabels: o.metricConstLabels(name),
+		}, o.Labels)
+	}
+	durationHistogram := func(name, help string, buckets []float64, labels []string) *prometheus.HistogramVec {
+		opts := prometheus.HistogramOpts{
+			Name:        o.MetricName(name),
+			Help:        o.Help(name, help),
+			ConstLabels: o.metricConstLabels(name),
+			Buckets:     buckets,
+			Unit:        o.openMetricsUnit(o.MetricName(name)),
+		}
+		if buckets == nil {
+			opts.Buckets = o.DurationUnit.buckets(prometheus.DefBuckets)
+		}
+		if o.NativeHistogramBucketFactor > 1 {
+			opts.Buckets = nil
+			opts.NativeHistogramBucketFactor = o.NativeHistogramBucketFactor
+			opts.NativeHistogramMaxBucketNumber = 160
+			opts.NativeHistogramMinResetDuration = time.Hour
+		}
+		return prometheus.NewHistogramVec(opts, labels)
+	}
+	lifetimeBuckets := o.ConnectionLifetimeBuckets
+	if lifetimeBuckets == nil {
+		lifetimeBuckets = o.DurationUnit.buckets(prometheus.ExponentialBuckets(1, 4, 8))
+	}
+	holdBuckets := o.DedicatedConnHoldBuckets
+	if holdBuckets == nil {
+		holdBuckets = o.DurationUnit.buckets(prometheus.ExponentialBuckets(0.001, 4, 10))
+	}
+	rowsBuckets := o.QueryRowsBuckets
+	if rowsBuckets == nil {
+		rowsBuckets = prometheus.ExponentialBuckets(1, 4, 8)
+	}
+	classify := o.ClassifyError
+	if classify == nil {
+		classify = ErrorClass
+	}
+	events := &eventBus{}
+	q := &queryMetrics{
+		duration: durationHistogram(
+			"query_duration_seconds",
+			"How long driver operations took in seconds",
+			o.QueryDurationBuckets, labels,
+		),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("queries_errors_total"),
+			Help:        o.Help("queries_errors_total", "The total number of driver operations that failed"),
+			ConstLabels: o.metricConstLabels("queries_errors_total"),
+		}, append(labels, ErrorClassLabel)),
+		canceled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("queries_canceled_total"),
+			Help:        o.Help("queries_canceled_total", "The total number of driver operations that failed as their context was canceled"),
+			ConstLabels: o.metricConstLabels("queries_canceled_total"),
+		}, append(append([]string(nil), o.Labels...), MethodLabel)),
+		deadline: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("queries_deadline_exceeded_total"),
+			Help:        o.Help("queries_deadline_exceeded_total", "The total number of driver operations that failed as their context's deadline passed"),
+			ConstLabels: o.metricConstLabels("queries_deadline_exceeded_total"),
+		}, append(append([]string(nil), o.Labels...), MethodLabel)),
+
+		txBegun:      counter("transactions_begun_total", "The total number of transactions begun"),
+		txCommitted:  counter("transactions_committed_total", "The total number of transactions committed"),
+		txRolledBack: counter("transactions_rolled_back_total", "The total number of transactions rolled back"),
+		txFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("transactions_failed_total"),
+			Help:        o.Help("transactions_failed_total", "The total number of transaction commits and rollbacks that failed, by method"),
+			ConstLabels: o.metricConstLabels("transactions_failed_total"),
+		}, append(append([]string(nil), o.Labels...), MethodLabel)),
+		txDuration: durationHistogram(
+			"transaction_duration_seconds",
+			"How long transactions were open for, from begin to commit or rollback, in seconds",
+			o.TransactionDurationBuckets, o.Labels,
+		),
+		txOpen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        o.MetricName("transactions_open"),
+			Help:        o.Help("transactions_open", "The number of transactions currently open"),
+			ConstLabels: o.metricConstLabels("transactions_open"),
+		}, o.Labels),
+
+		stmtsPrepared: counter("statements_prepared_total", "The total number of statements prepared"),
+		stmtsClosed:   counter("statements_closed_total", "The total number of prepared statements closed"),
+		stmtsOpen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        o.MetricName("statements_open"),
+			Help:        o.Help("statements_open", "The number of prepared statements currently open"),
+			ConstLabels: o.metricConstLabels("statements_open"),
+		}, o.Labels),
+
+		rows: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        o.MetricName("query_rows"),
+			Help:        o.Help("query_rows", "The number of rows read from each query's results"),
+			ConstLabels: o.metricConstLabels("query_rows"),
+			Buckets:     rowsBuckets,
+		}, o.Labels),
+		rowsIteration: durationHistogram(
+			"rows_iteration_duration_seconds",
+			"How long each query's results were open for, from the query returning to the rows being closed, in seconds",
+			o.RowsIterationDurationBuckets, o.Labels,
+		),
+
+		acquire: durationHistogram(
+			"connection_acquire_duration_seconds",
+			"How long the driver took to hand out a connection, opening a new one or resetting a reused one, in seconds",
+			o.AcquireDurationBuckets, o.Labels,
+		),
+
+		establish: durationHistogram(
+			"connection_establish_duration_seconds",
+			"How long the driver took to open new connections, including DNS, TCP, TLS and authentication, in seconds",
+			o.ConnectionEstablishDurationBuckets, o.Labels,
+		),
+		connLifetime: durationHistogram(
+			"connection_lifetime_seconds",
+			"How long connections lived, from the driver opening them to closing them, in seconds",
+			lifetimeBuckets, o.Labels,
+		),
+
+		dedicatedInUse: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        o.MetricName("dedicated_connections_in_use"),
+			Help:        o.Help("dedicated_connections_in_use", "The number of dedicated connections checked out with Collector.Conn and not yet closed"),
+			ConstLabels: o.metricConstLabels("dedicated_connections_in_use"),
+		}, o.Labels),
+		dedicatedHold: durationHistogram(
+			"dedicated_connection_hold_duration_seconds",
+			"How long dedicated connections checked out with Collector.Conn were held, in seconds",
+			holdBuckets, o.Labels,
+		),
+
+		connsOpened: counter("connections_opened_total", "The total number of connections opened by the driver"),
+		connsClosed: counter("connections_closed_total", "The total number of connections closed by the driver"),
+		connsOpenErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("connections_open_errors_total"),
+			Help:        o.Help("connections_open_errors_total", "The total number of connections the driver failed to open"),
+			ConstLabels: o.metricConstLabels("connections_open_errors_total"),
+		}, append(append([]string(nil), o.Labels...), ErrorClassLabel)),
+
+		slow:       newSlowQueries(o, events),
+		statements: newStatementStats(o),
+
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("query_retries_total"),
+			Help:        o.Help("query_retries_total", "The total number of retries of operations by Retriers"),
+			ConstLabels: o.metricConstLabels("query_retries_total"),
+		}, append(append([]string(nil), o.Labels...), MethodLabel)),
+		retryExhausted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("retry_exhausted_total"),
+			Help:        o.Help("retry_exhausted_total", "The total number of operations by Retriers that failed on their last attempt"),
+			ConstLabels: o.metricConstLabels("retry_exhausted_total"),
+		}, append(append([]string(nil), o.Labels...), MethodLabel)),
+
+		breakers: newBreakerMetrics(o, events),
+		events:   events,
+
+		labelOverflows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("query_label_overflows_total"),
+			Help:        o.Help("query_label_overflows_total", "The total number of observations whose dynamic label value was replaced by other, past Options.MaxQueryLabelValues"),
+			ConstLabels: o.metricConstLabels("query_label_overflows_total"),
+		}, []string{"label"}),
+
+		classify: classify,
+		exemplar: o.ExemplarFromContext,
+		unit:     o.DurationUnit,
+
+		statementKinds: o.StatementKindLabel,
+	}
+	if len(o.QueryDurationObjectives) > 0 {
+		q.duration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:        o.MetricName("query_duration_seconds"),
+			Help:        o.Help("query_duration_seconds", "How long driver operations took in seconds"),
+			ConstLabels: o.metricConstLabels("query_duration_seconds"),
+			Objectives:  o.QueryDurationObjectives,
+			Unit:        o.openMetricsUnit(o.MetricName("query_duration_seconds")),
+		}, labels)
+	}
+	if o.QuerySampleRate > 0 && o.QuerySampleRate < 1 {
+		q.sampleRate = o.QuerySampleRate
+		q.total = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("queries_total"),
+			Help:        o.Help("queries_total", "The total number of driver operations, sampled or not"),
+			ConstLabels: o.metricConstLabels("queries_total"),
+		}, labels)
+	}
+	if o.FingerprintQueries {
+		q.fingerprints = newLabelLimiter(o.MaxQueryLabelValues, q.labelOverflows, QueryFingerprintLabel)
+	}
+	if o.OperationLabel {
+		q.operations = newLabelLimiter(o.MaxQueryLabelValues, q.labelOverflows, OperationLabel)
+	}
+	if o.TableLabel {
+		q.tables = newLabelLimiter(o.MaxQueryLabelValues, q.labelOverflows, TableLabel)
+	}
+	for _, nc := range q.namedCollectors() {
+		if o.metricEnabled(nc.name) {
+			q.emitted = append(q.emitted, nc.c)
+		}
+	}
+	return q
+}
+
+// observeWithExemplar observes d in the DurationUnit, with the exemplar
+// of ctx if Options.ExemplarFromContext is set and returns one.
+func (q *queryMetrics) observeWithExemplar(ctx context.Context, o prometheus.Observer, d time.Duration) {
+	if q.exemplar != nil {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			if labels := q.exemplar(ctx); len(labels) > 0 {
+				eo.ObserveWithExemplar(q.unit.value(d), labels)
+				return
+			}
+		}
+	}
+	o.Observe(q.unit.value(d))
+}
+
+// namedCollector is a collector of a single metric with its name without
+// Prefix, Namespace or Subsystem
+type namedCollector struct {
+	name string
+	c    prometheus.Collector
+}
+
+// namedCollectors returns every collector of the query metrics
+func (q *queryMetrics) namedCollectors() []namedCollector {
+	cs := []namedCollector{
+		{"query_duration_seconds", q.duration},
+		{"queries_errors_total", q.errors},
+		{"queries_canceled_total", q.canceled},
+		{"queries_deadline_exceeded_total", q.deadline},
+		{"transactions_begun_total", q.txBegun},
+		{"transactions_committed_total", q.txCommitted},
+		{"transactions_rolled_back_total", q.txRolledBack},
+		{"transactions_failed_total", q.txFailed},
+		{"transaction_duration_seconds", q.txDuration},
+		{"transactions_open", q.txOpen},
+		{"statements_prepared_total", q.stmtsPrepared},
+		{"statements_closed_total", q.stmtsClosed},
+		{"statements_open", q.stmtsOpen},
+		{"query_rows", q.rows},
+		{"rows_iteration_duration_seconds", q.rowsIteration},
+		{"connection_acquire_duration_seconds", q.acquire},
+		{"connection_establish_duration_seconds", q.establish},
+		{"connection_lifetime_seconds", q.connLifetime},
+		{"dedicated_connections_in_use", q.dedicatedInUse},
+		{"dedicated_connection_hold_duration_seconds", q.dedicatedHold},
+		{"connections_opened_total", q.connsOpened},
+		{"connections_closed_total", q.connsClosed},
+		{"connections_open_errors_total", q.connsOpenErrors},
+		{"query_retries_total", q.retries},
+		{"retry_exhausted_total", q.retryExhausted},
+		{"query_label_overflows_total", q.labelOverflows},
+	}
+	if q.total != nil {
+		cs = append(cs, namedCollector{"queries_total", q.total})
+	}
+	if q.slow != nil {
+		cs = append(cs, namedCollector{"slow_queries_total", q.slow.total})
+	}
+	if q.breakers != nil {
+		cs = append(cs, q.breakers.namedCollectors()...)
+	}
+	return cs
+}
+
+func (q *queryMetrics) describe(ch chan<- *prometheus.Desc) {
+	for _, c := range q.emitted {
+		c.Describe(ch)
+	}
+}
+
+func (q *queryMetrics) collect(ch chan<- prometheus.Metric) {
+	for _, c := range q.emitted {
+		c.Collect(ch)
+	}
+}
+
+// ErrorClass is the default Options.ClassifyError. It returns
+// "context_canceled", "context_deadline_exceeded" or "driver_bad_conn" for
+// those errors, "sqlstate_" followed by the class (the first two
+// characters) of errors with a SQLState() string method, as the postgres
+// drivers' errors have, and "other" for anything else.
+func ErrorClass(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "context_canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "context_deadline_exceeded"
+	case errors.Is(err, driver.ErrBadConn):
+		return "driver_bad_conn"
+	}
+	var sqlState interface{ SQLState() string }
+	if errors.As(err, &sqlState) {
+		if state := sqlState.SQLState(); len(state) == 5 {
+			return "sqlstate_" + state[:2]
+		}
+	}
+	return "other"
+}
+
+// WrapConnector returns a connector whose connections record query metrics
+// on the collector with the given label values. Open the DB with
+// sql.OpenDB to use it.
+func (c *Collector) WrapConnector(connector driver.Connector, labelValues []string) (driver.Connector, error) {
+	i, err := c.instrument(labelValues)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedConnector{Connector: connector, i: i}, nil
+}
+
+// WrapDriver returns a driver whose connections record query metrics on
+// the collector with the given label values. Register it with
+// sql.Register to use it.
+func (c *Collector) WrapDriver(d driver.Driver, labelValues []string) (driver.Driver, error) {
+	i, err := c.instrument(labelValues)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedDriver{Driver: d, i: i}, nil
+}
+
+// Open opens a DB like sql.Open, with the driver wrapped by WrapDriver,
+// and registers it with the collector, for libraries such as sqlx and ent
+// that build on a *sql.DB.
+func (c *Collector) Open(driverName, dataSourceName string, labelValues []string) (*sql.DB, error) {
+	// sql.Open doesn't connect, it only looks up the driver
+	probe, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	d := probe.Driver()
+	probe.Close()
+
+	wrapped, err := c.WrapDriver(d, labelValues)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := wrapped.(driver.DriverContext).OpenConnector(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	return c.openWrapped(connector.(*wrappedConnector), driverName, labelValues)
+}
+
+// openWrapped opens a DB on a connector of WrapConnector or WrapDriver and
+// registers it with the collector, linking its entry to the connector's
+// acquisitions and closing. driverName, if known, is the name the driver was
+// registered under.
+func (c *Collector) openWrapped(connector *wrappedConnector, driverName string, labelValues []string) (*sql.DB, error) {
+	db := sql.OpenDB(connector)
+	e := &dbEntry{
+		labelValues:  labelValues,
+		driverName:   driverName,
+		acquisitions: &connector.i.acquisitions,
+		closed:       &connector.closed,
+	}
+	if err := c.register(db, e); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (c *Collector) instrument(labelValues []string) (*instrumentation, error) {
+	if len(labelValues) != len(c.o.Labels) {
+		return nil, fmt.Errorf("expected %d label values %v, got %d", len(c.o.Labels), c.o.Labels, len(labelValues))
+	}
+	labels := c.labelMap(labelValues)
+	return &instrumentation{
+		q:           c.q,
+		labelValues: append([]string(nil), labelValues...),
+		labels:      labels,
+		hooks:       c.o.QueryHooks,
+		commenter:   newCommenter(c.o),
+		breaker:     c.q.breakers.newBreaker(labelValues, labels),
+
+		txBegun:      c.q.txBegun.WithLabelValues(labelValues...),
+		txCommitted:  c.q.txCommitted.WithLabelValues(labelValues...),
+		txRolledBack: c.q.txRolledBack.WithLabelValues(labelValues...),
+		txCommitFailed: c.q.txFailed.WithLabelValues(
+			append(append([]string(nil), labelValues...), MethodCommit)...,
+		),
+		txRollbackFailed: c.q.txFailed.WithLabelValues(
+			append(append([]string(nil), labelValues...), MethodRollback)...,
+		),
+		txDuration: c.q.txDuration.WithLabelValues(labelValues...),
+		txOpen:     c.q.txOpen.WithLabelValues(labelValues...),
+
+		stmtsPrepared: c.q.stmtsPrepared.WithLabelValues(labelValues...),
+		stmtsClosed:   c.q.stmtsClosed.WithLabelValues(labelValues...),
+		stmtsOpen:     c.q.stmtsOpen.WithLabelValues(labelValues...),
+
+		rows:          c.q.rows.WithLabelValues(labelValues...),
+		rowsIteration: c.q.rowsIteration.WithLabelValues(labelValues...),
+
+		acquire: c.q.acquire.WithLabelValues(labelValues...),
+
+		establish:    c.q.establish.WithLabelValues(labelValues...),
+		connLifetime: c.q.connLifetime.WithLabelValues(labelValues...),
+
+		connsOpened: c.q.connsOpened.WithLabelValues(labelValues...),
+		connsClosed: c.q.connsClosed.WithLabelValues(labelValues...),
+	}, nil
+}
+
+// instrumentation records the query metrics of one wrapped driver or
+// connector
+type instrumentation struct {
+	q           *queryMetrics
+	labelValues []string
+	labels      map[string]string
+	hooks       []QueryHook
+	commenter   *commenter
+	breaker     *breaker
+
+	txBegun      prometheus.Counter
+	txCommitted  prometheus.Counter
+	txRolledBack prometheus.Counter
+	// Commits and rollbacks that failed, which don't count as committed
+	// or rolled back
+	txCommitFailed   prometheus.Counter
+	txRollbackFailed prometheus.Counter
+	txDuration       prometheus.Observer
+	txOpen           prometheus.Gauge
+
+	stmtsPrepared prometheus.Counter
+	stmtsClosed   prometheus.Counter
+	stmtsOpen     prometheus.Gauge
+
+	rows          prometheus.Observer
+	rowsIteration prometheus.Observer
+
+	acquire prometheus.Observer
+	// acquisitions counts the connections handed out, new or reused
+	acquisitions atomic.Uint64
+
+	establish    prometheus.Observer
+	connLifetime prometheus.Observer
+
+	connsOpened prometheus.Counter
+	connsClosed prometheus.Counter
+}
+
+// QueryEvent describes a driver operation of a wrapped driver or connector
+// to a QueryHook.
+type QueryEvent struct {
+	// Method is one of the MethodLabel values
+	Method string
+	// Query is the query of queries, execs and prepares, and of the
+	// queries and execs of prepared statements
+	Query string
+	// Labels maps each of Options.Labels to the label value the driver was
+	// wrapped with. It must not be modified.
+	Labels map[string]string
+	// Duration is how long the operation took. It is only set for After.
+	Duration time.Duration
+}
+
+// QueryHook is told about every driver operation of wrapped drivers and
+// connectors, for instrumentation beyond metrics such as tracing, logging
+// or auditing. Options.QueryHooks chain as middleware: Before hooks are
+// called in order, each passed the context returned by the previous one,
+// and After hooks in reverse order.
+type QueryHook interface {
+	// Before is called before the operation, and returns the context
+	// passed on to the driver and to After.
+	Before(ctx context.Context, e QueryEvent) context.Context
+	// After is called once the operation returned err.
+	After(ctx context.Context, e QueryEvent, err error)
+}
+
+// QueryHookFuncs is a QueryHook from a pair of functions, either of which
+// may be nil, for hooks such as logging or auditing that only care about
+// one side of the operation.
+type QueryHookFuncs struct {
+	BeforeFunc func(ctx context.Context, e QueryEvent) context.Context
+	AfterFunc  func(ctx context.Context, e QueryEvent, err error)
+}
+
+// Before calls BeforeFunc, if set
+func (h QueryHookFuncs) Before(ctx context.Context, e QueryEvent) context.Context {
+	if h.BeforeFunc == nil {
+		return ctx
+	}
+	return h.BeforeFunc(ctx, e)
+}
+
+// After calls AfterFunc, if set
+func (h QueryHookFuncs) After(ctx context.Context, e QueryEvent, err error) {
+	if h.AfterFunc != nil {
+		h.AfterFunc(ctx, e, err)
+	}
+}
+
+// operation is a driver operation in progress
+type operation struct {
+	i     *instrumentation
+	ctx   context.Context
+	event QueryEvent
+	start time.Time
+
+	// admitted is set for operations let through by the circuit breaker,
+	// and trial for the trials of a half-open one
+	admitted bool
+	trial    bool
+}
+
+// start begins an operation, running the Before hooks
+func (i *instrumentation) start(ctx context.Context, method, query string) (context.Context, *operation) {
+	e := QueryEvent{Method: method, Query: query, Labels: i.labels}
+	for _, h := range i.hooks {
+		ctx = h.Before(ctx, e)
+	}
+	return ctx, &operation{i: i, ctx: ctx, event: e, start: time.Now()}
+}
+
+// admit begins an operation if the circuit breaker, if any, lets it
+// through, and otherwise returns ErrCircuitOpen
+func (i *instrumentation) admit(ctx context.Context, method, query string) (context.Context, *operation, error) {
+	trial, err := i.breaker.allow()
+	if err != nil {
+		return ctx, nil, err
+	}
+	ctx, op := i.start(ctx, method, query)
+	op.admitted, op.trial = true, trial
+	return ctx, op, nil
+}
+
+// end records the operation and runs the After hooks, in reverse order
+func (op *operation) end(err error) {
+	op.event.Duration = time.Since(op.start)
+	op.i.q.observe(op.ctx, op.i.labelValues, op.event.Method, op.event.Query, op.event.Duration, err)
+	op.i.q.slow.observe(op.ctx, op.i.labelValues, op.event, err)
+	op.i.q.statements.observe(op.i.labelValues, op.event, err)
+	if op.admitted {
+		op.i.breaker.record(op.trial, op.event.Duration, err)
+	}
+	for j := len(op.i.hooks) - 1; j >= 0; j-- {
+		op.i.hooks[j].After(op.ctx, op.event, err)
+	}
+}
+
+// observe records an operation that took d, and its error if it failed.
+// Calls that return driver.ErrSkip never reached the database and aren't
+// recorded.
+func (q *queryMetrics) observe(ctx context.Context, labelValues []string, method, query string, d time.Duration, err error) {
+	if errors.Is(err, driver.ErrSkip) {
+		return
+	}
+	lv := append(append(make([]string, 0, len(labelValues)+6), labelValues...), method)
+	if q.fingerprints != nil {
+		lv = append(lv, q.fingerprints.value(Fingerprint(query)))
+	}
+	if q.operations != nil {
+		lv = append(lv, q.operations.value(OperationFromContext(ctx)))
+	}
+	if q.statementKinds {
+		lv = append(lv, StatementKind(query))
+	}
+	if q.tables != nil {
+		lv = append(lv, q.tables.value(TableName(query)))
+	}
+	if q.sampleRate == 0 || rand.Float64() < q.sampleRate {
+		q.observeWithExemplar(ctx, q.duration.WithLabelValues(lv...), d)
+	}
+	if q.total != nil {
+		q.total.WithLabelValues(lv...).Inc()
+	}
+	if err != nil {
+		q.errors.WithLabelValues(append(lv, q.classify(err))...).Inc()
+		q.observeContextError(ctx, lv[:len(labelValues)+1], err)
+	}
+}
+
+// observeContextError counts err if the operation failed due to its
+// context. Drivers don't always wrap the context's error, so an operation
+// that failed once its context was done is counted too.
+func (q *queryMetrics) observeContextError(ctx context.Context, labelValues []string, err error) {
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		err = ctx.Err()
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		q.canceled.WithLabelValues(labelValues...).Inc()
+	case errors.Is(err, context.DeadlineExceeded):
+		q.deadline.WithLabelValues(labelValues...).Inc()
+	}
+}
+
+// ObserveOperation records an operation made other than through a wrapped
+// driver, such as by an ORM's callbacks, in the query metrics. method is
+// the operation's MethodLabel value.
+func (c *Collector) ObserveOperation(ctx context.Context, labelValues []string, method string, d time.Duration, err error) error {
+	if len(labelValues) != len(c.o.Labels) {
+		return fmt.Errorf("expected %d label values %v, got %d", len(c.o.Labels), c.o.Labels, len(labelValues))
+	}
+	c.q.observe(ctx, labelValues, method, "", d, err)
+	return nil
+}
+
+// connect opens a new connection with open
+func (i *instrumentation) connect(ctx context.Context, open func() (driver.Conn, error)) (driver.Conn, error) {
+	start := time.Now()
+	conn, err := open()
+	d := time.Since(start)
+	i.q.observeWithExemplar(ctx, i.acquire, d)
+	i.q.observeWithExemplar(ctx, i.establish, d)
+	if err != nil {
+		lv := append(append(make([]string, 0, len(i.labelValues)+1), i.labelValues...), i.q.classify(err))
+		i.q.connsOpenErrors.WithLabelValues(lv...).Inc()
+		i.q.events.publish(Event{Type: EventConnOpenFailed, Labels: i.labels, Duration: d, Err: err})
+		return nil, err
+	}
+	i.connsOpened.Inc()
+	i.acquisitions.Add(1)
+	i.q.events.publish(Event{Type: EventConnOpened, Labels: i.labels, Duration: d})
+	return &wrappedConn{Conn: conn, i: i, opened: time.Now()}, nil
+}
+
+type wrappedDriver struct {
+	driver.Driver
+	i *instrumentation
+}
+
+func (d *wrappedDriver) Open(name string) (driver.Conn, error) {
+	return d.i.connect(context.Background(), func() (driver.Conn, error) {
+		return d.Driver.Open(name)
+	})
+}
+
+func (d *wrappedDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.Driver.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &wrappedConnector{Connector: connector, i: d.i, d: d}, nil
+	}
+	return &wrappedConnector{Connector: dsnConnector{name: name, d: d.Driver}, i: d.i, d: d}, nil
+}
+
+// dsnConnector is the connector of a driver that doesn't implement
+// driver.DriverContext
+type dsnConnector struct {
+	name string
+	d    driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.d.Open(c.name)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.d
+}
+
+type wrappedConnector struct {
+	driver.Connector
+	i *instrumentation
+	// d is the wrapped driver the connector was opened from, if any
+	d driver.Driver
+	// closed is set once the connector is closed, as sql.DB.Close does
+	closed atomic.Bool
+}
+
+func (c *wrappedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.i.connect(ctx, func() (driver.Conn, error) {
+		return c.Connector.Connect(ctx)
+	})
+}
+
+func (c *wrappedConnector) Driver() driver.Driver {
+	if c.d != nil {
+		return c.d
+	}
+	return &wrappedDriver{Driver: c.Connector.Driver(), i: c.i}
+}
+
+// Close closes the wrapped connector if it is an io.Closer, as sql.DB.Close
+// would have.
+func (c *wrappedConnector) Close() error {
+	c.closed.Store(true)
+	if closer, ok := c.Connector.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// wrappedConn implements every optional connection interface, falling back
+// to what database/sql would have done when the wrapped conn doesn't.
+type wrappedConn struct {
+	driver.Conn
+	i      *instrumentation
+	opened time.Time
+}
+
+// Close closes the connection. database/sql closes a driver.Conn exactly
+// once.
+func (c *wrappedConn) Close() error {
+	lifetime := time.Since(c.opened)
+	c.i.connsClosed.Inc()
+	c.i.connLifetime.Observe(c.i.q.unit.value(lifetime))
+	c.i.q.events.publish(Event{Type: EventConnClosed, Labels: c.i.labels, Duration: lifetime})
+	return c.Conn.Close()
+}
+
+func (c *wrappedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *wrappedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	ctx, op, err := c.i.admit(ctx, MethodPrepare, query)
+	if err != nil {
+		return nil, err
+	}
+	sent := c.i.commenter.comment(ctx, query)
+	var stmt driver.Stmt
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, sent)
+	} else {
+		stmt, err = c.Conn.Prepare(sent)
+	}
+	op.end(err)
+	if err != nil {
+		return nil, err
+	}
+	c.i.stmtsPrepared.Inc()
+	c.i.stmtsOpen.Inc()
+	return &wrappedStmt{Stmt: stmt, conn: c.Conn, query: query, i: c.i}, nil
+}
+
+func (c *wrappedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *wrappedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	bc, ok := c.Conn.(driver.ConnBeginTx)
+	if !ok {
+		if opts.Isolation != driver.IsolationLevel(0) {
+			return nil, errors.New("sql: driver does not support non-default isolation level")
+		}
+		if opts.ReadOnly {
+			return nil, errors.New("sql: driver does not support read-only transactions")
+		}
+	}
+
+	start := time.Now()
+	opCtx, op, err := c.i.admit(ctx, MethodBegin, "")
+	if err != nil {
+		return nil, err
+	}
+	var tx driver.Tx
+	if ok {
+		tx, err = bc.BeginTx(opCtx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	op.end(err)
+	if err != nil {
+		return nil, err
+	}
+	c.i.txBegun.Inc()
+	c.i.txOpen.Inc()
+	return &wrappedTx{Tx: tx, i: c.i, ctx: ctx, start: start}, nil
+}
+
+func (c *wrappedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, hasContext := c.Conn.(driver.ExecerContext)
+	e, ok := c.Conn.(driver.Execer)
+	if !hasContext && !ok {
+		return nil, driver.ErrSkip
+	}
+	var values []driver.Value
+	if !hasContext {
+		var err error
+		if values, err = namedValueToValue(args); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, op, err := c.i.admit(ctx, MethodExec, query)
+	if err != nil {
+		return nil, err
+	}
+	sent := c.i.commenter.comment(ctx, query)
+	var res driver.Result
+	if hasContext {
+		res, err = ec.ExecContext(ctx, sent, args)
+	} else {
+		res, err = e.Exec(sent, values)
+	}
+	op.end(err)
+	return res, err
+}
+
+func (c *wrappedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, hasContext := c.Conn.(driver.QueryerContext)
+	q, ok := c.Conn.(driver.Queryer)
+	if !hasContext && !ok {
+		return nil, driver.ErrSkip
+	}
+	var values []driver.Value
+	if !hasContext {
+		var err error
+		if values, err = namedValueToValue(args); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, op, err := c.i.admit(ctx, MethodQuery, query)
+	if err != nil {
+		return nil, err
+	}
+	sent := c.i.commenter.comment(ctx, query)
+	var rows driver.Rows
+	if hasContext {
+		rows, err = qc.QueryContext(ctx, sent, args)
+	} else {
+		rows, err = q.Query(sent, values)
+	}
+	op.end(err)
+	return c.i.wrapRows(rows, err)
+}
+
+func (c *wrappedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession is called when database/sql hands out a reused connection,
+// and is timed as its acquisition.
+func (c *wrappedConn) ResetSession(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() {
+		c.i.q.observeWithExemplar(ctx, c.i.acquire, time.Since(start))
+		if err == nil {
+			c.i.acquisitions.Add(1)
+		}
+	}()
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *wrappedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *wrappedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// wrappedTx is an open transaction. database/sql commits or rolls back a
+// driver.Tx exactly once.
+type wrappedTx struct {
+	driver.Tx
+	i *instrumentation
+	// ctx is the context the transaction was begun with, as commit and
+	// rollback don't take one
+	ctx   context.Context
+	start time.Time
+}
+
+func (tx *wrappedTx) Commit() error {
+	_, op := tx.i.start(tx.ctx, MethodCommit, "")
+	err := tx.Tx.Commit()
+	op.end(err)
+	if err == nil {
+		tx.i.txCommitted.Inc()
+	} else {
+		tx.i.txCommitFailed.Inc()
+	}
+	tx.end()
+	return err
+}
+
+func (tx *wrappedTx) Rollback() error {
+	_, op := tx.i.start(tx.ctx, MethodRollback, "")
+	err := tx.Tx.Rollback()
+	op.end(err)
+	if err == nil {
+		tx.i.txRolledBack.Inc()
+	} else {
+		tx.i.txRollbackFailed.Inc()
+	}
+	tx.end()
+	return err
+}
+
+func (tx *wrappedTx) end() {
+	tx.i.txOpen.Dec()
+	tx.i.txDuration.Observe(tx.i.q.unit.value(time.Since(tx.start)))
+}
+
+type wrappedStmt struct {
+	driver.Stmt
+	// conn is the wrapped conn the statement was prepared on
+	conn  driver.Conn
+	query string
+	i     *instrumentation
+}
+
+// Close closes the statement. database/sql closes a driver.Stmt exactly
+// once.
+func (s *wrappedStmt) Close() error {
+	s.i.stmtsClosed.Inc()
+	s.i.stmtsOpen.Dec()
+	return s.Stmt.Close()
+}
+
+func (s *wrappedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.exec(context.Background(), args)
+}
+
+func (s *wrappedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.queryValues(context.Background(), args)
+}
+
+func (s *wrappedStmt) exec(ctx context.Context, args []driver.Value) (driver.Result, error) {
+	_, op, err := s.i.admit(ctx, MethodExec, s.query)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.Stmt.Exec(args)
+	op.end(err)
+	return res, err
+}
+
+func (s *wrappedStmt) queryValues(ctx context.Context, args []driver.Value) (driver.Rows, error) {
+	_, op, err := s.i.admit(ctx, MethodQuery, s.query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.Stmt.Query(args)
+	op.end(err)
+	return s.i.wrapRows(rows, err)
+}
+
+func (s *wrappedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	sc, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		values, err := namedValueToValue(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.exec(ctx, values)
+	}
+	ctx, op, err := s.i.admit(ctx, MethodExec, s.query)
+	if err != nil {
+		return nil, err
+	}
+	res, err := sc.ExecContext(ctx, args)
+	op.end(err)
+	return res, err
+}
+
+func (s *wrappedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	sc, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		values, err := namedValueToValue(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.queryValues(ctx, values)
+	}
+	ctx, op, err := s.i.admit(ctx, MethodQuery, s.query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sc.QueryContext(ctx, args)
+	op.end(err)
+	return s.i.wrapRows(rows, err)
+}
+
+// CheckNamedValue checks with the statement, then the conn, as
+// database/sql would have.
+func (s *wrappedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	if nc, ok := s.conn.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (s *wrappedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if cc, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return cc.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+func (i *instrumentation) wrapRows(rows driver.Rows, err error) (driver.Rows, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedRows{Rows: rows, i: i, start: time.Now()}, nil
+}
+
+// wrappedRows implements every optional rows interface, returning what
+// database/sql would have assumed when the wrapped rows don't.
+type wrappedRows struct {
+	driver.Rows
+	i     *instrumentation
+	start time.Time
+	n     int
+}
+
+func (r *wrappedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.n++
+	}
+	return err
+}
+
+// Close closes the rows. database/sql closes a driver.Rows exactly once.
+func (r *wrappedRows) Close() error {
+	r.i.rowsIteration.Observe(r.i.q.unit.value(time.Since(r.start)))
+	r.i.rows.Observe(float64(r.n))
+	return r.Rows.Close()
+}
+
+func (r *wrappedRows) HasNextResultSet() bool {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *wrappedRows) NextResultSet() error {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.NextResultSet()
+	}
+	return io.EOF
+}
+
+func (r *wrappedRows) ColumnTypeScanType(index int) reflect.Type {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return ct.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *wrappedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return ct.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *wrappedRows) ColumnTypeLength(index int) (int64, bool) {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return ct.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *wrappedRows) ColumnTypeNullable(index int) (bool, bool) {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return ct.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+func (r *wrappedRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if ct, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return ct.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+// namedValueToValue converts args for drivers that predate named values,
+// as database/sql does.
+func namedValueToValue(named []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(named))
+	for n, param := range named {
+		if len(param.Name) > 0 {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[n] = param.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,839 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeDriverName is the name fakeDriver is registered under
+const fakeDriverName = "sqlmetrics-fake"
+
+func init() {
+	sql.Register(fakeDriverName, fakeDriver{})
+}
+
+// fakeDriverFailTx is the DSN of fakeDriver connections whose commits and
+// rollbacks fail
+const fakeDriverFailTx = "fail-tx"
+
+// fakeDriver is a driver whose connections open without a database and
+// support transactions only
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	return fakeConn{fail: dsn == fakeDriverFailTx}, nil
+}
+
+type fakeConn struct {
+	fail bool
+}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("statements aren't supported")
+}
+
+func (fakeConn) Close() error { return nil }
+
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx(c), nil }
+
+type fakeTx struct {
+	fail bool
+}
+
+func (tx fakeTx) Commit() error   { return tx.err() }
+func (tx fakeTx) Rollback() error { return tx.err() }
+
+func (tx fakeTx) err() error {
+	if tx.fail {
+		return errors.New("transaction failed")
+	}
+	return nil
+}
+
+func TestWaitRatio(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, EmitWaitRatio: true})
+	db, err := c.Open(fakeDriverName, "", []string{"main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	if err := c.RegisterDB(openTestDB(t), []string{"unwrapped"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"db": "main"}
+
+	// The first collection has no interval before it
+	assertAbsent(t, gather(t, c), "connections_wait_ratio", labels)
+
+	// Of two acquisitions, one waits for the other to be released
+	ctx := context.Background()
+	first, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan *sql.Conn)
+	go func() {
+		second, err := db.Conn(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- second
+	}()
+	for db.Stats().WaitCount == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	first.Close()
+	if second := <-acquired; second != nil {
+		second.Close()
+	}
+
+	families := gather(t, c)
+	assertValue(t, families, "connections_wait_ratio", labels, 0.5)
+	// DBs without a wrapped driver don't count their acquisitions
+	assertAbsent(t, families, "connections_wait_ratio", map[string]string{"db": "unwrapped"})
+
+	assertValue(t, gather(t, c), "connections_wait_ratio", labels, 0)
+}
+
+func TestTransactionOutcomes(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	for _, name := range []string{"ok", fakeDriverFailTx} {
+		db, err := c.Open(fakeDriverName, name, []string{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		for _, commit := range []bool{true, false} {
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commit {
+				tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+	}
+
+	families := gather(t, c)
+	ok := map[string]string{"db": "ok"}
+	assertValue(t, families, "transactions_committed_total", ok, 1)
+	assertValue(t, families, "transactions_rolled_back_total", ok, 1)
+	assertValue(t, families, "transactions_failed_total", map[string]string{"db": "ok", "method": MethodCommit}, 0)
+
+	// Failed commits and rollbacks count as failures only
+	failed := map[string]string{"db": fakeDriverFailTx}
+	assertValue(t, families, "transactions_committed_total", failed, 0)
+	assertValue(t, families, "transactions_rolled_back_total", failed, 0)
+	for _, method := range []string{MethodCommit, MethodRollback} {
+		assertValue(t, families, "transactions_failed_total", map[string]string{"db": fakeDriverFailTx, "method": method}, 1)
+	}
+}
+
+// fakeConnector is a connector of fakeDriver connections
+type fakeConnector struct{}
+
+func (fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn{}, nil }
+func (fakeConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+func TestOpenEntryPoints(t *testing.T) {
+	c := NewCollector(Options{
+		Labels:               []string{"db"},
+		EmitWaitRatio:        true,
+		PerMetricConstLabels: map[string]prometheus.Labels{"transactions_begun_total": {"team": "core"}},
+	})
+	open := map[string]func() (*sql.DB, error){
+		"method": func() (*sql.DB, error) { return c.Open(fakeDriverName, "", []string{"method"}) },
+		"open": func() (*sql.DB, error) {
+			return Open(fakeDriverName, "", WithCollector(c), WithDBLabels(map[string]string{"db": "open"}))
+		},
+		"opendb": func() (*sql.DB, error) {
+			return OpenDB(fakeConnector{}, WithCollector(c), WithDBLabels(map[string]string{"db": "opendb"}))
+		},
+	}
+	for name, open := range open {
+		db, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		t.Cleanup(func() { db.Close() })
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+	}
+
+	gather(t, c)
+	families := gather(t, c)
+	for name := range open {
+		labels := map[string]string{"db": name}
+		// Every entry point links the DB to its connector's acquisitions
+		assertValue(t, families, "connections_wait_ratio", labels, 0)
+		assertValue(t, families, "transactions_begun_total", map[string]string{"db": name, "team": "core"}, 1)
+	}
+}
+
+// assertCount fails t unless families has the histogram name with exactly
+// labels and want observations
+func assertCount(t testing.TB, families map[string]*dto.MetricFamily, name string, labels map[string]string, want uint64) {
+	t.Helper()
+	m := findMetric(families, name, labels)
+	if m.GetHistogram() == nil {
+		t.Errorf("no histogram %s%v emitted", name, labels)
+	} else if got := m.GetHistogram().GetSampleCount(); got != want {
+		t.Errorf("%s%v has %d observations, want %d", name, labels, got, want)
+	}
+}
+
+// failQuery is the query fake conns and statements fail, and skipQuery the
+// one contextConn leaves to a prepared statement with driver.ErrSkip
+const (
+	failQuery = "SELECT fail"
+	skipQuery = "SELECT skip"
+)
+
+var errFakeQuery = errors.New("query failed")
+
+// driverCalls counts the methods of fake conns, statements and rows called
+type driverCalls struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *driverCalls) record(method string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = make(map[string]int)
+	}
+	c.calls[method]++
+}
+
+func (c *driverCalls) count(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[method]
+}
+
+// prepareConn is a conn with none of the optional interfaces, which
+// database/sql runs every query and exec of as a prepared statement
+type prepareConn struct {
+	calls *driverCalls
+}
+
+func (c *prepareConn) Prepare(query string) (driver.Stmt, error) {
+	c.calls.record("Prepare")
+	if query == failQuery {
+		return nil, errFakeQuery
+	}
+	return &legacyStmt{calls: c.calls}, nil
+}
+
+func (c *prepareConn) Close() error { return nil }
+
+func (c *prepareConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+// legacyConn is a conn with the interfaces that predate contexts
+type legacyConn struct {
+	prepareConn
+}
+
+func (c *legacyConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	c.calls.record("Exec")
+	if query == failQuery {
+		return nil, errFakeQuery
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *legacyConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	c.calls.record("Query")
+	if query == failQuery {
+		return nil, errFakeQuery
+	}
+	return &legacyRows{n: 3}, nil
+}
+
+// contextConn is a conn with every optional interface
+type contextConn struct {
+	prepareConn
+	pingErr  error
+	resetErr error
+	invalid  bool
+	// isolation is the isolation level of the last BeginTx
+	isolation driver.IsolationLevel
+}
+
+func (c *contextConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c.calls.record("PrepareContext")
+	switch query {
+	case failQuery:
+		return nil, errFakeQuery
+	case "legacy":
+		return &legacyStmt{calls: c.calls}, nil
+	}
+	return &contextStmt{legacyStmt{calls: c.calls}}, nil
+}
+
+func (c *contextConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.isolation = opts.Isolation
+	return fakeTx{}, nil
+}
+
+func (c *contextConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.calls.record("ExecContext")
+	switch query {
+	case failQuery:
+		return nil, errFakeQuery
+	case skipQuery:
+		return nil, driver.ErrSkip
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *contextConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.calls.record("QueryContext")
+	switch query {
+	case failQuery:
+		return nil, errFakeQuery
+	case skipQuery:
+		return nil, driver.ErrSkip
+	}
+	return &contextRows{legacyRows{n: 3}}, nil
+}
+
+func (c *contextConn) Ping(context.Context) error { return c.pingErr }
+
+func (c *contextConn) ResetSession(context.Context) error {
+	c.calls.record("ResetSession")
+	return c.resetErr
+}
+
+func (c *contextConn) IsValid() bool { return !c.invalid }
+
+func (c *contextConn) CheckNamedValue(*driver.NamedValue) error {
+	c.calls.record("ConnCheckNamedValue")
+	return nil
+}
+
+// legacyStmt is a statement with none of the optional interfaces. Its
+// execs and queries fail if their first argument is "fail".
+type legacyStmt struct {
+	calls *driverCalls
+}
+
+func (s *legacyStmt) Close() error  { return nil }
+func (s *legacyStmt) NumInput() int { return -1 }
+
+func (s *legacyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.calls.record("StmtExec")
+	if len(args) > 0 && args[0] == "fail" {
+		return nil, errFakeQuery
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *legacyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.calls.record("StmtQuery")
+	if len(args) > 0 && args[0] == "fail" {
+		return nil, errFakeQuery
+	}
+	return &legacyRows{n: 3}, nil
+}
+
+// contextStmt is a statement with every optional interface
+type contextStmt struct {
+	legacyStmt
+}
+
+func (s *contextStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	s.calls.record("StmtExecContext")
+	if len(args) > 0 && args[0].Value == "fail" {
+		return nil, errFakeQuery
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *contextStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	s.calls.record("StmtQueryContext")
+	if len(args) > 0 && args[0].Value == "fail" {
+		return nil, errFakeQuery
+	}
+	return &contextRows{legacyRows{n: 3}}, nil
+}
+
+func (s *contextStmt) CheckNamedValue(*driver.NamedValue) error {
+	s.calls.record("StmtCheckNamedValue")
+	return nil
+}
+
+func (s *contextStmt) ColumnConverter(int) driver.ValueConverter { return driver.Int32 }
+
+// legacyRows are n rows of a single column, with none of the optional
+// interfaces
+type legacyRows struct {
+	n, read int
+}
+
+func (r *legacyRows) Columns() []string { return []string{"n"} }
+func (r *legacyRows) Close() error      { return nil }
+
+func (r *legacyRows) Next(dest []driver.Value) error {
+	if r.read == r.n {
+		return io.EOF
+	}
+	r.read++
+	dest[0] = int64(r.read)
+	return nil
+}
+
+// contextRows are rows with every optional interface, and a second,
+// empty, result set
+type contextRows struct {
+	legacyRows
+}
+
+func (r *contextRows) HasNextResultSet() bool { return r.n > 0 }
+
+func (r *contextRows) NextResultSet() error {
+	if r.n == 0 {
+		return io.EOF
+	}
+	r.n, r.read = 0, 0
+	return nil
+}
+
+func (r *contextRows) ColumnTypeScanType(int) reflect.Type   { return reflect.TypeFor[int64]() }
+func (r *contextRows) ColumnTypeDatabaseTypeName(int) string { return "INT8" }
+func (r *contextRows) ColumnTypeLength(int) (int64, bool)    { return 8, true }
+func (r *contextRows) ColumnTypeNullable(int) (bool, bool)   { return true, true }
+func (r *contextRows) ColumnTypePrecisionScale(int) (int64, int64, bool) {
+	return 10, 2, true
+}
+
+// connFuncConnector is a connector of the conns of fn
+type connFuncConnector func() driver.Conn
+
+func (c connFuncConnector) Connect(context.Context) (driver.Conn, error) { return c(), nil }
+func (c connFuncConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+// openWrappedDB returns a DB of the conns of connect, wrapped by c with the
+// db label value name
+func openWrappedDB(t *testing.T, c *Collector, name string, connect func() driver.Conn) *sql.DB {
+	t.Helper()
+	connector, err := c.WrapConnector(connFuncConnector(connect), []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestWrappedConnOperations(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		conn func(calls *driverCalls) driver.Conn
+		// calls are the conn methods the operations reach
+		calls []string
+	}{
+		{"legacy", func(calls *driverCalls) driver.Conn { return &legacyConn{prepareConn{calls}} }, []string{"Exec", "Query", "Prepare"}},
+		{"context", func(calls *driverCalls) driver.Conn { return &contextConn{prepareConn: prepareConn{calls}} }, []string{"ExecContext", "QueryContext", "PrepareContext"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(Options{Labels: []string{"db"}})
+			calls := &driverCalls{}
+			db := openWrappedDB(t, c, tt.name, func() driver.Conn { return tt.conn(calls) })
+
+			if _, err := db.Exec("INSERT ok"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(failQuery); !errors.Is(err, errFakeQuery) {
+				t.Errorf("failed exec returned %v", err)
+			}
+			rows, err := db.Query("SELECT ok")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows.Close()
+			if _, err := db.Query(failQuery); !errors.Is(err, errFakeQuery) {
+				t.Errorf("failed query returned %v", err)
+			}
+			stmt, err := db.Prepare("SELECT ok")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stmt.Close()
+			if _, err := db.Prepare(failQuery); !errors.Is(err, errFakeQuery) {
+				t.Errorf("failed prepare returned %v", err)
+			}
+			for _, method := range tt.calls {
+				if calls.count(method) == 0 {
+					t.Errorf("the conn's %s wasn't called", method)
+				}
+			}
+
+			families := gather(t, c)
+			for _, method := range []string{MethodExec, MethodQuery, MethodPrepare} {
+				assertCount(t, families, "query_duration_seconds", map[string]string{"db": tt.name, "method": method}, 2)
+				assertValue(t, families, "queries_errors_total", map[string]string{"db": tt.name, "method": method, ErrorClassLabel: "other"}, 1)
+			}
+			assertValue(t, families, "statements_prepared_total", map[string]string{"db": tt.name}, 1)
+		})
+	}
+}
+
+func TestWrappedConnErrSkip(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		conn  func(calls *driverCalls) driver.Conn
+		query string
+	}{
+		// database/sql prepares the queries and execs of conns without
+		// Execer or Queryer, and of those returning driver.ErrSkip
+		{"prepare", func(calls *driverCalls) driver.Conn { return &prepareConn{calls} }, "SELECT ok"},
+		{"skip", func(calls *driverCalls) driver.Conn { return &contextConn{prepareConn: prepareConn{calls}} }, skipQuery},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(Options{Labels: []string{"db"}})
+			calls := &driverCalls{}
+			db := openWrappedDB(t, c, tt.name, func() driver.Conn { return tt.conn(calls) })
+
+			if _, err := db.Exec(tt.query); err != nil {
+				t.Fatal(err)
+			}
+			rows, err := db.Query(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows.Close()
+
+			// The skipped calls aren't recorded, only those of the
+			// statements replacing them
+			families := gather(t, c)
+			labels := map[string]string{"db": tt.name}
+			for method, want := range map[string]uint64{MethodExec: 1, MethodQuery: 1, MethodPrepare: 2} {
+				assertCount(t, families, "query_duration_seconds", map[string]string{"db": tt.name, "method": method}, want)
+			}
+			if len(families["queries_errors_total"].GetMetric()) != 0 {
+				t.Error("skipped calls counted as errors")
+			}
+			assertValue(t, families, "statements_prepared_total", labels, 2)
+			assertValue(t, families, "statements_closed_total", labels, 2)
+			assertValue(t, families, "statements_open", labels, 0)
+		})
+	}
+}
+
+func TestWrappedStmt(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		query string
+		// calls are the statement methods the execs and queries reach
+		calls []string
+	}{
+		{"legacy", "legacy", []string{"StmtExec", "StmtQuery"}},
+		{"context", "SELECT ok", []string{"StmtExecContext", "StmtQueryContext"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(Options{Labels: []string{"db"}})
+			calls := &driverCalls{}
+			db := openWrappedDB(t, c, tt.name, func() driver.Conn { return &contextConn{prepareConn: prepareConn{calls}} })
+			labels := map[string]string{"db": tt.name}
+
+			stmt, err := db.Prepare(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertValue(t, gather(t, c), "statements_open", labels, 1)
+			for _, arg := range []string{"ok", "fail"} {
+				if _, err := stmt.Exec(arg); (err != nil) != (arg == "fail") {
+					t.Errorf("exec with %s returned %v", arg, err)
+				}
+				rows, err := stmt.Query(arg)
+				if (err != nil) != (arg == "fail") {
+					t.Errorf("query with %s returned %v", arg, err)
+				}
+				if err == nil {
+					rows.Close()
+				}
+			}
+			stmt.Close()
+			for _, method := range tt.calls {
+				if calls.count(method) == 0 {
+					t.Errorf("the statement's %s wasn't called", method)
+				}
+			}
+
+			families := gather(t, c)
+			for _, method := range []string{MethodExec, MethodQuery} {
+				assertCount(t, families, "query_duration_seconds", map[string]string{"db": tt.name, "method": method}, 2)
+				assertValue(t, families, "queries_errors_total", map[string]string{"db": tt.name, "method": method, ErrorClassLabel: "other"}, 1)
+			}
+			assertValue(t, families, "statements_prepared_total", labels, 1)
+			assertValue(t, families, "statements_closed_total", labels, 1)
+			assertValue(t, families, "statements_open", labels, 0)
+		})
+	}
+}
+
+func TestWrappedRows(t *testing.T) {
+	type columnType struct {
+		scanType     reflect.Type
+		databaseType string
+		length       int64
+		hasLength    bool
+		nullable     bool
+		hasNullable  bool
+		precision    int64
+		scale        int64
+		hasDecimal   bool
+	}
+	for _, tt := range []struct {
+		name string
+		conn func(calls *driverCalls) driver.Conn
+		want columnType
+		// resultSets is the number of result sets of the rows
+		resultSets int
+	}{
+		// Rows without the optional interfaces get what database/sql
+		// would have assumed
+		{"legacy", func(calls *driverCalls) driver.Conn { return &legacyConn{prepareConn{calls}} }, columnType{scanType: reflect.TypeFor[any]()}, 1},
+		{"context", func(calls *driverCalls) driver.Conn { return &contextConn{prepareConn: prepareConn{calls}} }, columnType{
+			scanType: reflect.TypeFor[int64](), databaseType: "INT8",
+			length: 8, hasLength: true,
+			nullable: true, hasNullable: true,
+			precision: 10, scale: 2, hasDecimal: true,
+		}, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(Options{Labels: []string{"db"}})
+			db := openWrappedDB(t, c, tt.name, func() driver.Conn { return tt.conn(&driverCalls{}) })
+
+			rows, err := db.Query("SELECT ok")
+			if err != nil {
+				t.Fatal(err)
+			}
+			types, err := rows.ColumnTypes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got columnType
+			ct := types[0]
+			got.scanType = ct.ScanType()
+			got.databaseType = ct.DatabaseTypeName()
+			got.length, got.hasLength = ct.Length()
+			got.nullable, got.hasNullable = ct.Nullable()
+			got.precision, got.scale, got.hasDecimal = ct.DecimalSize()
+			if got != tt.want {
+				t.Errorf("column type %+v, want %+v", got, tt.want)
+			}
+
+			resultSets, n := 0, 0
+			for {
+				resultSets++
+				for rows.Next() {
+					n++
+				}
+				if !rows.NextResultSet() {
+					break
+				}
+			}
+			if err := rows.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if resultSets != tt.resultSets {
+				t.Errorf("%d result sets, want %d", resultSets, tt.resultSets)
+			}
+
+			families := gather(t, c)
+			labels := map[string]string{"db": tt.name}
+			assertCount(t, families, "rows_iteration_duration_seconds", labels, 1)
+			assertCount(t, families, "query_rows", labels, 1)
+			if sum := findMetric(families, "query_rows", labels).GetHistogram().GetSampleSum(); sum != float64(n) || n != 3 {
+				t.Errorf("query_rows observed %g rows, read %d, want 3", sum, n)
+			}
+		})
+	}
+}
+
+func TestWrappedConnResetSession(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	calls := &driverCalls{}
+	conn := &contextConn{prepareConn: prepareConn{calls}}
+	connector, err := c.WrapConnector(connFuncConnector(func() driver.Conn { return conn }), []string{"main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquisitions := &connector.(*wrappedConnector).i.acquisitions
+	db := sql.OpenDB(connector)
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxIdleConns(1)
+
+	ctx := context.Background()
+	use := func() {
+		t.Helper()
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	use()
+	use()
+	if got := calls.count("ResetSession"); got != 1 {
+		t.Fatalf("ResetSession called %d times, want 1", got)
+	}
+	// Reusing a connection is timed as an acquisition, as opening one is
+	families := gather(t, c)
+	labels := map[string]string{"db": "main"}
+	assertCount(t, families, "connection_acquire_duration_seconds", labels, 2)
+	assertValue(t, families, "connections_opened_total", labels, 1)
+	if got := acquisitions.Load(); got != 2 {
+		t.Errorf("%d acquisitions, want 2", got)
+	}
+
+	// database/sql discards a conn that fails to reset and opens another,
+	// so the failed reset is timed but not counted as an acquisition
+	conn.resetErr = driver.ErrBadConn
+	use()
+	families = gather(t, c)
+	assertCount(t, families, "connection_acquire_duration_seconds", labels, 4)
+	assertValue(t, families, "connections_opened_total", labels, 2)
+	if got := acquisitions.Load(); got != 3 {
+		t.Errorf("%d acquisitions after a failed reset, want 3", got)
+	}
+}
+
+func TestWrappedConnOptionalInterfaces(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	ctx := context.Background()
+	wrap := func(conn driver.Conn) *wrappedConn {
+		t.Helper()
+		connector, err := c.WrapConnector(connFuncConnector(func() driver.Conn { return conn }), []string{"main"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped, err := connector.Connect(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wrapped.(*wrappedConn)
+	}
+	named := []driver.NamedValue{{Name: "id", Ordinal: 1, Value: int64(1)}}
+
+	t.Run("fallback", func(t *testing.T) {
+		calls := &driverCalls{}
+		conn := wrap(&legacyConn{prepareConn{calls}})
+		if err := conn.Ping(ctx); err != nil {
+			t.Errorf("Ping = %v, want nil", err)
+		}
+		if !conn.IsValid() {
+			t.Error("IsValid = false, want true")
+		}
+		if err := conn.CheckNamedValue(&named[0]); err != driver.ErrSkip {
+			t.Errorf("CheckNamedValue = %v, want driver.ErrSkip", err)
+		}
+		if err := conn.ResetSession(ctx); err != nil {
+			t.Errorf("ResetSession = %v, want nil", err)
+		}
+		// Conns without ConnBeginTx only support the default options
+		for _, opts := range []driver.TxOptions{
+			{Isolation: driver.IsolationLevel(sql.LevelSerializable)},
+			{ReadOnly: true},
+		} {
+			if _, err := conn.BeginTx(ctx, opts); err == nil {
+				t.Errorf("BeginTx(%+v) succeeded", opts)
+			}
+		}
+		if _, err := conn.BeginTx(ctx, driver.TxOptions{}); err != nil {
+			t.Error(err)
+		}
+		// Conns without the context interfaces don't support named values
+		if _, err := conn.ExecContext(ctx, "INSERT ok", named); err == nil {
+			t.Error("ExecContext with a named value succeeded")
+		}
+		if _, err := conn.QueryContext(ctx, "SELECT ok", named); err == nil {
+			t.Error("QueryContext with a named value succeeded")
+		}
+		if calls.count("Exec") != 0 || calls.count("Query") != 0 {
+			t.Error("operations with named values reached the conn")
+		}
+
+		stmt, err := conn.PrepareContext(ctx, "SELECT ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stmt.Close()
+		s := stmt.(*wrappedStmt)
+		if err := s.CheckNamedValue(&named[0]); err != driver.ErrSkip {
+			t.Errorf("statement CheckNamedValue = %v, want driver.ErrSkip", err)
+		}
+		if cc := s.ColumnConverter(0); cc != driver.DefaultParameterConverter {
+			t.Errorf("ColumnConverter = %v, want driver.DefaultParameterConverter", cc)
+		}
+		if _, err := s.ExecContext(ctx, named); err == nil {
+			t.Error("statement ExecContext with a named value succeeded")
+		}
+	})
+
+	t.Run("passthrough", func(t *testing.T) {
+		calls := &driverCalls{}
+		fake := &contextConn{prepareConn: prepareConn{calls}, pingErr: errFakeQuery, invalid: true}
+		conn := wrap(fake)
+		if err := conn.Ping(ctx); err != errFakeQuery {
+			t.Errorf("Ping = %v, want the conn's error", err)
+		}
+		if conn.IsValid() {
+			t.Error("IsValid = true, want the conn's false")
+		}
+		if err := conn.CheckNamedValue(&named[0]); err != nil || calls.count("ConnCheckNamedValue") != 1 {
+			t.Errorf("CheckNamedValue = %v, not passed on to the conn", err)
+		}
+		if _, err := conn.BeginTx(ctx, driver.TxOptions{Isolation: driver.IsolationLevel(sql.LevelSerializable)}); err != nil {
+			t.Fatal(err)
+		}
+		if fake.isolation != driver.IsolationLevel(sql.LevelSerializable) {
+			t.Errorf("BeginTx passed on isolation level %d", fake.isolation)
+		}
+		if _, err := conn.ExecContext(ctx, "INSERT ok", named); err != nil {
+			t.Error(err)
+		}
+
+		stmt, err := conn.PrepareContext(ctx, "SELECT ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stmt.Close()
+		s := stmt.(*wrappedStmt)
+		if err := s.CheckNamedValue(&named[0]); err != nil || calls.count("StmtCheckNamedValue") != 1 {
+			t.Errorf("statement CheckNamedValue = %v, not passed on to the statement", err)
+		}
+		if cc := s.ColumnConverter(0); cc != driver.Int32 {
+			t.Errorf("ColumnConverter = %v, want the statement's", cc)
+		}
+
+		// Statements without a checker of their own leave it to the conn
+		legacy, err := conn.PrepareContext(ctx, "legacy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer legacy.Close()
+		if err := legacy.(*wrappedStmt).CheckNamedValue(&named[0]); err != nil || calls.count("ConnCheckNamedValue") != 2 {
+			t.Errorf("statement CheckNamedValue = %v, not passed on to the conn", err)
+		}
+	})
+}
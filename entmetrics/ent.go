@@ -0,0 +1,27 @@
+// Package entmetrics opens ent SQL drivers instrumented by a
+// sqlmetrics.Collector.
+package entmetrics
+
+import (
+	entsql "entgo.io/ent/dialect/sql"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// Open opens an ent driver of the given dialect, such as dialect.Postgres,
+// over a DB opened by c.Open: its queries and transactions record query
+// metrics and its pool is registered with c. Pass it to the generated
+// client with ent.Driver.
+func Open(c *sqlmetrics.Collector, dialect, driverName, dataSourceName string, labelValues []string) (*entsql.Driver, error) {
+	db, err := c.Open(driverName, dataSourceName, labelValues)
+	if err != nil {
+		return nil, err
+	}
+	return entsql.OpenDB(dialect, db), nil
+}
+
+// Register registers the pool of an existing ent driver with c. Only pool
+// metrics are recorded; use Open for query metrics too.
+func Register(c *sqlmetrics.Collector, drv *entsql.Driver, labelValues []string) error {
+	return c.RegisterDB(drv.DB(), labelValues)
+}
@@ -0,0 +1,147 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the type of an Event
+type EventType string
+
+// Values of EventType
+const (
+	// EventConnOpened is a connection opened by a wrapped driver or
+	// connector. Duration is how long opening it took.
+	EventConnOpened EventType = "conn_opened"
+	// EventConnOpenFailed is a connection a wrapped driver or connector
+	// failed to open with Err, after Duration
+	EventConnOpenFailed EventType = "conn_open_failed"
+	// EventConnClosed is a connection of a wrapped driver or connector
+	// closed after living for Duration
+	EventConnClosed EventType = "conn_closed"
+	// EventWaits is Count waits for a connection of a registered DB,
+	// blocked for Duration in total, since the previous collection.
+	// database/sql doesn't expose individual waits, so they are reported
+	// once per collection from the change in the DB's stats.
+	EventWaits EventType = "waits"
+	// EventSlowQuery is a query or exec of a wrapped driver that took at
+	// least Options.SlowQueryThreshold, with the Method, Query, Duration
+	// and Err of its SlowQuery
+	EventSlowQuery EventType = "slow_query"
+	// EventBreakerStateChanged is the circuit breaker of a wrapped driver
+	// or connector moving to State, BreakerOpen when it tripped
+	EventBreakerStateChanged EventType = "breaker_state_changed"
+)
+
+// Event is something that happened to the pools or queries of a
+// collector, as delivered to the functions given to Subscribe. Which of
+// the fields are set depends on the Type.
+type Event struct {
+	Type EventType
+	// Time is when the event happened
+	Time time.Time
+	// Labels maps each of Options.Labels to the label value of the wrapped
+	// driver or registered DB. It must not be modified.
+	Labels map[string]string
+
+	Duration time.Duration
+	Count    int64
+	Method   string
+	Query    string
+	State    string
+	Err      error
+}
+
+// eventBus delivers events to the subscribers of a collector
+type eventBus struct {
+	mu   sync.Mutex
+	next uint64
+	// subs is replaced on every change, so publishing needs no lock
+	subs atomic.Pointer[map[uint64]func(Event)]
+}
+
+// active reports whether there are any subscribers, which lets callers
+// skip building events no one receives
+func (b *eventBus) active() bool {
+	subs := b.subs.Load()
+	return subs != nil && len(*subs) > 0
+}
+
+// publish calls every subscriber with e
+func (b *eventBus) publish(e Event) {
+	subs := b.subs.Load()
+	if subs == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, fn := range *subs {
+		fn(e)
+	}
+}
+
+// update replaces the subscribers with a copy changed by f
+func (b *eventBus) update(f func(map[uint64]func(Event))) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs := make(map[uint64]func(Event))
+	if cur := b.subs.Load(); cur != nil {
+		for id, fn := range *cur {
+			subs[id] = fn
+		}
+	}
+	f(subs)
+	b.subs.Store(&subs)
+}
+
+// Subscribe calls fn with every Event from now on, until the returned
+// unsubscribe function is called, for reactions such as autoscaling hints
+// or adaptive pool sizing built on the collector's instrumentation. fn is
+// called synchronously, from the goroutine the event happened on, often
+// holding a connection, so it must be quick and must not use the DB the
+// event is about. Hand events off to a buffered channel for anything
+// slower.
+func (c *Collector) Subscribe(fn func(Event)) (unsubscribe func()) {
+	b := c.q.events
+	var id uint64
+	b.update(func(subs map[uint64]func(Event)) {
+		b.next++
+		id = b.next
+		subs[id] = fn
+	})
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.update(func(subs map[uint64]func(Event)) {
+				delete(subs, id)
+			})
+		})
+	}
+}
+
+// observeWaitEvent publishes the waits of e since the previous collection.
+// The first collection only records the DB's stats.
+func (c *Collector) observeWaitEvent(e *dbEntry, stats sql.DBStats, labelValues []string, now time.Time) {
+	e.mu.Lock()
+	n := stats.WaitCount - e.eventWaitCount
+	d := stats.WaitDuration - e.eventWaitDur
+	// Stats going backwards are of a replaced pool, and start over
+	publish := e.eventWaitObserved && n > 0 && d >= 0
+	e.eventWaitCount = stats.WaitCount
+	e.eventWaitDur = stats.WaitDuration
+	e.eventWaitObserved = true
+	e.mu.Unlock()
+
+	if publish && c.q.events.active() {
+		c.q.events.publish(Event{
+			Type:     EventWaits,
+			Time:     now,
+			Labels:   c.entryLabelMap(e, labelValues),
+			Duration: d,
+			Count:    n,
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"expvar"
+)
+
+// PublishExpvar publishes the stats of db as the expvar name, served under
+// /debug/vars, keyed by the names of the metrics the Collector emits for
+// them. Like expvar.Publish it panics if name is already published.
+func PublishExpvar(db *sql.DB, name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return statsVars(Options{}, db.Stats())
+	}))
+}
+
+// PublishExpvar publishes the snapshot of every registered DB as the
+// expvar name, a list of the DBs' labels and stats keyed by the names of
+// the collector's metrics. Like expvar.Publish it panics if name is
+// already published.
+func (c *Collector) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		snapshots := c.Snapshot()
+		vars := make([]map[string]interface{}, len(snapshots))
+		for i, s := range snapshots {
+			vars[i] = map[string]interface{}{
+				"labels": s.Labels,
+				"stats":  statsVars(c.o, s.Stats),
+			}
+		}
+		return vars
+	}))
+}
+
+// statsVars maps the metric names of o to the values of stats
+func statsVars(o Options, stats sql.DBStats) map[string]interface{} {
+	return map[string]interface{}{
+		o.MetricName("connections_max"):                         stats.MaxOpenConnections,
+		o.MetricName("connections_open"):                        stats.OpenConnections,
+		o.MetricName("connections_in_use"):                      stats.InUse,
+		o.MetricName("connections_idle"):                        stats.Idle,
+		o.MetricName("connections_wait_count_total"):            stats.WaitCount,
+		o.MetricName("connections_wait_duration_seconds_total"): o.Duration(stats.WaitDuration),
+		o.MetricName("connections_max_idle_closed_total"):       stats.MaxIdleClosed,
+		o.MetricName("connections_max_idle_time_closed_total"):  stats.MaxIdleTimeClosed,
+		o.MetricName("connections_max_lifetime_closed_total"):   stats.MaxLifetimeClosed,
+	}
+}
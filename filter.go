@@ -0,0 +1,60 @@
+package sqlmetrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// metricEnabled reports whether the metric name, without Prefix,
+// Namespace or Subsystem, is emitted under Options.EnabledMetrics and
+// DisabledMetrics. The filter is applied to the descs and collectors as
+// they are built, so it holds for every DB whatever its names, such as
+// those of RegisterDBWithNamespace, and costs nothing to collect.
+func (o Options) metricEnabled(name string) bool {
+	if o.filtered != nil {
+		o.filtered(name)
+	}
+	if len(o.EnabledMetrics) > 0 && !containsName(o.EnabledMetrics, name) {
+		return false
+	}
+	return !containsName(o.DisabledMetrics, name)
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// metricNames are the names EnabledMetrics and DisabledMetrics may hold:
+// those of every metric the collector and wrapped drivers may emit,
+// whichever options enable them.
+var metricNames = sync.OnceValue(func() map[string]bool {
+	names := make(map[string]bool)
+	o := Options{
+		QuerySampleRate:    0.5,
+		SlowQueryThreshold: time.Second,
+		CircuitBreaker:     &BreakerPolicy{},
+		filtered:           func(name string) { names[name] = true },
+	}
+	m, _ := newMetrics(o, nil)
+	m.addSelf(o)
+	newQueryMetrics(o)
+	return names
+})
+
+// checkMetricNames returns an error if field holds a name that isn't one
+// of metricNames, such as a misspelled or renamed one, which would filter
+// nothing
+func checkMetricNames(field string, names []string) error {
+	for _, name := range names {
+		if !metricNames()[name] {
+			return fmt.Errorf("%s has the unknown metric %q", field, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package sqlmetrics
+
+import (
+	"regexp"
+	"strings"
+)
+
+// QueryFingerprintLabel is the label carrying the Fingerprint of the
+// query a query metric observed, when Options.FingerprintQueries is set.
+const QueryFingerprintLabel = "query_fingerprint"
+
+var (
+	// inList matches a parenthesized list of placeholders
+	inList = regexp.MustCompile(`\(\s*\?(\s*,\s*\?)*\s*\)`)
+	// valuesList matches repeated collapsed lists, as in multi-row inserts
+	valuesList = regexp.MustCompile(`\(\.\.\.\)(\s*,\s*\(\.\.\.\))+`)
+)
+
+// Fingerprint normalizes query so that queries differing only in their
+// literals share a fingerprint: comments are stripped, string and numeric
+// literals and placeholders become ?, lists of them such as IN lists
+// collapse to (...), whitespace collapses and unquoted text is lowercased.
+func Fingerprint(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+	space := false
+	emit := func(s string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+	}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			i++
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			space = true
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			space = true
+		case c == '\'':
+			i++
+			for i < len(query) {
+				if query[i] == '\\' {
+					i += 2
+					continue
+				}
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			i++
+			emit("?")
+		case c == '"' || c == '`':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				end = len(query) - i - 1
+			} else {
+				end++
+			}
+			emit(query[i : i+end+1])
+			i += end + 1
+		case c >= '0' && c <= '9' && !afterWord(query, i),
+			c == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			for i++; i < len(query) && isNumberByte(query[i]); i++ {
+			}
+			emit("?")
+		default:
+			j := i + 1
+			for j < len(query) && isWordByte(query[i]) && isWordByte(query[j]) {
+				j++
+			}
+			emit(strings.ToLower(query[i:j]))
+			i = j
+		}
+	}
+	fp := inList.ReplaceAllString(b.String(), "(...)")
+	return valuesList.ReplaceAllString(fp, "(...)")
+}
+
+// afterWord returns whether query[i] continues an identifier, as the 1 of
+// t1 does
+func afterWord(query string, i int) bool {
+	return i > 0 && isWordByte(query[i-1])
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isNumberByte(c byte) bool {
+	return c == '.' || c == 'x' || c == 'X' || c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
@@ -0,0 +1,50 @@
+package sqlmetrics
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	for _, test := range []struct {
+		query, want string
+	}{
+		// Literals
+		{"SELECT * FROM users WHERE name = 'bob'", "select * from users where name = ?"},
+		{"SELECT * FROM users WHERE id = 42 AND score > 1.5", "select * from users where id = ? and score > ?"},
+		{"SELECT * FROM t WHERE flags = 0xFF", "select * from t where flags = ?"},
+		{"SELECT * FROM t1 JOIN t2 ON t1.id = t2.id", "select * from t1 join t2 on t1.id = t2.id"},
+		// Escaped quotes stay inside the literal
+		{"SELECT * FROM users WHERE name = 'o''brien'", "select * from users where name = ?"},
+		{`SELECT * FROM users WHERE name = 'o\'brien' AND id = 1`, "select * from users where name = ? and id = ?"},
+		// Quoted identifiers keep their case
+		{`SELECT "UserID" FROM "Users"`, `select "UserID" from "Users"`},
+		{"SELECT `Name` FROM `Users`", "select `Name` from `Users`"},
+		// Comments are stripped
+		{"SELECT 1 -- trailing comment\nFROM dual", "select ? from dual"},
+		{"/* leading */ SELECT /* inner */ id FROM users", "select id from users"},
+		{"SELECT id FROM users /* unterminated", "select id from users"},
+		// Whitespace collapses
+		{"SELECT   id\n\tFROM\r\n users", "select id from users"},
+		// Lists of literals and placeholders collapse
+		{"SELECT * FROM users WHERE id IN (1, 2, 3)", "select * from users where id in (...)"},
+		{"SELECT * FROM users WHERE id IN ($1,$2,$3)", "select * from users where id in (...)"},
+		{"SELECT * FROM users WHERE name IN ('a', 'b')", "select * from users where name in (...)"},
+		{"INSERT INTO t (a, b) VALUES (?, ?), (?, ?), (?, ?)", "insert into t (a, b) values (...)"},
+		// Placeholders
+		{"SELECT * FROM users WHERE id = $1 AND name = $2", "select * from users where id = ? and name = ?"},
+		{"SELECT * FROM users WHERE id = ? AND name = ?", "select * from users where id = ? and name = ?"},
+	} {
+		if got := Fingerprint(test.query); got != test.want {
+			t.Errorf("Fingerprint(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestFingerprintDiffersOnlyByLiterals(t *testing.T) {
+	a := Fingerprint("SELECT * FROM users WHERE id = 1 AND name = 'a'")
+	b := Fingerprint("select *   from users where id = 2 and name = 'b'")
+	if a != b {
+		t.Errorf("fingerprints %q and %q of queries differing only in literals differ", a, b)
+	}
+	if c := Fingerprint("SELECT * FROM orders WHERE id = 1"); c == a {
+		t.Errorf("queries of different tables share the fingerprint %q", c)
+	}
+}
@@ -0,0 +1,79 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// defaultMu guards defaultCollector and defaultUsed
+	defaultMu        sync.Mutex
+	defaultCollector *Collector
+	// defaultUsed is whether Default has been called, after which
+	// SetDefault fails
+	defaultUsed bool
+)
+
+// globals maps the names passed to RegisterGlobal to their *sql.DB
+var globals sync.Map
+
+// Default returns the Collector that RegisterGlobal registers DBs with,
+// one created with the zero Options unless SetDefault set another.
+func Default() *Collector {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultCollector == nil {
+		defaultCollector = NewCollector(Options{})
+	}
+	defaultUsed = true
+	return defaultCollector
+}
+
+// SetDefault makes c the collector of Default, for programs that want
+// labels or other options on globally registered DBs. It returns an error
+// once Default has been used, by RegisterGlobal, Open or Handler among
+// others, so every module sees the same collector.
+func SetDefault(c *Collector) error {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultUsed {
+		return errors.New("the default collector is already in use")
+	}
+	defaultCollector = c
+	return nil
+}
+
+// RegisterGlobal registers db with Default under name, so independently
+// loaded modules can register their DBs without a reference to a
+// Collector. It returns an error if name is already registered.
+func RegisterGlobal(name string, db *sql.DB, labelValues []string) error {
+	if _, loaded := globals.LoadOrStore(name, db); loaded {
+		return fmt.Errorf("duplicate global register of %q", name)
+	}
+	if err := Default().RegisterDB(db, labelValues); err != nil {
+		globals.Delete(name)
+		return err
+	}
+	return nil
+}
+
+// MustRegisterGlobal is RegisterGlobal, but it panics on an error
+func MustRegisterGlobal(name string, db *sql.DB, labelValues []string) {
+	if err := RegisterGlobal(name, db, labelValues); err != nil {
+		panic(err)
+	}
+}
+
+// Close unregisters db from Default, along with its RegisterGlobal name if
+// it has one, and closes it.
+func Close(db *sql.DB) error {
+	globals.Range(func(name, v any) bool {
+		if v == db {
+			globals.Delete(name)
+		}
+		return true
+	})
+	return Default().CloseDB(db)
+}
@@ -0,0 +1,89 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// resetDefault gives the test, and the tests after it, a fresh Default
+func resetDefault(t testing.TB) {
+	reset := func() {
+		defaultMu.Lock()
+		defaultCollector, defaultUsed = nil, false
+		defaultMu.Unlock()
+		globals.Clear()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestRegisterGlobalConcurrent(t *testing.T) {
+	resetDefault(t)
+	dbs := make([]*sql.DB, 20)
+	for i := range dbs {
+		dbs[i] = openTestDB(t)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(dbs))
+	for i, db := range dbs {
+		wg.Go(func() {
+			errs[i] = RegisterGlobal(fmt.Sprintf("db%d", i), db, nil)
+		})
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("RegisterGlobal of db%d: %v", i, err)
+		}
+	}
+	if got := len(Default().Snapshot()); got != len(dbs) {
+		t.Errorf("Default has %d DBs, want %d", got, len(dbs))
+	}
+
+	if err := Close(dbs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(Default().Snapshot()); got != len(dbs)-1 {
+		t.Errorf("Default has %d DBs after Close, want %d", got, len(dbs)-1)
+	}
+	// Close frees the name
+	if err := RegisterGlobal("db0", openTestDB(t), nil); err != nil {
+		t.Errorf("RegisterGlobal of a closed DB's name: %v", err)
+	}
+}
+
+func TestRegisterGlobalDuplicate(t *testing.T) {
+	resetDefault(t)
+	if err := RegisterGlobal("main", openTestDB(t), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterGlobal("main", openTestDB(t), nil); err == nil {
+		t.Error("registering a name twice succeeded")
+	}
+	// A failed registration doesn't hold on to its name
+	if err := RegisterGlobal("bad", openTestDB(t), []string{"extra"}); err == nil {
+		t.Fatal("registering with label values the collector doesn't have succeeded")
+	}
+	if err := RegisterGlobal("bad", openTestDB(t), nil); err != nil {
+		t.Errorf("RegisterGlobal after a failed registration: %v", err)
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	resetDefault(t)
+	c := NewCollector(Options{Labels: []string{"db"}})
+	if err := SetDefault(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterGlobal("main", openTestDB(t), []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	if Default() != c {
+		t.Error("Default isn't the collector given to SetDefault")
+	}
+	if err := SetDefault(NewCollector(Options{})); err == nil {
+		t.Error("SetDefault after Default was used succeeded")
+	}
+}
@@ -0,0 +1,87 @@
+// Package gormmetrics is a GORM plugin recording the query metrics of a
+// sqlmetrics.Collector from GORM's callbacks.
+package gormmetrics
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// startKey is the statement setting holding when an operation began
+const startKey = "sqlmetrics:start"
+
+// Plugin records every GORM operation in the collector's query metrics,
+// with the operation (create, query, update, delete, row or raw) as the
+// method label. Initialize also registers the DB's pool with the
+// collector.
+type Plugin struct {
+	Collector   *sqlmetrics.Collector
+	LabelValues []string
+}
+
+// New returns a Plugin for c, to pass to gorm.DB.Use
+func New(c *sqlmetrics.Collector, labelValues []string) *Plugin {
+	return &Plugin{Collector: c, LabelValues: labelValues}
+}
+
+func (p *Plugin) Name() string {
+	return "sqlmetrics"
+}
+
+func (p *Plugin) Initialize(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := p.Collector.RegisterDB(sqlDB, p.LabelValues); err != nil && !errors.Is(err, sqlmetrics.ErrAlreadyRegistered) {
+		return err
+	}
+
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("sqlmetrics:before_create", before),
+		cb.Create().After("gorm:create").Register("sqlmetrics:after_create", p.after("create")),
+		cb.Query().Before("gorm:query").Register("sqlmetrics:before_query", before),
+		cb.Query().After("gorm:query").Register("sqlmetrics:after_query", p.after("query")),
+		cb.Update().Before("gorm:update").Register("sqlmetrics:before_update", before),
+		cb.Update().After("gorm:update").Register("sqlmetrics:after_update", p.after("update")),
+		cb.Delete().Before("gorm:delete").Register("sqlmetrics:before_delete", before),
+		cb.Delete().After("gorm:delete").Register("sqlmetrics:after_delete", p.after("delete")),
+		cb.Row().Before("gorm:row").Register("sqlmetrics:before_row", before),
+		cb.Row().After("gorm:row").Register("sqlmetrics:after_row", p.after("row")),
+		cb.Raw().Before("gorm:raw").Register("sqlmetrics:before_raw", before),
+		cb.Raw().After("gorm:raw").Register("sqlmetrics:after_raw", p.after("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func before(db *gorm.DB) {
+	db.InstanceSet(startKey, time.Now())
+}
+
+func (p *Plugin) after(method string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		v, ok := db.InstanceGet(startKey)
+		if !ok {
+			return
+		}
+		start, ok := v.(time.Time)
+		if !ok {
+			return
+		}
+		err := db.Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Not finding a record is a result, not a failure
+			err = nil
+		}
+		p.Collector.ObserveOperation(db.Statement.Context, p.LabelValues, method, time.Since(start), err)
+	}
+}
@@ -0,0 +1,272 @@
+// Package grafana generates a Grafana dashboard of the metrics exported by
+// a sqlmetrics.Collector and its wrapped drivers, named and labeled per the
+// collector's Options so the dashboard matches what is actually exported.
+package grafana
+
+import (
+	"encoding/json"
+	"strings"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// DefaultTitle is the title of Options that don't set one
+const DefaultTitle = "SQL connection pools"
+
+// Options for the dashboard
+type Options struct {
+	// Title is the dashboard's title, DefaultTitle if unset
+	Title string
+	// UID, if set, is the dashboard's uid, so re-imports replace it
+	UID string
+	// Datasource, if set, is the uid of the Prometheus datasource of the
+	// panels. Otherwise the dashboard has a datasource variable.
+	Datasource string
+}
+
+// panel is a timeseries panel of one or more queries
+type panel struct {
+	title   string
+	unit    string
+	targets []target
+}
+
+type target struct {
+	expr   string
+	legend string
+}
+
+// Dashboard returns the JSON of a dashboard, ready to import, with a
+// variable per label of o.Labels to filter the DBs by, a row of panels of
+// the pool stats and a row of panels of the driver's query metrics.
+func Dashboard(o sqlmetrics.Options, do Options) ([]byte, error) {
+	if do.Title == "" {
+		do.Title = DefaultTitle
+	}
+	datasource := map[string]string{"type": "prometheus", "uid": do.Datasource}
+	if do.Datasource == "" {
+		datasource["uid"] = "${datasource}"
+	}
+
+	g := generator{o: o}
+	rows := []struct {
+		title  string
+		panels []panel
+	}{
+		{"Pool", g.poolPanels()},
+		{"Queries", g.queryPanels()},
+	}
+
+	var panels []any
+	y := 0
+	id := 1
+	for _, row := range rows {
+		panels = append(panels, map[string]any{
+			"id":        id,
+			"type":      "row",
+			"title":     row.title,
+			"collapsed": false,
+			"gridPos":   map[string]int{"x": 0, "y": y, "w": 24, "h": 1},
+			"panels":    []any{},
+		})
+		id++
+		y++
+		for i, p := range row.panels {
+			targets := make([]any, len(p.targets))
+			for j, t := range p.targets {
+				targets[j] = map[string]any{
+					"refId":        string(rune('A' + j)),
+					"datasource":   datasource,
+					"expr":         t.expr,
+					"legendFormat": t.legend,
+				}
+			}
+			panels = append(panels, map[string]any{
+				"id":         id,
+				"type":       "timeseries",
+				"title":      p.title,
+				"datasource": datasource,
+				"gridPos":    map[string]int{"x": 12 * (i % 2), "y": y + 8*(i/2), "w": 12, "h": 8},
+				"fieldConfig": map[string]any{
+					"defaults":  map[string]any{"unit": p.unit},
+					"overrides": []any{},
+				},
+				"targets": targets,
+			})
+			id++
+		}
+		y += 8 * ((len(row.panels) + 1) / 2)
+	}
+
+	var variables []any
+	if do.Datasource == "" {
+		variables = append(variables, map[string]any{
+			"name":  "datasource",
+			"label": "Data source",
+			"type":  "datasource",
+			"query": "prometheus",
+		})
+	}
+	for _, label := range o.Labels {
+		variables = append(variables, map[string]any{
+			"name":       label,
+			"label":      label,
+			"type":       "query",
+			"datasource": datasource,
+			"query":      "label_values(" + o.MetricName("connections_open") + ", " + label + ")",
+			"refresh":    2,
+			"sort":       1,
+			"multi":      true,
+			"includeAll": true,
+			"allValue":   ".*",
+			"current":    map[string]any{"text": "All", "value": "$__all"},
+		})
+	}
+
+	dashboard := map[string]any{
+		"title":         do.Title,
+		"tags":          []string{"sql"},
+		"schemaVersion": 39,
+		"editable":      true,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating":    map[string]any{"list": variables},
+		"panels":        panels,
+	}
+	if do.UID != "" {
+		dashboard["uid"] = do.UID
+	}
+	return json.MarshalIndent(dashboard, "", "  ")
+}
+
+// generator renders the panels' queries for the collector's options
+type generator struct {
+	o sqlmetrics.Options
+}
+
+// durationUnit returns the grafana unit of the duration metrics
+func (g generator) durationUnit() string {
+	if g.o.DurationUnit == sqlmetrics.Milliseconds {
+		return "ms"
+	}
+	return "s"
+}
+
+// selector returns the series of the metric name, and the suffix of its
+// histogram series if any, selected by the label variables
+func (g generator) selector(name string, suffix ...string) string {
+	matchers := make([]string, len(g.o.Labels))
+	for i, label := range g.o.Labels {
+		matchers[i] = label + `=~"$` + label + `"`
+	}
+	return g.o.MetricName(name) + strings.Join(suffix, "") + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// rate returns the per-second rate of the counter name, or of the suffix
+// series of the histogram name
+func (g generator) rate(name string, suffix ...string) string {
+	return "rate(" + g.selector(name, suffix...) + "[$__rate_interval])"
+}
+
+// sum returns expr summed by the labels and the extra labels
+func (g generator) sum(expr string, extra ...string) string {
+	return g.aggregate("sum", expr, extra...)
+}
+
+// aggregate returns expr aggregated with op by the labels and the extra
+// labels
+func (g generator) aggregate(op, expr string, extra ...string) string {
+	return op + " by (" + strings.Join(append(append([]string(nil), g.o.Labels...), extra...), ", ") + ") (" + expr + ")"
+}
+
+// legend returns the legend of series with the labels, the extra labels
+// and suffix
+func (g generator) legend(suffix string, extra ...string) string {
+	var parts []string
+	for _, label := range append(append([]string(nil), g.o.Labels...), extra...) {
+		parts = append(parts, "{{"+label+"}}")
+	}
+	if suffix != "" {
+		parts = append(parts, suffix)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (g generator) poolPanels() []panel {
+	panels := []panel{
+		{"Connections", "short", []target{
+			{g.selector("connections_in_use"), g.legend("in use")},
+			{g.selector("connections_idle"), g.legend("idle")},
+			{g.selector("connections_max"), g.legend("max")},
+		}},
+		{"Connection waits", "ops", []target{
+			{g.rate("connections_wait_count_total"), g.legend("")},
+		}},
+		{"Average wait", g.durationUnit(), []target{
+			{g.rate("connections_wait_duration_seconds_total") + " / " + g.rate("connections_wait_count_total"), g.legend("")},
+		}},
+		{"Connections closed", "ops", []target{
+			{g.rate("connections_max_idle_closed_total"), g.legend("max idle")},
+			{g.rate("connections_max_idle_time_closed_total"), g.legend("max idle time")},
+			{g.rate("connections_max_lifetime_closed_total"), g.legend("max lifetime")},
+		}},
+	}
+	if g.o.PingInterval > 0 {
+		panels = append(panels, panel{"Up", "short", []target{
+			{g.selector("db_up"), g.legend("")},
+		}})
+	}
+	return panels
+}
+
+func (g generator) queryPanels() []panel {
+	method := sqlmetrics.MethodLabel
+	quantile := func(q string) string {
+		if len(g.o.QueryDurationObjectives) > 0 {
+			// Summary quantiles can't be aggregated, the slowest instance's
+			// stands for them all
+			selector := strings.TrimSuffix(g.selector("query_duration_seconds"), "}")
+			if !strings.HasSuffix(selector, "{") {
+				selector += ","
+			}
+			return g.aggregate("max", selector+`quantile="`+q+`"}`, method)
+		}
+		if g.o.NativeHistogramBucketFactor > 1 {
+			return "histogram_quantile(" + q + ", " + g.sum(g.rate("query_duration_seconds"), method) + ")"
+		}
+		return "histogram_quantile(" + q + ", " + g.sum(g.rate("query_duration_seconds", "_bucket"), method, "le") + ")"
+	}
+	operations := g.rate("query_duration_seconds", "_count")
+	if g.o.QuerySampleRate > 0 && g.o.QuerySampleRate < 1 {
+		// The histogram only counts the sampled operations
+		operations = g.rate("queries_total")
+	}
+	panels := []panel{
+		{"Operations", "ops", []target{
+			{g.sum(operations, method), g.legend("", method)},
+		}},
+		{"Operation errors", "ops", []target{
+			{g.sum(g.rate("queries_errors_total"), method), g.legend("", method)},
+		}},
+		{"Operation duration p50", g.durationUnit(), []target{
+			{quantile("0.5"), g.legend("", method)},
+		}},
+		{"Operation duration p99", g.durationUnit(), []target{
+			{quantile("0.99"), g.legend("", method)},
+		}},
+		{"Transactions", "ops", []target{
+			{g.rate("transactions_committed_total"), g.legend("committed")},
+			{g.rate("transactions_rolled_back_total"), g.legend("rolled back")},
+		}},
+		{"Open transactions and statements", "short", []target{
+			{g.selector("transactions_open"), g.legend("transactions")},
+			{g.selector("statements_open"), g.legend("statements")},
+		}},
+	}
+	if g.o.SlowQueryThreshold > 0 {
+		panels = append(panels, panel{"Slow queries", "ops", []target{
+			{g.sum(g.rate("slow_queries_total"), method), g.legend("", method)},
+		}})
+	}
+	return panels
+}
@@ -0,0 +1,49 @@
+package sqlmetrics
+
+import "database/sql"
+
+// LabelGroup registers DBs with labels of their own in place of
+// Options.Labels, for collectors whose pools don't all fit one label
+// schema. Their pool metrics have the collector's names, and labels are
+// all a DB's series have, so the group's DBs need no placeholder values
+// for the labels of the others. Creating a group before the
+// collector is first described makes it unchecked, as Options explains.
+type LabelGroup struct {
+	c      *Collector
+	labels []string
+	m      *metrics
+}
+
+// LabelGroup returns the group of the DBs with labels
+func (c *Collector) LabelGroup(labels ...string) (*LabelGroup, error) {
+	o := c.o
+	// Not nil, which would be Options.Labels to the DBs' entries
+	o.Labels = append(make([]string, 0, len(labels)), labels...)
+	m, info := newMetrics(o, nil)
+	if err := checkInfo(info); err != nil {
+		return nil, err
+	}
+	c.perDB.Store(true)
+	return &LabelGroup{c: c, labels: o.Labels, m: m}, nil
+}
+
+// Labels returns the label names of the group
+func (g *LabelGroup) Labels() []string {
+	return append([]string(nil), g.labels...)
+}
+
+// RegisterDB registers db with the values of the group's labels, as
+// Collector.RegisterDB does. Unregister it from the collector.
+func (g *LabelGroup) RegisterDB(db *sql.DB, labelValues []string) error {
+	return g.c.register(db, g.entry(labelValues))
+}
+
+// RegisterProvider registers a pool with the values of the group's labels,
+// as Collector.RegisterProvider does
+func (g *LabelGroup) RegisterProvider(p StatsProvider, labelValues []string) error {
+	return g.c.register(p, g.entry(labelValues))
+}
+
+func (g *LabelGroup) entry(labelValues []string) *dbEntry {
+	return &dbEntry{labelValues: labelValues, labelNames: g.labels, m: g.m}
+}
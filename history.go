@@ -0,0 +1,100 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// StatsRecord is the stats of a DB as read at Time
+type StatsRecord struct {
+	Time  time.Time   `json:"time"`
+	Stats sql.DBStats `json:"stats"`
+}
+
+// DBHistory is the recent stats of a registered DB, as History and
+// HistoryHandler report them
+type DBHistory struct {
+	// Labels maps each of Options.Labels, or of the labels of the DB's
+	// LabelGroup, to the DB's label value
+	Labels map[string]string `json:"labels"`
+	// Name is the name of DBs registered with RegisterNamed
+	Name string `json:"name,omitempty"`
+	// Records are the last Options.StatsHistory stats read, oldest first
+	Records []StatsRecord `json:"records"`
+}
+
+// statsHistory is a ring of the last stats read of a DB
+type statsHistory struct {
+	records []StatsRecord
+	next    int
+}
+
+// recordStats adds the stats read at now to the DB's history of the last n
+func (e *dbEntry) recordStats(now time.Time, stats sql.DBStats, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h := &e.history
+	if len(h.records) < n {
+		h.records = append(h.records, StatsRecord{now, stats})
+		return
+	}
+	h.records[h.next] = StatsRecord{now, stats}
+	h.next = (h.next + 1) % n
+}
+
+// historyRecords returns a copy of the DB's history, oldest first
+func (e *dbEntry) historyRecords() []StatsRecord {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h := &e.history
+	records := make([]StatsRecord, 0, len(h.records))
+	records = append(records, h.records[h.next:]...)
+	return append(records, h.records[:h.next]...)
+}
+
+// History returns the last Options.StatsHistory stats read of every
+// registered DB, in collection order, to look at short-term pool behavior
+// around an incident at a finer resolution than the metrics backend keeps.
+// They are read by the background sampler if Options.SampleInterval is
+// set, and by collections otherwise. It returns nil if
+// Options.StatsHistory isn't set.
+func (c *Collector) History() []DBHistory {
+	if c.o.StatsHistory <= 0 {
+		return nil
+	}
+	entries := c.entries()
+	dbs := make([]DBHistory, len(entries))
+	for i, e := range entries {
+		dbs[i] = DBHistory{
+			Labels:  c.entryLabelMap(e, e.currentLabelValues()),
+			Name:    e.name,
+			Records: e.historyRecords(),
+		}
+	}
+	return dbs
+}
+
+// HistoryHandler returns an http.Handler serving History as JSON. The name
+// query parameter limits it to the DB registered with RegisterNamed under
+// that name.
+func (c *Collector) HistoryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dbs := c.History()
+		if name := r.URL.Query().Get("name"); name != "" {
+			var named []DBHistory
+			for _, db := range dbs {
+				if db.Name == name {
+					named = append(named, db)
+				}
+			}
+			dbs = named
+		}
+		if dbs == nil {
+			dbs = []DBHistory{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dbs)
+	})
+}
@@ -0,0 +1,184 @@
+// Package influx periodically writes the pool stats of the DBs registered
+// with a sqlmetrics.Collector, and the metrics of its wrapped drivers, in
+// InfluxDB line protocol.
+package influx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// DefaultInterval is the write interval of Options that don't set one
+const DefaultInterval = 10 * time.Second
+
+// Options for the Reporter. Exactly one of Writer and URL must be set.
+type Options struct {
+	// Writer is written each batch of lines
+	Writer io.Writer
+	// URL is POSTed each batch of lines, such as InfluxDB 2's
+	// http://host:8086/api/v2/write?org=org&bucket=bucket&precision=ns
+	URL string
+	// Token, if set, is sent with requests to URL as the Authorization
+	// token
+	Token string
+	// Client makes the requests to URL, http.DefaultClient if unset
+	Client *http.Client
+
+	// Interval is the time between writes, DefaultInterval if unset
+	Interval time.Duration
+}
+
+// Reporter writes the collector's metrics as one line per series, with the
+// metric name as the measurement and the labels as tags. Gauges and
+// counters have a value field, histograms count and sum fields.
+type Reporter struct {
+	o Options
+	g prometheus.Gatherer
+}
+
+// NewReporter returns a Reporter of c's SnapshotCollector, so it doesn't
+// disturb the collector's scrapes.
+func NewReporter(c *sqlmetrics.Collector, o Options) (*Reporter, error) {
+	if (o.Writer == nil) == (o.URL == "") {
+		return nil, errors.New("exactly one of Writer and URL must be set")
+	}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c.SnapshotCollector()); err != nil {
+		return nil, err
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	return &Reporter{o: o, g: reg}, nil
+}
+
+// Run writes every Options.Interval until ctx is done, then writes a final
+// time and returns that write's error.
+func (r *Reporter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.o.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return r.Write(context.Background())
+		case <-ticker.C:
+			r.Write(ctx)
+		}
+	}
+}
+
+// Write writes the current metrics
+func (r *Reporter) Write(ctx context.Context) error {
+	mfs, err := r.g.Gather()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	AppendLines(&buf, mfs, time.Now())
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	if r.o.Writer != nil {
+		_, err := r.o.Writer.Write(buf.Bytes())
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.o.URL, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if r.o.Token != "" {
+		req.Header.Set("Authorization", "Token "+r.o.Token)
+	}
+	resp, err := r.o.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx write: %s", resp.Status)
+	}
+	return nil
+}
+
+// AppendLines writes mfs to buf in line protocol, timestamped with ts
+func AppendLines(buf *bytes.Buffer, mfs []*dto.MetricFamily, ts time.Time) {
+	stamp := strconv.FormatInt(ts.UnixNano(), 10)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var fields string
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				fields = "value=" + formatFloat(m.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				fields = "value=" + formatFloat(m.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				fields = "value=" + formatFloat(m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				fields = "count=" + strconv.FormatUint(h.GetSampleCount(), 10) + "i,sum=" + formatFloat(h.GetSampleSum())
+			default:
+				continue
+			}
+
+			buf.WriteString(escape(mf.GetName(), ", "))
+			labels := append([]*dto.LabelPair(nil), m.GetLabel()...)
+			sort.Slice(labels, func(i, j int) bool {
+				return labels[i].GetName() < labels[j].GetName()
+			})
+			for _, lp := range labels {
+				if lp.GetValue() == "" {
+					// Empty tag values aren't valid line protocol
+					continue
+				}
+				buf.WriteByte(',')
+				buf.WriteString(escape(lp.GetName(), ",= "))
+				buf.WriteByte('=')
+				buf.WriteString(escape(lp.GetValue(), ",= "))
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(fields)
+			buf.WriteByte(' ')
+			buf.WriteString(stamp)
+			buf.WriteByte('\n')
+		}
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// escape backslash-escapes the characters of special in s
+func escape(s, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,107 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"path"
+	"reflect"
+	"time"
+)
+
+// The labels database_info has after Options.Labels
+const (
+	DriverNameLabel    = "driver_name"
+	ServerVersionLabel = "server_version"
+)
+
+// versionQueries are the queries of the server version of drivers whose
+// database doesn't support SELECT version(), by driver package
+var versionQueries = map[string]string{
+	"github.com/mattn/go-sqlite3":      "SELECT sqlite_version()",
+	"modernc.org/sqlite":               "SELECT sqlite_version()",
+	"github.com/microsoft/go-mssqldb":  "SELECT @@VERSION",
+	"github.com/denisenkom/go-mssqldb": "SELECT @@VERSION",
+}
+
+// rowQuerier is a StatsProvider the server version can be queried from,
+// as *sql.DB can
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// driverer is a StatsProvider reporting its driver, as *sql.DB does
+type driverer interface {
+	Driver() driver.Driver
+}
+
+// driverPackage returns the import path of the package of d, looking
+// through wrapped drivers
+func driverPackage(d driver.Driver) string {
+	if w, ok := d.(*wrappedDriver); ok {
+		d = w.Driver
+	}
+	t := reflect.TypeOf(d)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.PkgPath()
+}
+
+// databaseInfo returns the driver name and server version of e, querying
+// the version on the first collection that succeeds, before deadline if it
+// is set. ok is false for DBs whose version can't be queried.
+func (c *Collector) databaseInfo(e *dbEntry, deadline time.Time) (driverName, version string, ok bool) {
+	e.mu.Lock()
+	driverName, version, ok = e.infoDriverName, e.serverVersion, e.versionRead
+	e.mu.Unlock()
+	if ok {
+		return driverName, version, true
+	}
+	driverName = e.driverName
+
+	q, ok := e.provider.(rowQuerier)
+	if !ok {
+		return "", "", false
+	}
+	query := c.o.ServerVersionQuery
+	if d, ok := e.provider.(driverer); ok {
+		pkg := driverPackage(d.Driver())
+		if driverName == "" {
+			driverName = path.Base(pkg)
+		}
+		if query == "" {
+			query = versionQueries[pkg]
+		}
+	}
+	if query == "" {
+		query = "SELECT version()"
+	}
+	timeout := c.o.CollectTimeout
+	if timeout <= 0 {
+		timeout = DefaultCollectTimeout
+	}
+	if !deadline.IsZero() {
+		left := deadline.Sub(c.now())
+		if left <= 0 {
+			return "", "", false
+		}
+		timeout = min(timeout, left)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := q.QueryRowContext(ctx, query).Scan(&version); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			e.mu.Lock()
+			e.collectTimeouts++
+			e.mu.Unlock()
+		}
+		return "", "", false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.infoDriverName, e.serverVersion, e.versionRead = driverName, version, true
+	return driverName, version, true
+}
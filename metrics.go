@@ -1,161 +1,2676 @@
 package sqlmetrics
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// Options for the Collector
+// FleetTotalLabelValue is the label value used for every label of the
+// fleet-wide aggregate series emitted when Options.EmitFleetTotals is set.
+// It is reserved and may not be used as a label value of a registered DB.
+const FleetTotalLabelValue = "_total"
+
+// InvalidStateLabelValue replaces the StateLabel values of
+// RegisterDBWithStateLabel funcs that are reserved, such as
+// FleetTotalLabelValue under Options.EmitFleetTotals
+const InvalidStateLabelValue = "invalid"
+
+var (
+	// ErrAlreadyRegistered is returned when registering a DB twice
+	ErrAlreadyRegistered = errors.New("db is already registered")
+	// ErrNotRegistered is returned for operations on a DB that isn't registered
+	ErrNotRegistered = errors.New("db is not registered")
+)
+
+// DriverLabel is the label (which must be present in Options.Labels) that
+// RegisterDBWithDriverName fills in with the DB's driver name.
+const DriverLabel = "driver"
+
+// StateLabel is the label (which must be present in Options.Labels) that
+// RegisterDBWithStateLabel fills in from the DB's stats.
+const StateLabel = "state"
+
+// Options for the Collector.
+//
+// A collector is a checked collector, describing the metrics of these
+// options, unless DBs with metrics of their own, of
+// RegisterDBWithConstLabels, RegisterDBWithNamespace or a LabelGroup, were
+// registered or created before it was first described. Their metrics
+// can't all be described consistently, so such a collector is unchecked,
+// and registries check its metrics as they are collected instead. A
+// checked collector that has such DBs later on mustn't be registered with
+// a pedantic registry.
 type Options struct {
 	Prefix string
 	Labels []string
+
+	// Namespace and Subsystem are joined to metric names with underscores,
+	// following prometheus.BuildFQName, after Prefix.
+	Namespace string
+	Subsystem string
+
+	// ConstLabels are added to every metric of the collector
+	ConstLabels prometheus.Labels
+
+	// MetricNames maps metric names, as they are without Prefix, Namespace
+	// or Subsystem (e.g. "connections_open"), to the full names to emit
+	// them as in their place (e.g. "go_sql_open_connections"), to keep the
+	// names of an existing fleet. NewCollector panics if they are invalid;
+	// Validate checks them.
+	MetricNames map[string]string
+
+	// SemanticConventions emits the pool metrics that have an OpenTelemetry
+	// database client semantic convention under its name, as the
+	// OpenTelemetry prometheus exporter writes it and without Prefix,
+	// Namespace or Subsystem, so fleets mixing OpenTelemetry and prometheus
+	// share names. connections_in_use and connections_idle are emitted as
+	// db_client_connections_usage with a ConnectionStateLabel of used or
+	// idle, in place of them and connections_open, and connections_max,
+	// connections_max_idle, connection_establish_duration_seconds and
+	// connections_wait_seconds as db_client_connections_max,
+	// db_client_connections_idle_max,
+	// db_client_connections_create_time_seconds and
+	// db_client_connections_wait_time_seconds. MetricNames take precedence,
+	// and the other metrics keep their names.
+	SemanticConventions bool
+
+	// MetricHelp overrides the help text of metrics, keyed by metric name
+	// as MetricNames is, to localize or standardize descriptions.
+	MetricHelp map[string]string
+
+	// DSNParsers parse the DSNs of RegisterDBWithDSN by driver name, in
+	// addition to and overriding DefaultDSNParsers
+	DSNParsers map[string]DSNParser `json:"-"`
+
+	// EmitFleetTotals additionally emits the sum of the pool gauges and
+	// counters across the registered DBs, with every label set to
+	// FleetTotalLabelValue. It requires at least one label. DBs with metrics
+	// of their own, registered with RegisterDBWithConstLabels,
+	// RegisterDBWithNamespace or a LabelGroup, aren't summed.
+	EmitFleetTotals bool
+
+	// WarmupDelay holds back a newly registered DB's series until it has
+	// been registered for at least this long, skipping the transient stats
+	// of a pool that is still warming up.
+	WarmupDelay time.Duration
+
+	// WarmupEmitCounters emits the counters of DBs that are still within
+	// WarmupDelay, holding back only their gauges, so that rate() has a
+	// starting point from the first collection after registration.
+	WarmupEmitCounters bool
+
+	// FrozenThreshold, if non-zero, emits connections_frozen for each DB,
+	// which is 1 once this many consecutive collections have returned
+	// identical stats while connections are in use. A pool that holds
+	// connections but never changes is likely deadlocked.
+	FrozenThreshold int
+
+	// PerMetricConstLabels adds const labels to individual metrics, keyed
+	// by metric name without Prefix, Namespace or Subsystem (e.g.
+	// "connections_wait_duration_seconds_total"). They are merged with
+	// ConstLabels. NewCollector panics if a const label collides with one
+	// of Labels; Validate checks them.
+	PerMetricConstLabels map[string]prometheus.Labels
+
+	// EnabledMetrics, if set, are the only metrics emitted, and
+	// DisabledMetrics metrics that aren't, by name without Prefix,
+	// Namespace or Subsystem (e.g. "connections_wait_count_total"), to
+	// control the series of large fleets. Names are those the metrics have
+	// before MetricNames, SemanticConventions or DurationUnit rename them,
+	// so they match the metrics of every DB, including those registered
+	// with RegisterDBWithNamespace. Histograms and summaries are named
+	// without their _bucket, _sum and _count suffixes. Filtered out
+	// metrics are still recorded, just not emitted. Validate rejects names
+	// that aren't those of a metric.
+	EnabledMetrics  []string
+	DisabledMetrics []string
+
+	// EmitMetricInfo additionally emits a metric_info series, always 1, for
+	// every metric the collector emits, with the metric's name, type, unit
+	// and help as labels.
+	EmitMetricInfo bool
+
+	// OpenMetrics makes the output conform to OpenMetrics for strict
+	// validators: the collector's handlers negotiate the OpenMetrics format,
+	// counters and histograms get _created samples, from when their DB was
+	// registered for the pool metrics, and metrics whose names end with a
+	// unit such as _seconds get its UNIT metadata. metric_info and
+	// database_info stay gauges of 1, as the Prometheus encoders have no
+	// info type.
+	OpenMetrics bool
+
+	// SkipZeroCounters leaves out the pool counters of a DB while they are
+	// 0, such as connections_closed_max_idle_total of a pool without idle
+	// limits, to save series across many registered DBs. A counter's
+	// series appears once it first increments, including the counters
+	// WarmupEmitCounters emits during WarmupDelay.
+	SkipZeroCounters bool
+
+	// EmitWaitDurationNanoseconds additionally emits the wait duration as
+	// connections_wait_duration_nanoseconds_total, which keeps the full
+	// resolution of sql.DBStats.WaitDuration.
+	EmitWaitDurationNanoseconds bool
+
+	// IdleRatioWindow, if non-zero, emits connections_idle_ratio_avg: the
+	// average Idle/OpenConnections over the last IdleRatioWindow
+	// collections. Collections with no open connections are left out.
+	IdleRatioWindow int
+
+	// RecentWaitWindow, if non-zero, emits
+	// connections_wait_duration_recent_max_seconds. sql.DBStats doesn't
+	// expose individual waits, so this is an approximation: for every
+	// interval between collections the average wait (the change in
+	// WaitDuration divided by the change in WaitCount) is computed, and the
+	// largest of those over the last RecentWaitWindow intervals is emitted.
+	RecentWaitWindow int
+
+	// EmitWaitRatio emits connections_wait_ratio: the share of the
+	// connections handed out since the previous collection that had to be
+	// waited for, the change in WaitCount over the change in acquisitions.
+	// sql.DBStats doesn't count acquisitions, so only DBs opened with Open,
+	// OpenDB or Collector.Open, whose wrapped driver counts them, emit it.
+	// It is 0 for intervals without acquisitions.
+	EmitWaitRatio bool
+
+	// WaitDurationBuckets, if set, emits the connections_wait_seconds
+	// histogram with these buckets. database/sql doesn't expose individual
+	// waits, not even to wrapped drivers, so this is an approximation:
+	// every time the DB's stats are read, by a collection or by the
+	// sampler if SampleInterval is set, the waits since the previous read
+	// are observed as that many waits of their average duration. A shorter
+	// SampleInterval makes the approximation closer.
+	WaitDurationBuckets []float64
+
+	// StatsTimeout, if non-zero, bounds how long Collect waits for a DB's
+	// stats. A DB whose stats take longer, or whose stats func panics, is
+	// left out of that collection, and counted in
+	// sqlmetrics_stats_read_errors_total. A read that hangs is left
+	// running, and later collections wait on it rather than start another
+	// until it returns.
+	StatsTimeout time.Duration
+
+	// CounterRefreshInterval, if greater than 1, only refreshes a DB's
+	// counters every CounterRefreshInterval collections and emits the
+	// previously read values in between. Gauges are refreshed on every
+	// collection.
+	CounterRefreshInterval int
+
+	// EmitStatsReadDuration additionally emits
+	// connections_stats_read_duration_seconds, how long reading each DB's
+	// stats took, to surface slow stats funcs.
+	EmitStatsReadDuration bool
+
+	// AutoAggregateDuplicateLabels merges DBs registered with identical
+	// label values into a single series of their summed stats, instead of
+	// emitting colliding series. Metrics that depend on a DB's history,
+	// such as connections_frozen, are only emitted for DBs whose label
+	// values are unique.
+	AutoAggregateDuplicateLabels bool
+
+	// EmitStartTime additionally emits sqlmetrics_start_time_seconds, the
+	// Unix time the collector was created, to correlate counter resets
+	// with restarts.
+	EmitStartTime bool
+
+	// EmitUtilization additionally emits connections_utilization_ratio,
+	// InUse/MaxOpenConnections, and connections_saturation, which is 1
+	// while every connection the pool may open is in use so new queries
+	// wait. Pools without a connection limit have no utilization and are
+	// never saturated.
+	EmitUtilization bool
+
+	// UtilizationBands, if set, emits sqlmetrics_dbs_by_utilization: the
+	// number of DBs whose InUse/MaxOpenConnections falls in each band.
+	// Bands are in ascending order of Max; a DB is counted in the first
+	// band whose Max it doesn't exceed, or the last band. DBs without a
+	// connection limit are not counted.
+	UtilizationBands []UtilizationBand
+
+	// RegisterOnFirstDB, if set, is the registry the collector registers
+	// itself with when the first DB is registered, so that a collector
+	// without DBs doesn't expose any metrics.
+	RegisterOnFirstDB prometheus.Registerer `json:"-"`
+
+	// OnSaturationChange, if set, is called after a collection in which a
+	// DB became saturated (not Healthy) or stopped being saturated. A new
+	// state is only reported once it has been observed for at least
+	// SaturationDwell, so a flapping pool doesn't flood the callback.
+	OnSaturationChange func(labelValues []string, saturated bool) `json:"-"`
+	SaturationDwell    time.Duration
+
+	// ClassifyError returns the error_class of a failed driver operation
+	// of a wrapped driver or connector. It defaults to ErrorClass, and
+	// should return few distinct values. Set it to classify errors
+	// ErrorClass doesn't know, such as MySQL's error numbers.
+	ClassifyError func(error) string `json:"-"`
+
+	// QueryDurationBuckets, TransactionDurationBuckets and
+	// RowsIterationDurationBuckets are the buckets of the
+	// query_duration_seconds, transaction_duration_seconds and
+	// rows_iteration_duration_seconds histograms of wrapped drivers,
+	// prometheus.DefBuckets if unset. Slow, OLAP-style queries are
+	// better served by buckets going well past DefBuckets' 10 seconds,
+	// such as prometheus.ExponentialBuckets(0.01, 2, 15).
+	QueryDurationBuckets         []float64
+	TransactionDurationBuckets   []float64
+	RowsIterationDurationBuckets []float64
+
+	// QueryRowsBuckets are the buckets of query_rows, the number of rows
+	// read from each query, prometheus.ExponentialBuckets(1, 4, 8) if
+	// unset
+	QueryRowsBuckets []float64
+
+	// AcquireDurationBuckets are the buckets of
+	// connection_acquire_duration_seconds, prometheus.DefBuckets if unset.
+	// Drivers only see a connection being opened, or a reused one being
+	// reset, so time spent waiting for a connection in the pool is not
+	// included; see connections_wait_duration_seconds_total for that.
+	AcquireDurationBuckets []float64
+
+	// ConnectionEstablishDurationBuckets are the buckets of
+	// connection_establish_duration_seconds, how long wrapped drivers took
+	// to open new connections, with their DNS lookups, TCP and TLS
+	// handshakes and authentication, prometheus.DefBuckets if unset.
+	// Unlike connection_acquire_duration_seconds it leaves out the resets
+	// of reused connections, so slow handshakes stand apart from pool
+	// starvation, which shows in connections_wait_duration_seconds_total.
+	ConnectionEstablishDurationBuckets []float64
+
+	// ConnectionLifetimeBuckets are the buckets of
+	// connection_lifetime_seconds, how long the connections of wrapped
+	// drivers lived from being opened to being closed,
+	// prometheus.ExponentialBuckets(1, 4, 8) if unset: up to about 4.5
+	// hours. Many short lifetimes show SetConnMaxLifetime or
+	// SetConnMaxIdleTime churning connections.
+	ConnectionLifetimeBuckets []float64
+
+	// DedicatedConnHoldBuckets are the buckets of
+	// dedicated_connection_hold_duration_seconds, how long the connections
+	// checked out with Collector.Conn were held,
+	// prometheus.ExponentialBuckets(0.001, 4, 10) if unset: up to about
+	// 4 minutes.
+	DedicatedConnHoldBuckets []float64
+
+	// CircuitBreaker, if set, puts a circuit breaker with this policy in
+	// front of each wrapped driver and connector, shedding their
+	// operations while the DB is degraded, and emits
+	// circuit_breaker_state, circuit_breaker_trips_total and
+	// circuit_breaker_rejected_total.
+	CircuitBreaker *BreakerPolicy
+
+	// QueryHooks are told about every driver operation of wrapped drivers
+	// and connectors. The otel package provides one emitting spans.
+	QueryHooks []QueryHook `json:"-"`
+
+	// ExemplarFromContext, if set, returns the exemplar labels, such as
+	// a trace ID, to attach to the query_duration_seconds and
+	// connection_acquire_duration_seconds observations made with the
+	// operation's context. The otel package's TraceExemplar returns the
+	// context's trace ID.
+	ExemplarFromContext func(context.Context) prometheus.Labels `json:"-"`
+
+	// DurationUnit is the unit of the duration metrics, seconds by
+	// default. Their names and help follow it, so with Milliseconds
+	// query_duration_seconds becomes query_duration_milliseconds. Unix
+	// times, such as sqlmetrics_start_time_seconds, stay in seconds. Metric
+	// names keep their _seconds form as keys of MetricNames, MetricHelp
+	// and PerMetricConstLabels. Buckets given in Options are in the unit,
+	// while the default buckets are scaled to it.
+	DurationUnit DurationUnit
+
+	// NativeHistogramBucketFactor, if greater than 1, makes the duration
+	// histograms of wrapped drivers native histograms with this bucket
+	// growth factor (1.1 is a common choice), in place of their classic
+	// buckets. Scraping them requires a prometheus with native histograms
+	// enabled.
+	NativeHistogramBucketFactor float64
+
+	// QueryDurationObjectives, if set, makes query_duration_seconds a
+	// summary with these quantile objectives, mapping quantiles to their
+	// allowed error, such as {0.5: 0.05, 0.99: 0.001}, instead of a
+	// histogram. A summary is a handful of series per label set rather than
+	// one per bucket, which matters for high-QPS services with many
+	// methods and label values, but its quantiles can't be aggregated
+	// across instances, and it carries no exemplars.
+	QueryDurationObjectives map[float64]float64
+
+	// QuerySampleRate, if between 0 and 1, is the fraction of driver
+	// operations observed in query_duration_seconds, picked at random, to
+	// cut the cost of timing every statement on hot paths; 0.01 samples
+	// 1 in 100. The histogram's count and sum then only cover the sampled
+	// operations, so queries_total counts them all, and
+	// queries_errors_total, queries_canceled_total and
+	// queries_deadline_exceeded_total stay exact too.
+	QuerySampleRate float64
+
+	// FingerprintQueries adds a query_fingerprint label, the Fingerprint
+	// of the query, to the query_duration_seconds and queries_errors_total
+	// of wrapped drivers, to break them down by statement. Operations
+	// without a query, such as begins and commits, have an empty one.
+	FingerprintQueries bool
+
+	// OperationLabel adds an operation label, the operation the context
+	// was tagged with by WithOperation, to the query_duration_seconds and
+	// queries_errors_total of wrapped drivers and of ObserveOperation.
+	// Untagged queries have an empty one.
+	OperationLabel bool
+
+	// StatementKindLabel adds a stmt_kind label, the StatementKind of the
+	// query, such as select or insert, to the query_duration_seconds and
+	// queries_errors_total of wrapped drivers, for read and write
+	// breakdowns without the cardinality of FingerprintQueries.
+	// Operations without a query have an empty one.
+	StatementKindLabel bool
+
+	// TableLabel adds a table label, the TableName of the query, to the
+	// query_duration_seconds and queries_errors_total of wrapped drivers.
+	// It has an unknown value for queries whose table isn't found. Each
+	// table is a new series per method, so it is opt in, bounded by
+	// MaxQueryLabelValues.
+	TableLabel bool
+
+	// CommentQueries makes wrapped drivers append a sqlcommenter comment
+	// to the queries, execs and prepares they send, tagging them with
+	// CommentApplication, the operation of WithOperation and CommentTags,
+	// so the database's logs can be correlated back to the application.
+	// The comment goes before any trailing semicolon. Queries that
+	// already have a comment outside of their string literals are sent as
+	// they are. Metrics
+	// and QueryHooks see the query without the comment.
+	CommentQueries bool
+	// CommentApplication is the application tag of comments
+	CommentApplication string
+	// CommentTags, if set, returns more tags of comments from the query's
+	// context. The otel package's TraceCommentTags returns the context's
+	// traceparent.
+	CommentTags func(context.Context) map[string]string `json:"-"`
+
+	// SlowQueryThreshold, if set, counts the queries and execs of wrapped
+	// drivers taking at least this long in slow_queries_total, and calls
+	// OnSlowQuery with them.
+	SlowQueryThreshold time.Duration
+	// OnSlowQuery, if set, is called with every slow query, such as to log
+	// it
+	OnSlowQuery func(context.Context, SlowQuery) `json:"-"`
+	// SlowQueryMaxLength, if set, truncates the queries OnSlowQuery is
+	// called with to this many bytes
+	SlowQueryMaxLength int
+	// SlowQueryFingerprint makes OnSlowQuery called with the Fingerprint of
+	// queries, which doesn't carry their literals, in place of the queries
+	SlowQueryFingerprint bool
+
+	// TrackStatements, if set, tracks the calls, errors and total and max
+	// durations of up to this many statements of wrapped drivers, by their
+	// Fingerprint, for TopStatements and StatementsHandler. Past it, the
+	// statement with the least total duration is forgotten to make room.
+	TrackStatements int
+
+	// MaxQueryLabelValues bounds the distinct values of each dynamic label,
+	// query_fingerprint, operation and table. Values past it are replaced by other
+	// and counted in query_label_overflows_total. 0 means
+	// DefaultMaxQueryLabelValues, and a negative value means unbounded.
+	MaxQueryLabelValues int
+
+	// SampleInterval is how often the background sampler started by
+	// Collector.Start reads the registered DBs' stats between scrapes, to
+	// emit the peaks of spikes that scrapes alone would miss.
+	SampleInterval time.Duration
+
+	// RefreshInterval, if set, makes the refresher started by
+	// Collector.Start collect the registered DBs this often, and Collect
+	// send the metrics of its last collection, so that several scrapers
+	// don't each read the DBs' stats and query them. A Collect with no
+	// refresh within the last RefreshInterval, such as one without Start,
+	// refreshes the metrics itself. The Unix time of the
+	// refresh is emitted as sqlmetrics_last_refresh_timestamp_seconds, to
+	// tell how stale the metrics are.
+	RefreshInterval time.Duration
+
+	// StatsHistory, if set, keeps the last this many stats read of each
+	// registered DB, with when they were read, for History and
+	// HistoryHandler. They are read by the background sampler if
+	// SampleInterval is set, and by collections otherwise.
+	StatsHistory int
+
+	// PingInterval is how often the prober started by Collector.Start pings
+	// the registered DBs, for db_up and ping_duration_seconds. Only DBs
+	// whose StatsProvider has a PingContext method, as *sql.DB does, are
+	// pinged. *sql.DBs found to be closed are unregistered, so their
+	// frozen stats aren't emitted as ghost pools. The prober is a single
+	// goroutine pinging the DBs one at a time, however many there are,
+	// unless PingConcurrency is set, so PingTimeout should keep a hung DB
+	// from delaying the rest.
+	PingInterval time.Duration
+	// PingTimeout bounds each ping. 0 means PingInterval for the prober's,
+	// and only the context's deadline for HealthChecks.
+	PingTimeout time.Duration
+	// PingConcurrency, if greater than 1, has the prober ping each DB on a
+	// goroutine of its own, with up to this many pings at once.
+	PingConcurrency int
+
+	// DatabaseInfo emits database_info, always 1, with the driver_name and
+	// server_version labels of each registered DB whose StatsProvider can
+	// be queried, as *sql.DB can. The version is queried once, on the
+	// first collection, with SELECT version() or the driver's equivalent.
+	// driver_name is the name the DB was opened or registered with, or
+	// else the last element of its driver's package path.
+	DatabaseInfo bool
+	// ServerVersionQuery, if set, is the query of the server version in
+	// place of the driver's.
+	ServerVersionQuery string
+
+	// CollectConcurrency, if greater than 1, reads the stats of and
+	// collects up to this many DBs at once, so that many registered DBs,
+	// or slow ones, add less to scrape latency. Metrics are emitted in the
+	// same order either way. The limit is emitted as
+	// sqlmetrics_max_concurrent_stats.
+	CollectConcurrency int
+
+	// CollectTimeout bounds the queries Collect makes against each DB,
+	// such as the server version of DatabaseInfo, so a hung database
+	// doesn't stall the scrape. A DB whose queries time out has only its
+	// in-process stats emitted, and the timeout counted in
+	// collect_timeouts_total. 0 means DefaultCollectTimeout.
+	CollectTimeout time.Duration
+
+	// CollectDeadline, if set, bounds each collection as a whole. The DBs
+	// whose stats haven't been read by then are left out of it and counted
+	// in sqlmetrics_dropped_dbs_total, and as DBs are read in collection
+	// order, the lowest priority ones of RegisterDBPrioritized are dropped
+	// first. Queries such as DatabaseInfo's are bounded by whichever of
+	// CollectTimeout and the deadline comes first, and aren't made once it
+	// has passed.
+	CollectDeadline time.Duration
+
+	// filtered, if set, is told the name of every metric metricEnabled
+	// filters, to list the canonical names
+	filtered func(name string)
+}
+
+// DefaultCollectTimeout is the Options.CollectTimeout used when it is 0
+const DefaultCollectTimeout = time.Second
+
+// UtilizationBand is a named range of pool utilization
+type UtilizationBand struct {
+	Name string
+	Max  float64
+}
+
+// DefaultUtilizationBands are reasonable bands for Options.UtilizationBands
+var DefaultUtilizationBands = []UtilizationBand{
+	{Name: "low", Max: 0.5},
+	{Name: "medium", Max: 0.8},
+	{Name: "high", Max: 1},
 }
 
+// metrics are the descs of the per-DB metrics and the collector's own.
+// The descs of the metrics EnabledMetrics or DisabledMetrics filter out
+// are nil, and nothing is emitted for them.
 type metrics struct {
 	maxConnsDesc *prometheus.Desc
 	// Pool Status
 	openConns *prometheus.Desc
 	inUse     *prometheus.Desc
 	idle      *prometheus.Desc
+	// usage replaces the above under Options.SemanticConventions
+	usage *prometheus.Desc
 
 	// Counters
 	waitCount         *prometheus.Desc
 	waitDuration      *prometheus.Desc
+	waitDurationNanos *prometheus.Desc
 	maxIdleClosed     *prometheus.Desc
+	maxIdleTimeClosed *prometheus.Desc
 	maxLifetimeClosed *prometheus.Desc
+
+	// Configuration
+	maxIdleConns    *prometheus.Desc
+	connMaxLifetime *prometheus.Desc
+	connMaxIdleTime *prometheus.Desc
+
+	// Derived
+	idleRatioAvg  *prometheus.Desc
+	recentWaitMax *prometheus.Desc
+	waitRatio     *prometheus.Desc
+	utilization   *prometheus.Desc
+	saturation    *prometheus.Desc
+	waitHistogram *prometheus.Desc
+
+	// Sampled
+	peakInUse        *prometheus.Desc
+	peakOpen         *prometheus.Desc
+	peakIntervalWait *prometheus.Desc
+
+	// Liveness
+	up           *prometheus.Desc
+	pingDuration *prometheus.Desc
+
+	databaseInfo    *prometheus.Desc
+	collectTimeouts *prometheus.Desc
+
+	// Health
+	frozen           *prometheus.Desc
+	statsReadSeconds *prometheus.Desc
+	swaps            *prometheus.Desc
+
+	metricInfo *prometheus.Desc
+
+	// Self
+	invalidStats *prometheus.Desc
+	unhealthyDBs *prometheus.Desc
+	labelUpdates *prometheus.Desc
+	startTime    *prometheus.Desc
+	refreshTime  *prometheus.Desc
+	droppedDBs   *prometheus.Desc
+	statsErrors  *prometheus.Desc
+	dbsByBand    *prometheus.Desc
+	concurrency  *prometheus.Desc
+}
+
+// selfDescs returns the descs of the collector's own metrics, nil for
+// those filtered out
+func (m *metrics) selfDescs() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		m.metricInfo,
+		m.invalidStats,
+		m.unhealthyDBs,
+		m.labelUpdates,
+		m.startTime,
+		m.refreshTime,
+		m.droppedDBs,
+		m.statsErrors,
+		m.dbsByBand,
+		m.concurrency,
+	}
+}
+
+// descs returns the descs of the metrics of o, which has info, including
+// the collector's own, nil for those filtered out
+func (m *metrics) descs(o Options, info []metricInfo) []*prometheus.Desc {
+	descs := m.selfDescs()
+	for _, mi := range info {
+		descs = append(descs, mi.desc)
+	}
+	if o.DatabaseInfo {
+		descs = append(descs, m.databaseInfo)
+	}
+	return descs
+}
+
+// metricInfo describes an enabled metric for the metric_info series
+type metricInfo struct {
+	desc *prometheus.Desc
+	name string
+	help string
+	// valueType is UntypedValue for histograms
+	valueType prometheus.ValueType
+	unit      string
+	// healthCheck is whether the metric is only enabled once HealthCheck
+	// is used
+	healthCheck bool
+}
+
+// Healthy reports whether a pool with the given stats can hand out a
+// connection without waiting, i.e. it has no connection limit or fewer
+// connections in use than the limit.
+func Healthy(stats sql.DBStats) bool {
+	return stats.MaxOpenConnections <= 0 || stats.InUse < stats.MaxOpenConnections
+}
+
+// MetricName returns the full name of the metric name: its MetricNames
+// mapping if it has one, and otherwise name after Prefix, Namespace and
+// Subsystem.
+func (o Options) MetricName(name string) string {
+	if mapped, ok := o.MetricNames[name]; ok {
+		return mapped
+	}
+	if semconv, ok := o.semconvName(name); ok {
+		return semconv
+	}
+	return o.Prefix + prometheus.BuildFQName(o.Namespace, o.Subsystem, o.DurationUnit.metricName(name))
+}
+
+// metricConstLabels returns the const labels of the metric name:
+// ConstLabels merged with its PerMetricConstLabels
+func (o Options) metricConstLabels(name string) prometheus.Labels {
+	return mergeLabels(o.ConstLabels, o.PerMetricConstLabels[name])
+}
+
+// Help returns the help text of the metric name: its MetricHelp override
+// if it has one, and otherwise help.
+func (o Options) Help(name, help string) string {
+	if override, ok := o.MetricHelp[name]; ok {
+		return override
+	}
+	if o.DurationUnit.metricName(name) != name {
+		return strings.Replace(help, " in seconds", " in "+o.DurationUnit.String(), 1)
+	}
+	return help
+}
+
+// Duration returns d in the DurationUnit, as duration metrics emit it
+func (o Options) Duration(d time.Duration) float64 {
+	return o.DurationUnit.value(d)
+}
+
+// DurationUnit is the unit of duration metrics
+type DurationUnit int
+
+const (
+	// Seconds is the default DurationUnit, the prometheus base unit
+	Seconds DurationUnit = iota
+	// Milliseconds is for dashboards expecting milliseconds
+	Milliseconds
+)
+
+func (u DurationUnit) String() string {
+	if u == Milliseconds {
+		return "milliseconds"
+	}
+	return "seconds"
+}
+
+// value returns d in the unit
+func (u DurationUnit) value(d time.Duration) float64 {
+	if u == Milliseconds {
+		return float64(d) / float64(time.Millisecond)
+	}
+	return d.Seconds()
+}
+
+// metricName returns the name of the duration metric name in the unit.
+// Timestamps such as sqlmetrics_start_time_seconds stay in seconds.
+func (u DurationUnit) metricName(name string) string {
+	// Unix times stay in seconds
+	if u != Milliseconds || strings.HasSuffix(name, "_time_seconds") || strings.HasSuffix(name, "_timestamp_seconds") {
+		return name
+	}
+	if strings.HasSuffix(name, "_seconds") {
+		return strings.TrimSuffix(name, "_seconds") + "_milliseconds"
+	}
+	if strings.HasSuffix(name, "_seconds_total") {
+		return strings.TrimSuffix(name, "_seconds_total") + "_milliseconds_total"
+	}
+	return name
+}
+
+// buckets returns the default buckets, in seconds, scaled to the unit
+func (u DurationUnit) buckets(buckets []float64) []float64 {
+	if u != Milliseconds {
+		return buckets
+	}
+	scaled := make([]float64, len(buckets))
+	for i, b := range buckets {
+		scaled[i] = b * 1000
+	}
+	return scaled
+}
+
+// validMetricName matches the legacy prometheus metric names
+var validMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Validate returns an error if o is invalid: if MetricNames maps a name to
+// an invalid metric name, or two names to the same one, if the buckets of
+// a histogram aren't in increasing order, or if
+// QueryDurationObjectives has quantiles outside of [0, 1] or negative
+// errors, or if QuerySampleRate is outside of [0, 1], or if
+// EnabledMetrics or DisabledMetrics name a metric that doesn't exist, or
+// if the metrics can't be created with the labels, such as for an invalid
+// label name or a const label that is also one of Labels.
+func (o Options) Validate() error {
+	mappedFrom := make(map[string]string, len(o.MetricNames))
+	for name, mapped := range o.MetricNames {
+		if !validMetricName.MatchString(mapped) {
+			return fmt.Errorf("metric %s is mapped to the invalid name %q", name, mapped)
+		}
+		if other, ok := mappedFrom[mapped]; ok {
+			return fmt.Errorf("metrics %s and %s are both mapped to %s", other, name, mapped)
+		}
+		mappedFrom[mapped] = name
+	}
+	for _, b := range []struct {
+		field   string
+		buckets []float64
+	}{
+		{"WaitDurationBuckets", o.WaitDurationBuckets},
+		{"QueryDurationBuckets", o.QueryDurationBuckets},
+		{"TransactionDurationBuckets", o.TransactionDurationBuckets},
+		{"RowsIterationDurationBuckets", o.RowsIterationDurationBuckets},
+		{"QueryRowsBuckets", o.QueryRowsBuckets},
+		{"AcquireDurationBuckets", o.AcquireDurationBuckets},
+		{"ConnectionEstablishDurationBuckets", o.ConnectionEstablishDurationBuckets},
+		{"ConnectionLifetimeBuckets", o.ConnectionLifetimeBuckets},
+		{"DedicatedConnHoldBuckets", o.DedicatedConnHoldBuckets},
+	} {
+		for i := 1; i < len(b.buckets); i++ {
+			if b.buckets[i] <= b.buckets[i-1] {
+				return fmt.Errorf("%s must be in increasing order, got %v", b.field, b.buckets)
+			}
+		}
+	}
+	if o.QuerySampleRate < 0 || o.QuerySampleRate > 1 {
+		return fmt.Errorf("QuerySampleRate must be within [0, 1], got %v", o.QuerySampleRate)
+	}
+	for q, e := range o.QueryDurationObjectives {
+		if q < 0 || q > 1 || e < 0 {
+			return fmt.Errorf("QueryDurationObjectives has the invalid objective %v: %v", q, e)
+		}
+	}
+	if err := checkMetricNames("EnabledMetrics", o.EnabledMetrics); err != nil {
+		return err
+	}
+	if err := checkMetricNames("DisabledMetrics", o.DisabledMetrics); err != nil {
+		return err
+	}
+
+	// The collector may be unchecked, so registering its metrics with a
+	// registry of their own is what surfaces the errors of their Descs.
+	// Only enabled metrics are checked: a disabled one, such as
+	// connections_usage without SemanticConventions, may clash with Labels
+	// harmlessly.
+	m, info := newMetrics(o, nil)
+	m.addSelf(o)
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(descCollector(m.descs(o, info))); err != nil {
+		return err
+	}
+	for _, nc := range newQueryMetrics(o).namedCollectors() {
+		if err := reg.Register(nc.c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// descCollector is a collector describing its descs and collecting
+// nothing, to check the descs by registering it. The nil descs of
+// filtered out metrics are skipped.
+type descCollector []*prometheus.Desc
+
+func (d descCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range d {
+		if desc != nil {
+			ch <- desc
+		}
+	}
+}
+
+// checkInfo returns the error of the first invalid desc of the metrics
+// described by info, such as one with an invalid or duplicate label name
+func checkInfo(info []metricInfo) error {
+	descs := make(descCollector, len(info))
+	for i, mi := range info {
+		descs[i] = mi.desc
+	}
+	return prometheus.NewRegistry().Register(descs)
+}
+
+func (descCollector) Collect(chan<- prometheus.Metric) {}
+
+// mergeLabels returns the union of all labels
+func mergeLabels(labels ...prometheus.Labels) prometheus.Labels {
+	var merged prometheus.Labels
+	for _, l := range labels {
+		if len(l) == 0 {
+			continue
+		}
+		if merged == nil {
+			merged = make(prometheus.Labels)
+		}
+		for k, v := range l {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// newMetrics returns the per-DB metrics for o with constLabels added to
+// each of them, along with descriptions of the enabled ones.
+func newMetrics(o Options, constLabels prometheus.Labels) (*metrics, []metricInfo) {
+	optional := map[string]bool{
+		"connections_open":                               !o.SemanticConventions,
+		"connections_in_use":                             !o.SemanticConventions,
+		"connections_idle":                               !o.SemanticConventions,
+		"connections_usage":                              o.SemanticConventions,
+		"connections_wait_duration_nanoseconds_total":    o.EmitWaitDurationNanoseconds,
+		"connections_idle_ratio_avg":                     o.IdleRatioWindow > 0,
+		"connections_wait_duration_recent_max_seconds":   o.RecentWaitWindow > 0,
+		"connections_wait_ratio":                         o.EmitWaitRatio,
+		"connections_utilization_ratio":                  o.EmitUtilization,
+		"connections_saturation":                         o.EmitUtilization,
+		"connections_wait_seconds":                       len(o.WaitDurationBuckets) > 0,
+		"connections_frozen":                             o.FrozenThreshold > 0,
+		"connections_stats_read_duration_seconds":        o.EmitStatsReadDuration,
+		"connections_in_use_peak":                        o.SampleInterval > 0,
+		"connections_open_peak":                          o.SampleInterval > 0,
+		"connections_wait_duration_interval_max_seconds": o.SampleInterval > 0,
+		"db_up":                  o.PingInterval > 0,
+		"ping_duration_seconds":  o.PingInterval > 0,
+		"collect_timeouts_total": o.DatabaseInfo,
+	}
+	// checked are the metrics HealthCheck emits without Options.PingInterval
+	checked := map[string]bool{
+		"db_up":                 true,
+		"ping_duration_seconds": true,
+	}
+
+	var info []metricInfo
+	newDescWithLabels := func(name, help string, valueType prometheus.ValueType, unit string, variableLabels []string) *prometheus.Desc {
+		if !o.metricEnabled(name) {
+			return nil
+		}
+		labels := mergeLabels(o.ConstLabels, o.PerMetricConstLabels[name], constLabels)
+		desc := o.newDesc(o.MetricName(name), o.Help(name, help), variableLabels, labels)
+		if enabled, ok := optional[name]; !ok || enabled || checked[name] {
+			info = append(info, metricInfo{
+				desc:        desc,
+				name:        o.MetricName(name),
+				help:        help,
+				valueType:   valueType,
+				unit:        unit,
+				healthCheck: ok && !enabled,
+			})
+		}
+		return desc
+	}
+	newDesc := func(name, help string, valueType prometheus.ValueType, unit string) *prometheus.Desc {
+		return newDescWithLabels(name, help, valueType, unit, o.Labels)
+	}
+
+	m := &metrics{
+		maxConnsDesc: newDesc(
+			"connections_max",
+			"Max number of open connections to the DB",
+			prometheus.GaugeValue, "connections",
+		),
+		openConns: newDesc(
+			"connections_open",
+			"The number of established connections, both in use and idle",
+			prometheus.GaugeValue, "connections",
+		),
+		inUse: newDesc(
+			"connections_in_use",
+			"The number of connections currently in use",
+			prometheus.GaugeValue, "connections",
+		),
+		usage: newDescWithLabels(
+			"connections_usage",
+			"The number of connections in the state",
+			prometheus.GaugeValue, "connections",
+			append(append([]string(nil), o.Labels...), ConnectionStateLabel),
+		),
+		idle: newDesc(
+			"connections_idle",
+			"The number of idle connections",
+			prometheus.GaugeValue, "connections",
+		),
+		waitCount: newDesc(
+			"connections_wait_count_total",
+			"The total number of connections waited for",
+			prometheus.CounterValue, "connections",
+		),
+		waitDuration: newDesc(
+			"connections_wait_duration_seconds_total",
+			"The total time blocked waiting for a new connection in seconds",
+			prometheus.CounterValue, "seconds",
+		),
+		waitDurationNanos: newDesc(
+			"connections_wait_duration_nanoseconds_total",
+			"The total time blocked waiting for a new connection in nanoseconds",
+			prometheus.CounterValue, "nanoseconds",
+		),
+		maxIdleClosed: newDesc(
+			"connections_max_idle_closed_total",
+			"The total number of connections closed due to SetMaxIdleConns",
+			prometheus.CounterValue, "connections",
+		),
+		maxIdleTimeClosed: newDesc(
+			"connections_max_idle_time_closed_total",
+			"The total number of connections closed due to SetConnMaxIdleTime",
+			prometheus.CounterValue, "connections",
+		),
+		maxLifetimeClosed: newDesc(
+			"connections_max_lifetime_closed_total",
+			"The total number of connections closed due to SetConnMaxLifetime",
+			prometheus.CounterValue, "connections",
+		),
+		maxIdleConns: newDesc(
+			"connections_max_idle",
+			"The configured max number of idle connections, of DBs whose PoolConfig is known",
+			prometheus.GaugeValue, "connections",
+		),
+		connMaxLifetime: newDesc(
+			"connections_max_lifetime_seconds",
+			"The configured max lifetime of connections in seconds, 0 if unlimited, of DBs whose PoolConfig is known",
+			prometheus.GaugeValue, "seconds",
+		),
+		connMaxIdleTime: newDesc(
+			"connections_max_idle_time_seconds",
+			"The configured max idle time of connections in seconds, 0 if unlimited, of DBs whose PoolConfig is known",
+			prometheus.GaugeValue, "seconds",
+		),
+		idleRatioAvg: newDesc(
+			"connections_idle_ratio_avg",
+			"The average ratio of idle to open connections over the last IdleRatioWindow collections",
+			prometheus.GaugeValue, "ratio",
+		),
+		recentWaitMax: newDesc(
+			"connections_wait_duration_recent_max_seconds",
+			"The largest average wait per interval between the last RecentWaitWindow collections in seconds",
+			prometheus.GaugeValue, "seconds",
+		),
+		waitRatio: newDesc(
+			"connections_wait_ratio",
+			"The share of the connections handed out since the previous collection that had to be waited for",
+			prometheus.GaugeValue, "ratio",
+		),
+		utilization: newDesc(
+			"connections_utilization_ratio",
+			"The ratio of connections in use to the max number of open connections",
+			prometheus.GaugeValue, "ratio",
+		),
+		saturation: newDesc(
+			"connections_saturation",
+			"Whether every connection the pool may open is in use",
+			prometheus.GaugeValue, "",
+		),
+		waitHistogram: newDesc(
+			"connections_wait_seconds",
+			"How long waits for a connection took in seconds, estimated from the changes in sql.DBStats WaitCount and WaitDuration between reads of the stats rather than measured per wait",
+			prometheus.UntypedValue, "seconds",
+		),
+		peakInUse: newDesc(
+			"connections_in_use_peak",
+			"The most connections in use seen by the sampler since the previous collection",
+			prometheus.GaugeValue, "connections",
+		),
+		peakOpen: newDesc(
+			"connections_open_peak",
+			"The most established connections seen by the sampler since the previous collection",
+			prometheus.GaugeValue, "connections",
+		),
+		peakIntervalWait: newDesc(
+			"connections_wait_duration_interval_max_seconds",
+			"The most time blocked waiting for connections within one SampleInterval since the previous collection in seconds",
+			prometheus.GaugeValue, "seconds",
+		),
+		up: newDesc(
+			"db_up",
+			"Whether the latest ping of the DB succeeded",
+			prometheus.GaugeValue, "",
+		),
+		pingDuration: newDesc(
+			"ping_duration_seconds",
+			"How long the latest ping of the DB took in seconds",
+			prometheus.GaugeValue, "seconds",
+		),
+		collectTimeouts: newDesc(
+			"collect_timeouts_total",
+			"The total number of collections whose queries of the DB took longer than CollectTimeout",
+			prometheus.CounterValue, "",
+		),
+		frozen: newDesc(
+			"connections_frozen",
+			"Whether the pool has held connections with unchanged stats for FrozenThreshold collections",
+			prometheus.GaugeValue, "",
+		),
+		statsReadSeconds: newDesc(
+			"connections_stats_read_duration_seconds",
+			"How long reading the DB's stats took during the last collection in seconds",
+			prometheus.GaugeValue, "seconds",
+		),
+		swaps: newDesc(
+			"connections_swaps_total",
+			"The total number of times ReplaceNamed replaced the DB, of DBs registered with RegisterNamed",
+			prometheus.CounterValue, "",
+		),
+	}
+	if o.metricEnabled("database_info") {
+		m.databaseInfo = prometheus.NewDesc(
+			o.MetricName("database_info"),
+			o.Help("database_info", "Describes the driver and server version of the DB, always 1"),
+			append(append([]string(nil), o.Labels...), DriverNameLabel, ServerVersionLabel),
+			mergeLabels(o.ConstLabels, o.PerMetricConstLabels["database_info"], constLabels),
+		)
+	}
+	return m, info
+}
+
+// addSelf adds the descs of the collector's own metrics to m
+func (m *metrics) addSelf(o Options) {
+	newDesc := func(name, help string, variableLabels []string) *prometheus.Desc {
+		if !o.metricEnabled(name) {
+			return nil
+		}
+		return o.newDesc(o.MetricName(name), o.Help(name, help), variableLabels, o.ConstLabels)
+	}
+	m.metricInfo = newDesc(
+		"metric_info",
+		"Describes a metric emitted by the collector, always 1",
+		[]string{"metric", "type", "unit", "help"},
+	)
+	m.invalidStats = newDesc(
+		"sqlmetrics_invalid_stats_total",
+		"The total number of impossible stats values that were clamped before being emitted",
+		[]string{"field"},
+	)
+	m.unhealthyDBs = newDesc(
+		"sqlmetrics_unhealthy_dbs",
+		"The number of registered DBs that are not Healthy",
+		nil,
+	)
+	m.labelUpdates = newDesc(
+		"sqlmetrics_label_updates_total",
+		"The total number of times a registered DB's label values were changed",
+		nil,
+	)
+	m.startTime = newDesc(
+		"sqlmetrics_start_time_seconds",
+		"The Unix time the collector was created in seconds",
+		nil,
+	)
+	m.refreshTime = newDesc(
+		"sqlmetrics_last_refresh_timestamp_seconds",
+		"The Unix time the metrics were last refreshed in seconds",
+		nil,
+	)
+	m.droppedDBs = newDesc(
+		"sqlmetrics_dropped_dbs_total",
+		"The total number of times a registered DB was left out of a collection past CollectDeadline",
+		nil,
+	)
+	m.statsErrors = newDesc(
+		"sqlmetrics_stats_read_errors_total",
+		"The total number of reads of a registered DB's stats that failed, as they panicked or took longer than StatsTimeout",
+		[]string{"reason"},
+	)
+	m.dbsByBand = newDesc(
+		"sqlmetrics_dbs_by_utilization",
+		"The number of registered DBs in each utilization band",
+		[]string{"band"},
+	)
+	m.concurrency = newDesc(
+		"sqlmetrics_max_concurrent_stats",
+		"The max number of DBs collected at once, the configured CollectConcurrency",
+		nil,
+	)
 }
 
 // NewCollector returns a collector for the given db
 func NewCollector(o Options) *Collector {
+	if err := o.Validate(); err != nil {
+		panic(err)
+	}
+	m, info := newMetrics(o, nil)
+	m.addSelf(o)
+
 	return &Collector{
-		o:   o,
-		dbs: make(map[*sql.DB][]string),
-		m: metrics{
-			maxConnsDesc: prometheus.NewDesc(
-				o.Prefix+"connections_max",
-				"Max number of open connections to the DB",
-				o.Labels, nil,
-			),
-			openConns: prometheus.NewDesc(
-				o.Prefix+"connections_open",
-				"Current number of established connections bith inuse and idle",
-				o.Labels, nil,
-			),
-			inUse: prometheus.NewDesc(
-				o.Prefix+"connections_in_use",
-				"The number of connections currently in use",
-				o.Labels, nil,
-			),
-			idle: prometheus.NewDesc(
-				o.Prefix+"connections_idle",
-				"The number of idle connections",
-				o.Labels, nil,
-			),
-			waitCount: prometheus.NewDesc(
-				o.Prefix+"connections_wait_count_total",
-				"The total number of connections waited for",
-				o.Labels, nil,
-			),
-			waitDuration: prometheus.NewDesc(
-				o.Prefix+"connections_wait_duration_seconds_total",
-				"The total time blocked waiting for a new connection in seconds",
-				o.Labels, nil,
-			),
-			maxIdleClosed: prometheus.NewDesc(
-				o.Prefix+"connections_max_idle_closed_total",
-				"The total number of connections closed due to SetMaxIdleConns",
-				o.Labels, nil,
-			),
-			maxLifetimeClosed: prometheus.NewDesc(
-				o.Prefix+"connections_max_lifetime_closed_total",
-				"The total number of connections closed due to SetConnMaxLifetime",
-				o.Labels, nil,
-			),
-		},
+		o:       o,
+		m:       m,
+		q:       newQueryMetrics(o),
+		info:    info,
+		now:     time.Now,
+		started: time.Now(),
+		dbs:     make(map[StatsProvider]*dbEntry),
+		named:   make(map[string]*dbEntry),
+
+		invalid: make(map[string]uint64),
 	}
 }
 
 // Collector is a prometheus Collector which collects metrics from a sql.DB
 type Collector struct {
-	o Options
-	m metrics
+	o    Options
+	m    *metrics
+	q    *queryMetrics
+	info []metricInfo
+	now  func() time.Time
 
-	l   sync.RWMutex
-	dbs map[*sql.DB][]string
+	started time.Time
+
+	// pairs are the label pairs of the per-DB metrics
+	pairs labelPairCache
+
+	selfMu         sync.Mutex
+	selfRegistered bool
+
+	// l serializes changes to the registered DBs. Readers such as Collect
+	// never take it: they use view, the registered DBs in collection order,
+	// which is replaced rather than modified on every change.
+	l    sync.Mutex
+	dbs  map[StatsProvider]*dbEntry
+	seq  uint64
+	view atomic.Pointer[[]*dbEntry]
+	// named are the DBs registered with RegisterNamed by their name
+	named map[string]*dbEntry
+
+	// healthChecked is whether HealthCheck has been used, which enables the
+	// metrics of the pings
+	healthChecked atomic.Bool
+
+	// perDB is whether DBs with metrics of their own were registered or a
+	// LabelGroup created, and unchecked whether the collector was
+	// unchecked because of them when it was first described
+	perDB        atomic.Bool
+	describeOnce sync.Once
+	unchecked    bool
+
+	// labelUpdates counts label value changes of registered DBs
+	labelUpdates atomic.Uint64
+	// droppedDBs counts the DBs left out of collections past
+	// Options.CollectDeadline
+	droppedDBs atomic.Uint64
+	// statsTimeouts and statsPanics count the reads of DBs' stats that
+	// took longer than Options.StatsTimeout or panicked
+	statsTimeouts atomic.Uint64
+	statsPanics   atomic.Uint64
+
+	invalidMu sync.Mutex
+	invalid   map[string]uint64
+
+	lastCollectMu sync.Mutex
+	lastCollect   time.Time
+
+	samplerMu   sync.Mutex
+	stopSampler chan struct{}
+	samplerWG   sync.WaitGroup
+
+	// refreshed are the metrics of the last refresh of
+	// Options.RefreshInterval, and refreshMu serializes refreshes
+	refreshMu sync.Mutex
+	refreshed atomic.Pointer[refreshedMetrics]
+}
+
+// StatsProvider is the source of a registered DB's stats. *sql.DB
+// implements it; other pools can be registered with RegisterProvider by
+// mapping their stats onto sql.DBStats.
+type StatsProvider interface {
+	Stats() sql.DBStats
+}
+
+// statsFunc adapts a func registered with RegisterDBStatsFunc
+type statsFunc struct {
+	fn func() sql.DBStats
+}
+
+func (s *statsFunc) Stats() sql.DBStats {
+	return s.fn()
 }
 
+// Options returns the Options the collector was created with, for
+// exporters that name the collector's metrics.
+func (c *Collector) Options() Options {
+	return c.o
+}
+
+// Config returns the collector's Options as JSON, along with the names of
+// the metrics they enable under "Metrics".
+func (c *Collector) Config() ([]byte, error) {
+	info := c.enabledInfo()
+	metrics := make([]string, len(info))
+	for i, mi := range info {
+		metrics[i] = mi.name
+	}
+	return json.Marshal(struct {
+		Options
+		Metrics []string
+	}{c.o, metrics})
+}
+
+// enabledInfo returns the descriptions of the enabled metrics, including
+// those of the pings once HealthCheck is used
+func (c *Collector) enabledInfo() []metricInfo {
+	healthChecked := c.healthChecked.Load()
+	enabled := make([]metricInfo, 0, len(c.info))
+	for _, mi := range c.info {
+		if !mi.healthCheck || healthChecked {
+			enabled = append(enabled, mi)
+		}
+	}
+	return enabled
+}
+
+// dbEntry is the registration state of a single DB
+type dbEntry struct {
+	provider    StatsProvider
+	labelValues []string
+	driverName  string
+	registered  time.Time
+	priority    int
+	seq         uint64
+	noDerived   atomic.Bool
+	// name is the name of DBs registered with RegisterNamed
+	name string
+	// swaps is the number of times ReplaceNamed replaced the DB of name
+	swaps uint64
+	// acquisitions, if set, counts the connections handed out by the
+	// wrapped driver the DB was opened with
+	acquisitions *atomic.Uint64
+	// closed, if set, is set once the DB's wrapped connector is closed, as
+	// closing the DB does
+	closed *atomic.Bool
+	// labelNames are the labels of DBs of a LabelGroup, whose metrics are
+	// m. They are Options.Labels if nil.
+	labelNames []string
+	// poolConfig, if set, is the DB's configuration given to SetPoolConfig
+	// or RegisterDBWithPoolConfig
+	poolConfig atomic.Pointer[PoolConfig]
+	// collected, if set, is when the DB was last collected and the stats
+	// emitted for it
+	collected atomic.Pointer[collectedStats]
+
+	// labelFn, if set, computes the label values on every collection
+	labelFn func() []string
+
+	// stateFn, if set, computes the value of the label at stateIdx
+	stateFn  func(sql.DBStats) string
+	stateIdx int
+
+	// m, if set, are the DB's own metrics with its const labels
+	m *metrics
+
+	// statsRead, if set, is the read of the stats in flight, or finished
+	// after the collection that started it timed out
+	statsMu   sync.Mutex
+	statsRead *statsRead
+
+	mu        sync.Mutex
+	lastStats sql.DBStats
+	identical int
+
+	// idleRatios is a ring of the last idle ratios, NaN where the pool
+	// had no open connections.
+	idleRatios []float64
+	idleNext   int
+
+	// recentWaits is a ring of the average wait in seconds of the last
+	// intervals between observations.
+	recentWaits   []float64
+	recentNext    int
+	prevWaitCount int64
+	prevWaitDur   time.Duration
+	observedWait  bool
+
+	// The wait count and acquisitions of the previous collection, for
+	// connections_wait_ratio
+	ratioWaitCount    int64
+	ratioAcquisitions uint64
+	observedRatio     bool
+
+	// history is the last Options.StatsHistory stats read
+	history statsHistory
+
+	// The wait stats of the previous collection, for EventWaits
+	eventWaitCount    int64
+	eventWaitDur      time.Duration
+	eventWaitObserved bool
+
+	counterCollections int
+	counters           sql.DBStats
+
+	saturated      bool
+	saturatedSince time.Time
+
+	// The approximate histogram of waits, with the non-cumulative count
+	// of each bucket, and the wait stats it was last observed at
+	waitBuckets   []uint64
+	waitCount     uint64
+	waitSum       float64
+	histWaitCount int64
+	histWaitDur   time.Duration
+	histObserved  bool
+
+	// The peaks seen by the sampler since the previous collection
+	peakInUse      int
+	peakOpen       int
+	peakWait       time.Duration
+	sampledWaitDur time.Duration
+	sampledWait    bool
+
+	// The result of the latest ping by the prober
+	pinged  bool
+	up      bool
+	pingDur time.Duration
+
+	// The driver name and server version, queried once for database_info
+	infoDriverName string
+	serverVersion  string
+	versionRead    bool
+
+	collectTimeouts uint64
+}
+
+// refreshLabels returns a copy of the DB's label values, first replacing
+// them with the result of its label func, if it has one and the result is
+// valid
+func (c *Collector) refreshLabels(e *dbEntry) []string {
+	if e.labelFn == nil {
+		return e.currentLabelValues()
+	}
+	values := e.labelFn()
+	if c.validateLabelValues(values) != nil {
+		return e.currentLabelValues()
+	}
+	e.mu.Lock()
+	changed := !equalLabelValues(e.labelValues, values)
+	if changed {
+		e.labelValues = append([]string(nil), values...)
+	}
+	e.mu.Unlock()
+	if changed {
+		c.labelUpdates.Add(1)
+	}
+	return append([]string(nil), values...)
+}
+
+// currentLabelValues returns a copy of the DB's label values, which
+// RelabelAll may replace while it is collected
+func (e *dbEntry) currentLabelValues() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.labelValues...)
+}
+
+// observeSaturation records whether the DB is saturated at now and reports
+// whether that is a change which has lasted for at least dwell.
+func (e *dbEntry) observeSaturation(now time.Time, saturated bool, dwell time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if saturated == e.saturated {
+		e.saturatedSince = time.Time{}
+		return false
+	}
+	if e.saturatedSince.IsZero() {
+		e.saturatedSince = now
+	}
+	if now.Sub(e.saturatedSince) < dwell {
+		return false
+	}
+	e.saturated = saturated
+	e.saturatedSince = time.Time{}
+	return true
+}
+
+// sampleCounters returns stats with its counters replaced by the values
+// read on the most recent of every interval'th call. Counters never move
+// backwards.
+func (e *dbEntry) sampleCounters(stats sql.DBStats, interval int) sql.DBStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.counterCollections%interval == 0 {
+		if stats.WaitCount > e.counters.WaitCount {
+			e.counters.WaitCount = stats.WaitCount
+		}
+		if stats.WaitDuration > e.counters.WaitDuration {
+			e.counters.WaitDuration = stats.WaitDuration
+		}
+		if stats.MaxIdleClosed > e.counters.MaxIdleClosed {
+			e.counters.MaxIdleClosed = stats.MaxIdleClosed
+		}
+		if stats.MaxIdleTimeClosed > e.counters.MaxIdleTimeClosed {
+			e.counters.MaxIdleTimeClosed = stats.MaxIdleTimeClosed
+		}
+		if stats.MaxLifetimeClosed > e.counters.MaxLifetimeClosed {
+			e.counters.MaxLifetimeClosed = stats.MaxLifetimeClosed
+		}
+	}
+	e.counterCollections++
+
+	stats.WaitCount = e.counters.WaitCount
+	stats.WaitDuration = e.counters.WaitDuration
+	stats.MaxIdleClosed = e.counters.MaxIdleClosed
+	stats.MaxIdleTimeClosed = e.counters.MaxIdleTimeClosed
+	stats.MaxLifetimeClosed = e.counters.MaxLifetimeClosed
+	return stats
+}
+
+// observeRecentWait records the average wait since the previous
+// observation and returns the largest over the last window intervals, in
+// unit. ok is false until there has been at least one interval.
+func (e *dbEntry) observeRecentWait(stats sql.DBStats, window int, unit DurationUnit) (peak float64, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.observedWait {
+		var avg float64
+		if n := stats.WaitCount - e.prevWaitCount; n > 0 {
+			avg = unit.value(stats.WaitDuration-e.prevWaitDur) / float64(n)
+		}
+		if len(e.recentWaits) < window {
+			e.recentWaits = append(e.recentWaits, avg)
+		} else {
+			e.recentWaits[e.recentNext] = avg
+			e.recentNext = (e.recentNext + 1) % window
+		}
+	}
+	e.prevWaitCount = stats.WaitCount
+	e.prevWaitDur = stats.WaitDuration
+	e.observedWait = true
+
+	if len(e.recentWaits) == 0 {
+		return 0, false
+	}
+	for _, w := range e.recentWaits {
+		if w > peak {
+			peak = w
+		}
+	}
+	return peak, true
+}
+
+// observeWaitRatio records the wait count and acquisitions and returns
+// the share of the acquisitions since the previous observation that
+// waited. ok is false for the first observation.
+func (e *dbEntry) observeWaitRatio(waitCount int64, acquisitions uint64) (ratio float64, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	waits, acquired := waitCount-e.ratioWaitCount, acquisitions-e.ratioAcquisitions
+	ok = e.observedRatio
+	e.ratioWaitCount, e.ratioAcquisitions, e.observedRatio = waitCount, acquisitions, true
+	if !ok || acquired == 0 || waits <= 0 {
+		return 0, ok
+	}
+	// Waits are counted when they start, acquisitions when they end, so a
+	// wait in progress may outnumber them
+	return min(float64(waits)/float64(acquired), 1), true
+}
+
+// observeWaits records the waits since the previous observation in the
+// approximate wait histogram with the given buckets in unit, as waits of
+// their average duration
+func (e *dbEntry) observeWaits(stats sql.DBStats, buckets []float64, unit DurationUnit) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.observeWaitsLocked(stats, buckets, unit)
+}
+
+func (e *dbEntry) observeWaitsLocked(stats sql.DBStats, buckets []float64, unit DurationUnit) {
+	if e.waitBuckets == nil {
+		e.waitBuckets = make([]uint64, len(buckets))
+	}
+	// Stats going backwards are of a replaced pool, and start over
+	if e.histObserved && stats.WaitCount >= e.histWaitCount && stats.WaitDuration >= e.histWaitDur {
+		if n := stats.WaitCount - e.histWaitCount; n > 0 {
+			total := unit.value(stats.WaitDuration - e.histWaitDur)
+			avg := total / float64(n)
+			if i := sort.SearchFloat64s(buckets, avg); i < len(buckets) {
+				e.waitBuckets[i] += uint64(n)
+			}
+			e.waitCount += uint64(n)
+			e.waitSum += total
+		}
+	}
+	e.histWaitCount = stats.WaitCount
+	e.histWaitDur = stats.WaitDuration
+	e.histObserved = true
+}
+
+// takeWaits records stats, read by a collection, in the approximate wait
+// histogram and returns it with cumulative bucket counts
+func (e *dbEntry) takeWaits(stats sql.DBStats, buckets []float64, unit DurationUnit) (count uint64, sum float64, cumulative map[float64]uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.observeWaitsLocked(stats, buckets, unit)
+	cumulative = make(map[float64]uint64, len(buckets))
+	var n uint64
+	for i, upper := range buckets {
+		n += e.waitBuckets[i]
+		cumulative[upper] = n
+	}
+	return e.waitCount, e.waitSum, cumulative
+}
+
+// observeIdleRatio records the idle ratio of stats and returns the average
+// over the last window observations. ok is false if none of them had open
+// connections.
+func (e *dbEntry) observeIdleRatio(stats sql.DBStats, window int) (avg float64, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ratio := math.NaN()
+	if stats.OpenConnections > 0 {
+		ratio = float64(stats.Idle) / float64(stats.OpenConnections)
+	}
+	if len(e.idleRatios) < window {
+		e.idleRatios = append(e.idleRatios, ratio)
+	} else {
+		e.idleRatios[e.idleNext] = ratio
+		e.idleNext = (e.idleNext + 1) % window
+	}
+
+	var sum float64
+	var n int
+	for _, r := range e.idleRatios {
+		if !math.IsNaN(r) {
+			sum += r
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
+
+// observeFrozen records stats and reports whether the last threshold
+// observations were identical while connections were in use.
+func (e *dbEntry) observeFrozen(stats sql.DBStats, threshold int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.identical > 0 && stats == e.lastStats {
+		e.identical++
+	} else {
+		e.identical = 1
+	}
+	e.lastStats = stats
+	return stats.InUse > 0 && e.identical >= threshold
+}
+
+// RegisterDB adds db to the collector with the given values for
+// Options.Labels. It returns an error if db is already registered or the
+// label values don't match Options.Labels.
+func (c *Collector) RegisterDB(db *sql.DB, labelValues []string) error {
+	return c.register(db, &dbEntry{labelValues: labelValues})
+}
+
+// MustRegisterDB is like RegisterDB but panics on error
 func (c *Collector) MustRegisterDB(db *sql.DB, labelValues []string) {
+	if err := c.RegisterDB(db, labelValues); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterDBWithDriverName registers db, filling in the DriverLabel label
+// with driverName. labelValues holds the values of the remaining labels in
+// Options.Labels, in order.
+func (c *Collector) RegisterDBWithDriverName(db *sql.DB, driverName string, labelValues []string) error {
+	values, _, err := c.insertLabel(DriverLabel, driverName, labelValues)
+	if err != nil {
+		return err
+	}
+	return c.register(db, &dbEntry{labelValues: values, driverName: driverName})
+}
+
+// RegisterDBWithStateLabel registers db, filling in the StateLabel label on
+// every collection with the result of fn applied to the DB's current stats.
+// labelValues holds the values of the remaining labels in Options.Labels, in
+// order. Under Options.EmitFleetTotals, a state of FleetTotalLabelValue
+// would collide with the fleet totals, so it is emitted as
+// InvalidStateLabelValue.
+func (c *Collector) RegisterDBWithStateLabel(db *sql.DB, fn func(sql.DBStats) string, labelValues []string) error {
+	values, idx, err := c.insertLabel(StateLabel, "", labelValues)
+	if err != nil {
+		return err
+	}
+	return c.register(db, &dbEntry{labelValues: values, stateFn: fn, stateIdx: idx})
+}
+
+// state returns the StateLabel value of e with stats, replacing a reserved
+// value with InvalidStateLabelValue and counting it as an invalid state in
+// sqlmetrics_invalid_stats_total
+func (c *Collector) state(e *dbEntry, stats sql.DBStats) string {
+	state := e.stateFn(stats)
+	if c.o.EmitFleetTotals && state == FleetTotalLabelValue {
+		c.invalidMu.Lock()
+		c.invalid["state"]++
+		c.invalidMu.Unlock()
+		return InvalidStateLabelValue
+	}
+	return state
+}
+
+// RegisterDBWithLabelFunc registers db with its label values given by fn,
+// which is called on every collection, so labels that change over time,
+// such as a DB's role after a failover, stay accurate without
+// re-registering it. fn must be safe for concurrent use. Invalid results
+// are ignored, keeping the previous values.
+func (c *Collector) RegisterDBWithLabelFunc(db *sql.DB, fn func() []string) error {
+	return c.register(db, &dbEntry{labelValues: fn(), labelFn: fn})
+}
+
+// insertLabel returns labelValues with value inserted at the position of
+// label in Options.Labels, and that position.
+func (c *Collector) insertLabel(label, value string, labelValues []string) ([]string, int, error) {
+	idx := -1
+	for i, l := range c.o.Labels {
+		if l == label {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, 0, fmt.Errorf("label %q is not in Options.Labels", label)
+	}
+	if len(labelValues) != len(c.o.Labels)-1 {
+		return nil, 0, fmt.Errorf("expected %d label values for labels %q without %q, got %d: %q", len(c.o.Labels)-1, c.o.Labels, label, len(labelValues), labelValues)
+	}
+
+	values := make([]string, 0, len(c.o.Labels))
+	values = append(values, labelValues[:idx]...)
+	values = append(values, value)
+	values = append(values, labelValues[idx:]...)
+	return values, idx, nil
+}
+
+// RegisterDBWithLabels registers db with its label values given by name.
+// labels must have exactly the names in Options.Labels, so values can't be
+// mixed up the way positional values can.
+func (c *Collector) RegisterDBWithLabels(db *sql.DB, labels map[string]string) error {
+	values, err := c.labelValues(labels)
+	if err != nil {
+		return err
+	}
+	return c.register(db, &dbEntry{labelValues: values})
+}
+
+// labelValues orders labels by Options.Labels, rejecting missing and extra
+// names.
+func (c *Collector) labelValues(labels map[string]string) ([]string, error) {
+	values := make([]string, len(c.o.Labels))
+	for i, name := range c.o.Labels {
+		v, ok := labels[name]
+		if !ok {
+			return nil, fmt.Errorf("missing label %q", name)
+		}
+		values[i] = v
+	}
+	if len(labels) != len(c.o.Labels) {
+		for name := range labels {
+			known := false
+			for _, l := range c.o.Labels {
+				if name == l {
+					known = true
+					break
+				}
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown label %q, expected labels %q", name, c.o.Labels)
+			}
+		}
+	}
+	return values, nil
+}
+
+// RegisterDBWithConstLabels registers db with constLabels added to all of
+// its series, in addition to the values for Options.Labels.
+func (c *Collector) RegisterDBWithConstLabels(db *sql.DB, labelValues []string, constLabels prometheus.Labels) error {
+	for name := range constLabels {
+		for _, l := range c.o.Labels {
+			if name == l {
+				return fmt.Errorf("const label %q is also in Options.Labels", name)
+			}
+		}
+		if _, ok := c.o.ConstLabels[name]; ok {
+			return fmt.Errorf("const label %q is also in Options.ConstLabels", name)
+		}
+		for metric, labels := range c.o.PerMetricConstLabels {
+			if _, ok := labels[name]; ok {
+				return fmt.Errorf("const label %q is also a const label of %s", name, metric)
+			}
+		}
+	}
+
+	m, info := newMetrics(c.o, constLabels)
+	if err := checkInfo(info); err != nil {
+		return err
+	}
+	c.perDB.Store(true)
+	return c.register(db, &dbEntry{labelValues: labelValues, m: m})
+}
+
+// RegisterDBWithNamespace registers db with its metrics named with
+// namespace and subsystem in place of Options.Namespace and
+// Options.Subsystem, so DBs of different components can be told apart by
+// metric name, such as readmodel_db_connections_open. The query metrics
+// of wrapped drivers keep the collector's names.
+func (c *Collector) RegisterDBWithNamespace(db *sql.DB, namespace, subsystem string, labelValues []string) error {
+	o := c.o
+	o.Namespace, o.Subsystem = namespace, subsystem
+	m, info := newMetrics(o, nil)
+	if err := checkInfo(info); err != nil {
+		return err
+	}
+	c.perDB.Store(true)
+	return c.register(db, &dbEntry{labelValues: labelValues, m: m})
+}
+
+// RegisterDBPrioritized registers db with the given collection priority.
+// Collect reads and emits DBs in descending priority order, so that past
+// Options.CollectDeadline the lowest priority ones are dropped first; DBs
+// registered through the other methods have priority 0.
+func (c *Collector) RegisterDBPrioritized(db *sql.DB, priority int, labelValues []string) error {
+	return c.register(db, &dbEntry{labelValues: labelValues, priority: priority})
+}
+
+// RegisterDBStatsFunc registers a DB whose stats are supplied by fn rather
+// than read from a *sql.DB, e.g. a wrapped or fake pool.
+func (c *Collector) RegisterDBStatsFunc(fn func() sql.DBStats, labelValues []string) error {
+	return c.register(&statsFunc{fn: fn}, &dbEntry{labelValues: labelValues})
+}
+
+// RegisterProvider registers a pool whose stats are read from p, which
+// identifies it for UnregisterProvider. p is used as a map key, so it must
+// be comparable, such as a pointer.
+func (c *Collector) RegisterProvider(p StatsProvider, labelValues []string) error {
+	if p == nil || !reflect.TypeOf(p).Comparable() {
+		return fmt.Errorf("stats provider %T is not comparable", p)
+	}
+	return c.register(p, &dbEntry{labelValues: labelValues})
+}
+
+// UnregisterProvider removes a pool registered with RegisterProvider,
+// reporting whether it was registered.
+func (c *Collector) UnregisterProvider(p StatsProvider) bool {
+	return c.unregister(p)
+}
+
+func (c *Collector) register(p StatsProvider, e *dbEntry) error {
+	if err := c.add(p, e); err != nil {
+		return err
+	}
+	if err := c.registerSelf(); err != nil {
+		c.unregister(p)
+		return err
+	}
+	return nil
+}
+
+func (c *Collector) add(p StatsProvider, e *dbEntry) error {
 	c.l.Lock()
 	defer c.l.Unlock()
 
-	if _, ok := c.dbs[db]; ok {
-		panic("duplicate register")
+	if _, ok := c.dbs[p]; ok {
+		return ErrAlreadyRegistered
+	}
+	if err := c.validateLabelValuesOf(c.entryLabels(e), e.labelValues); err != nil {
+		return err
 	}
-	c.dbs[db] = labelValues
+	c.insert(p, e)
+	c.publish()
+	return nil
 }
 
-func (c Collector) Describe(ch chan<- *prometheus.Desc) {
-	prometheus.DescribeByCollect(c, ch)
+// insert adds e to the registered DBs. c.l must be held.
+func (c *Collector) insert(p StatsProvider, e *dbEntry) {
+	c.seq++
+	e.provider = p
+	e.seq = c.seq
+	e.registered = c.now()
+	c.dbs[p] = e
 }
 
-func (c Collector) Collect(ch chan<- prometheus.Metric) {
-	c.l.RLock()
-	defer c.l.RUnlock()
+// registerSelf registers the collector with Options.RegisterOnFirstDB the
+// first time it is called successfully.
+func (c *Collector) registerSelf() error {
+	if c.o.RegisterOnFirstDB == nil {
+		return nil
+	}
 
-	for db, labelValues := range c.dbs {
-		stats := db.Stats()
+	c.selfMu.Lock()
+	defer c.selfMu.Unlock()
+	if c.selfRegistered {
+		return nil
+	}
+	if err := c.o.RegisterOnFirstDB.Register(c); err != nil {
+		return err
+	}
+	c.selfRegistered = true
+	return nil
+}
 
+// SetDerivedMetrics enables or disables the derived metrics
+// (connections_idle_ratio_avg, connections_wait_duration_recent_max_seconds,
+// connections_wait_ratio, the connections_wait_seconds histogram,
+// connections_utilization_ratio and connections_saturation) for a
+// registered db. They are enabled by default and can be disabled for
+// DBs where they are meaningless, such as pools without a connection limit.
+func (c *Collector) SetDerivedMetrics(db *sql.DB, enabled bool) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	e, ok := c.dbs[db]
+	if !ok {
+		return ErrNotRegistered
+	}
+	e.noDerived.Store(!enabled)
+	return nil
+}
+
+// UnregisterDB removes db from the collector so its series are no longer
+// emitted, reporting whether it was registered.
+func (c *Collector) UnregisterDB(db *sql.DB) bool {
+	return c.unregister(db)
+}
+
+// CloseDB unregisters db and closes it. A closed DB's stats stay frozen at
+// their last values, so a DB that is closed while still registered is
+// emitted as a ghost pool until the prober of Options.PingInterval notices
+// it was closed.
+func (c *Collector) CloseDB(db *sql.DB) error {
+	c.unregister(db)
+	return db.Close()
+}
+
+// DBs returns the registered *sql.DBs in collection order
+func (c *Collector) DBs() []*sql.DB {
+	var dbs []*sql.DB
+	for _, e := range c.entries() {
+		if db, ok := e.provider.(*sql.DB); ok {
+			dbs = append(dbs, db)
+		}
+	}
+	return dbs
+}
+
+func (c *Collector) unregister(p StatsProvider) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	e, ok := c.dbs[p]
+	if !ok {
+		return false
+	}
+	delete(c.dbs, p)
+	if e.name != "" {
+		delete(c.named, e.name)
+	}
+	c.publish()
+	return true
+}
+
+// entries returns the registered DBs in collection order: by descending
+// priority, then by registration order. The slice must not be modified.
+func (c *Collector) entries() []*dbEntry {
+	if entries := c.view.Load(); entries != nil {
+		return *entries
+	}
+	return nil
+}
+
+// publish replaces the view of the registered DBs. c.l must be held.
+func (c *Collector) publish() {
+	entries := make([]*dbEntry, 0, len(c.dbs))
+	for _, e := range c.dbs {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].priority != entries[j].priority {
+			return entries[i].priority > entries[j].priority
+		}
+		return entries[i].seq < entries[j].seq
+	})
+	c.view.Store(&entries)
+}
+
+// RelabelAll replaces the label values of every registered DB with the
+// result of fn applied to its current values. If any result is invalid no
+// DB is relabeled. The DBs of LabelGroups have labels of their own and
+// are left as they are.
+func (c *Collector) RelabelAll(fn func(old []string) []string) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	relabeled := make(map[*dbEntry][]string, len(c.dbs))
+	for _, e := range c.dbs {
+		if e.labelNames != nil {
+			continue
+		}
+		old := e.currentLabelValues()
+
+		values := fn(old)
+		if err := c.validateLabelValues(values); err != nil {
+			return err
+		}
+		relabeled[e] = values
+	}
+
+	for e, values := range relabeled {
+		if !equalLabelValues(e.currentLabelValues(), values) {
+			c.labelUpdates.Add(1)
+		}
+		e.mu.Lock()
+		e.labelValues = values
+		e.mu.Unlock()
+	}
+	return nil
+}
+
+// UpdateLabels replaces the label values of the registered db, such as
+// its role after a failover, keeping its history. A collection in progress
+// emits the DB with either its old or its new values. Only the pool's
+// metrics are relabeled: the query metrics of a wrapped driver keep the
+// values it was wrapped with. DBs registered with RegisterDBWithLabelFunc
+// get theirs from their func and can't be updated.
+func (c *Collector) UpdateLabels(db *sql.DB, labelValues []string) error {
+	return c.updateLabels(db, labelValues)
+}
+
+// UpdateProviderLabels replaces the label values of a pool registered with
+// RegisterProvider, as UpdateLabels does
+func (c *Collector) UpdateProviderLabels(p StatsProvider, labelValues []string) error {
+	return c.updateLabels(p, labelValues)
+}
+
+func (c *Collector) updateLabels(p StatsProvider, labelValues []string) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	e, ok := c.dbs[p]
+	if !ok {
+		return ErrNotRegistered
+	}
+	if e.labelFn != nil {
+		return errors.New("db is registered with a label func")
+	}
+	if err := c.validateLabelValuesOf(c.entryLabels(e), labelValues); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	changed := !equalLabelValues(e.labelValues, labelValues)
+	e.labelValues = append([]string(nil), labelValues...)
+	e.mu.Unlock()
+	if changed {
+		c.labelUpdates.Add(1)
+	}
+	return nil
+}
+
+func equalLabelValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Collector) validateLabelValues(values []string) error {
+	return c.validateLabelValuesOf(c.o.Labels, values)
+}
+
+// validateLabelValuesOf checks values are valid values of the labels
+func (c *Collector) validateLabelValuesOf(labels, values []string) error {
+	if len(values) != len(labels) {
+		return fmt.Errorf("expected %d label values for labels %q, got %d: %q", len(labels), labels, len(values), values)
+	}
+	if c.o.EmitFleetTotals {
+		for _, v := range values {
+			if v == FleetTotalLabelValue {
+				return fmt.Errorf("label value %q is reserved for fleet totals", FleetTotalLabelValue)
+			}
+		}
+	}
+	return nil
+}
+
+// Describe sends the Descs of the collector's metrics, or none if DBs with
+// metrics of their own were registered before the collector was first
+// described, which makes it an unchecked collector, as Options explains.
+// Whether it is checked is decided on the first Describe, so registries
+// see the same Descs on every call.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.describeOnce.Do(func() { c.unchecked = c.perDB.Load() })
+	if c.unchecked {
+		return
+	}
+	for _, d := range c.m.descs(c.o, c.info) {
+		if d != nil {
+			ch <- d
+		}
+	}
+	c.q.describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if c.o.RefreshInterval > 0 {
+		c.collectRefreshed(ch)
+		return
+	}
+	c.collect(ch)
+}
+
+func (c *Collector) collect(ch chan<- prometheus.Metric) {
+	// Saturation changes are reported once the DBs are collected, so the
+	// callback may register or relabel DBs.
+	var saturationChanges []*sample
+	defer func() {
+		for _, s := range saturationChanges {
+			c.o.OnSaturationChange(append([]string(nil), s.labelValues...), !Healthy(s.stats))
+		}
+	}()
+
+	c.pairs.rotate()
+	now := c.now()
+	c.lastCollectMu.Lock()
+	c.lastCollect = now
+	c.lastCollectMu.Unlock()
+	var deadline time.Time
+	if c.o.CollectDeadline > 0 {
+		deadline = now.Add(c.o.CollectDeadline)
+	}
+	samples := c.readSamples(now, deadline)
+
+	var unhealthy int
+	bands := make([]int, len(c.o.UtilizationBands))
+	for _, s := range samples {
+		if s.countersOnly {
+			continue
+		}
+		if !Healthy(s.stats) {
+			unhealthy++
+		}
+		if c.o.OnSaturationChange != nil && s.entry.observeSaturation(now, !Healthy(s.stats), c.o.SaturationDwell) {
+			saturationChanges = append(saturationChanges, s)
+		}
+		if len(bands) > 0 && s.stats.MaxOpenConnections > 0 {
+			utilization := float64(s.stats.InUse) / float64(s.stats.MaxOpenConnections)
+			i := 0
+			for i < len(bands)-1 && utilization > c.o.UtilizationBands[i].Max {
+				i++
+			}
+			bands[i]++
+		}
+	}
+	if c.o.AutoAggregateDuplicateLabels {
+		samples = aggregateSamples(samples)
+	}
+
+	var total sql.DBStats
+	c.collectSamples(ch, samples)
+	if c.o.EmitFleetTotals {
+		// Only the DBs of Options.Labels are summed: the DBs with their own
+		// metrics, such as those of LabelGroups, aren't part of the fleet.
+		for _, s := range samples {
+			if s.m == c.m {
+				total = addStats(total, s.emitted)
+			}
+		}
+	}
+
+	if c.m.unhealthyDBs != nil {
 		ch <- prometheus.MustNewConstMetric(
-			c.m.maxConnsDesc,
-			prometheus.GaugeValue,
-			float64(stats.MaxOpenConnections),
-			labelValues...,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.m.openConns,
+			c.m.unhealthyDBs,
 			prometheus.GaugeValue,
-			float64(stats.OpenConnections),
-			labelValues...,
+			float64(unhealthy),
 		)
+	}
+	if c.m.labelUpdates != nil {
+		ch <- c.constCounter(c.m.labelUpdates, float64(c.labelUpdates.Load()), c.started)
+	}
+
+	if c.m.dbsByBand != nil {
+		for i, n := range bands {
+			ch <- prometheus.MustNewConstMetric(
+				c.m.dbsByBand,
+				prometheus.GaugeValue,
+				float64(n),
+				c.o.UtilizationBands[i].Name,
+			)
+		}
+	}
+
+	if c.o.CollectConcurrency > 1 && c.m.concurrency != nil {
 		ch <- prometheus.MustNewConstMetric(
-			c.m.inUse,
+			c.m.concurrency,
 			prometheus.GaugeValue,
-			float64(stats.InUse),
-			labelValues...,
+			float64(c.o.CollectConcurrency),
 		)
+	}
+
+	if c.o.CollectDeadline > 0 && c.m.droppedDBs != nil {
+		ch <- c.constCounter(c.m.droppedDBs, float64(c.droppedDBs.Load()), c.started)
+	}
+
+	if c.m.statsErrors != nil {
+		ch <- c.constCounter(c.m.statsErrors, float64(c.statsPanics.Load()), c.started, statsReadPanic)
+		if c.o.StatsTimeout > 0 {
+			ch <- c.constCounter(c.m.statsErrors, float64(c.statsTimeouts.Load()), c.started, statsReadTimeout)
+		}
+	}
+
+	if c.o.EmitStartTime && c.m.startTime != nil {
 		ch <- prometheus.MustNewConstMetric(
-			c.m.idle,
+			c.m.startTime,
 			prometheus.GaugeValue,
-			float64(stats.Idle),
-			labelValues...,
+			float64(c.started.UnixNano())/1e9,
 		)
+	}
 
-		// Counters
-		ch <- prometheus.MustNewConstMetric(
-			c.m.waitCount,
-			prometheus.CounterValue,
-			float64(stats.WaitCount),
-			labelValues...,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.m.waitDuration,
-			prometheus.CounterValue,
-			float64(stats.WaitDuration.Seconds()),
-			labelValues...,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.m.maxIdleClosed,
-			prometheus.CounterValue,
-			float64(stats.MaxIdleClosed),
-			labelValues...,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.m.maxLifetimeClosed,
-			prometheus.CounterValue,
-			float64(stats.MaxLifetimeClosed),
-			labelValues...,
-		)
+	if c.m.invalidStats != nil {
+		c.invalidMu.Lock()
+		for field, n := range c.invalid {
+			ch <- c.constCounter(c.m.invalidStats, float64(n), c.started, field)
+		}
+		c.invalidMu.Unlock()
+	}
+
+	if c.o.EmitMetricInfo && c.m.metricInfo != nil {
+		for _, mi := range c.enabledInfo() {
+			valueType := "gauge"
+			switch mi.valueType {
+			case prometheus.CounterValue:
+				valueType = "counter"
+			case prometheus.UntypedValue:
+				valueType = "histogram"
+			}
+			ch <- prometheus.MustNewConstMetric(
+				c.m.metricInfo,
+				prometheus.GaugeValue,
+				1,
+				mi.name, valueType, mi.unit, mi.help,
+			)
+		}
+	}
+
+	if c.o.EmitFleetTotals && len(c.o.Labels) > 0 {
+		totalLabels := make([]string, len(c.o.Labels))
+		for i := range totalLabels {
+			totalLabels[i] = FleetTotalLabelValue
+		}
+		c.collectStats(c.constMetrics(ch, totalLabels, c.started), c.m, total)
+	}
+
+	c.q.collect(ch)
+}
+
+// sample is a DB's stats as read during a single collection
+type sample struct {
+	// entry is nil for samples aggregated from several DBs
+	entry        *dbEntry
+	m            *metrics
+	labelValues  []string
+	stats        sql.DBStats
+	emitted      sql.DBStats
+	readDuration time.Duration
+	// deadline, if set, is when the collection's Options.CollectDeadline
+	// passes
+	deadline time.Time
+
+	// countersOnly is set for DBs within their warmup, whose gauges are
+	// zeroed and not emitted
+	countersOnly bool
+}
+
+// readSamples reads the stats of every DB that is past its warmup, in
+// collection order, leaving out those not read by deadline if it is set.
+func (c *Collector) readSamples(now, deadline time.Time) []*sample {
+	var entries []*dbEntry
+	for _, e := range c.entries() {
+		if now.Sub(e.registered) < c.o.WarmupDelay && !c.o.WarmupEmitCounters {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	type read struct {
+		stats    sql.DBStats
+		ok       bool
+		duration time.Duration
+	}
+	reads := make([]read, len(entries))
+	var dropped atomic.Uint64
+	c.parallel(len(entries), func(i int) {
+		if c.pastDeadline(deadline) {
+			dropped.Add(1)
+			return
+		}
+		start := time.Now()
+		stats, ok := c.readStats(entries[i])
+		reads[i] = read{stats, ok, time.Since(start)}
+	})
+	c.droppedDBs.Add(dropped.Load())
+
+	var samples []*sample
+	for i, e := range entries {
+		warmingUp := now.Sub(e.registered) < c.o.WarmupDelay
+		stats, readDuration := reads[i].stats, reads[i].duration
+		if !reads[i].ok {
+			continue
+		}
+		if c.o.StatsHistory > 0 && c.o.SampleInterval <= 0 {
+			e.recordStats(now, stats, c.o.StatsHistory)
+		}
+		stats = c.sanitize(stats)
+
+		labelValues := c.refreshLabels(e)
+		if e.stateFn != nil {
+			labelValues[e.stateIdx] = c.state(e, stats)
+		}
+		c.observeWaitEvent(e, stats, labelValues, now)
+
+		emitted := stats
+		if c.o.CounterRefreshInterval > 1 {
+			emitted = e.sampleCounters(stats, c.o.CounterRefreshInterval)
+		}
+
+		if warmingUp {
+			emitted.MaxOpenConnections = 0
+			emitted.OpenConnections = 0
+			emitted.InUse = 0
+			emitted.Idle = 0
+		}
+
+		m := c.m
+		if e.m != nil {
+			m = e.m
+		}
+		e.collected.Store(&collectedStats{at: now, stats: emitted})
+
+		samples = append(samples, &sample{
+			entry:        e,
+			m:            m,
+			labelValues:  labelValues,
+			stats:        stats,
+			emitted:      emitted,
+			readDuration: readDuration,
+			deadline:     deadline,
+			countersOnly: warmingUp,
+		})
+	}
+	return samples
+}
+
+// pastDeadline reports whether deadline is set and has passed
+func (c *Collector) pastDeadline(deadline time.Time) bool {
+	return !deadline.IsZero() && !c.now().Before(deadline)
+}
+
+// parallel calls fn with each index below n, on up to
+// Options.CollectConcurrency goroutines at once
+func (c *Collector) parallel(n int, fn func(i int)) {
+	parallel(c.o.CollectConcurrency, n, fn)
+}
+
+// parallel calls fn with each index below n, on up to workers goroutines at
+// once, or on the calling goroutine unless workers is greater than 1
+func parallel(workers, n int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// collectSamples emits samples in order, collecting them concurrently per
+// Options.CollectConcurrency
+func (c *Collector) collectSamples(ch chan<- prometheus.Metric, samples []*sample) {
+	if c.o.CollectConcurrency <= 1 {
+		for _, s := range samples {
+			c.collectSample(ch, s)
+		}
+		return
+	}
+
+	collected := make([][]prometheus.Metric, len(samples))
+	c.parallel(len(samples), func(i int) {
+		sampleCh := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for m := range sampleCh {
+				collected[i] = append(collected[i], m)
+			}
+		}()
+		c.collectSample(sampleCh, samples[i])
+		close(sampleCh)
+		<-done
+	})
+	for _, metrics := range collected {
+		for _, m := range metrics {
+			ch <- m
+		}
+	}
+}
+
+// aggregateSamples merges samples with identical metrics and label values into a
+// single sample with their summed stats, keeping the order of first
+// occurrence.
+func aggregateSamples(samples []*sample) []*sample {
+	index := make(map[string]int, len(samples))
+	var aggregated []*sample
+	for _, s := range samples {
+		key := fmt.Sprintf("%p\xff%s", s.m, strings.Join(s.labelValues, "\xff"))
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(aggregated)
+			aggregated = append(aggregated, s)
+			continue
+		}
+		agg := aggregated[i]
+		aggregated[i] = &sample{
+			m:            agg.m,
+			labelValues:  agg.labelValues,
+			stats:        addStats(agg.stats, s.stats),
+			emitted:      addStats(agg.emitted, s.emitted),
+			countersOnly: agg.countersOnly && s.countersOnly,
+		}
+	}
+	return aggregated
+}
+
+// addStats returns the field-wise sum of a and b
+func addStats(a, b sql.DBStats) sql.DBStats {
+	a.MaxOpenConnections += b.MaxOpenConnections
+	a.OpenConnections += b.OpenConnections
+	a.InUse += b.InUse
+	a.Idle += b.Idle
+	a.WaitCount += b.WaitCount
+	a.WaitDuration += b.WaitDuration
+	a.MaxIdleClosed += b.MaxIdleClosed
+	a.MaxIdleTimeClosed += b.MaxIdleTimeClosed
+	a.MaxLifetimeClosed += b.MaxLifetimeClosed
+	return a
+}
+
+// collectSample emits the metrics of a single sample. Metrics that depend
+// on per-DB history are only emitted for samples of a single DB.
+func (c *Collector) collectSample(ch chan<- prometheus.Metric, s *sample) {
+	m := s.m
+	labelValues := s.labelValues
+	created := c.started
+	if s.entry != nil {
+		created = s.entry.registered
+	}
+	cm := c.constMetrics(ch, labelValues, created)
+
+	if s.countersOnly {
+		c.collectCounters(cm, m, s.emitted)
+		return
+	}
+
+	cm.emit(m.maxConnsDesc, prometheus.GaugeValue, float64(s.emitted.MaxOpenConnections))
+	c.collectStats(cm, m, s.emitted)
+
+	e := s.entry
+	if e == nil {
+		return
+	}
+	stats := s.stats
+
+	if p := e.poolConfig.Load(); p != nil {
+		cm.emit(m.maxIdleConns, prometheus.GaugeValue, float64(p.maxIdle()))
+		cm.emit(m.connMaxLifetime, prometheus.GaugeValue, c.o.Duration(max(p.ConnMaxLifetime, 0)))
+		cm.emit(m.connMaxIdleTime, prometheus.GaugeValue, c.o.Duration(max(p.ConnMaxIdleTime, 0)))
+	}
+
+	if e.name != "" {
+		cm.emit(m.swaps, prometheus.CounterValue, float64(e.swaps))
+	}
+
+	if c.o.EmitStatsReadDuration {
+		cm.emit(m.statsReadSeconds, prometheus.GaugeValue, c.o.Duration(s.readDuration))
+	}
+
+	if c.o.IdleRatioWindow > 0 && !e.noDerived.Load() {
+		if avg, ok := e.observeIdleRatio(stats, c.o.IdleRatioWindow); ok {
+			cm.emit(m.idleRatioAvg, prometheus.GaugeValue, avg)
+		}
+	}
+
+	if c.o.RecentWaitWindow > 0 && !e.noDerived.Load() {
+		if peak, ok := e.observeRecentWait(stats, c.o.RecentWaitWindow, c.o.DurationUnit); ok {
+			cm.emit(m.recentWaitMax, prometheus.GaugeValue, peak)
+		}
+	}
+
+	if c.o.EmitWaitRatio && e.acquisitions != nil && !e.noDerived.Load() {
+		if ratio, ok := e.observeWaitRatio(stats.WaitCount, e.acquisitions.Load()); ok {
+			cm.emit(m.waitRatio, prometheus.GaugeValue, ratio)
+		}
+	}
+
+	if len(c.o.WaitDurationBuckets) > 0 && !e.noDerived.Load() {
+		count, sum, buckets := e.takeWaits(stats, c.o.WaitDurationBuckets, c.o.DurationUnit)
+		if m.waitHistogram != nil {
+			ch <- c.constHistogram(m.waitHistogram, count, sum, buckets, e.registered, labelValues...)
+		}
+	}
+
+	if c.o.EmitUtilization && !e.noDerived.Load() {
+		if stats.MaxOpenConnections > 0 {
+			cm.emit(m.utilization, prometheus.GaugeValue, float64(stats.InUse)/float64(stats.MaxOpenConnections))
+		}
+		var saturation float64
+		if !Healthy(stats) {
+			saturation = 1
+		}
+		cm.emit(m.saturation, prometheus.GaugeValue, saturation)
+	}
+
+	if c.o.SampleInterval > 0 {
+		inUse, open, wait := e.takePeaks(stats)
+		cm.emit(m.peakInUse, prometheus.GaugeValue, float64(inUse))
+		cm.emit(m.peakOpen, prometheus.GaugeValue, float64(open))
+		cm.emit(m.peakIntervalWait, prometheus.GaugeValue, c.o.Duration(wait))
+	}
+
+	// DBs are pinged by the prober of Options.PingInterval and by
+	// HealthChecks
+	if up, d, ok := e.pingResult(); ok {
+		var v float64
+		if up {
+			v = 1
+		}
+		cm.emit(m.up, prometheus.GaugeValue, v)
+		cm.emit(m.pingDuration, prometheus.GaugeValue, c.o.Duration(d))
+	}
+
+	if c.o.DatabaseInfo {
+		if driverName, version, ok := c.databaseInfo(e, s.deadline); ok && m.databaseInfo != nil {
+			ch <- prometheus.MustNewConstMetric(
+				m.databaseInfo,
+				prometheus.GaugeValue,
+				1,
+				append(append(make([]string, 0, len(labelValues)+2), labelValues...), driverName, version)...,
+			)
+		}
+		e.mu.Lock()
+		timeouts := e.collectTimeouts
+		e.mu.Unlock()
+		cm.emit(m.collectTimeouts, prometheus.CounterValue, float64(timeouts))
+	}
+
+	if c.o.FrozenThreshold > 0 {
+		var frozen float64
+		if e.observeFrozen(stats, c.o.FrozenThreshold) {
+			frozen = 1
+		}
+		cm.emit(m.frozen, prometheus.GaugeValue, frozen)
+	}
+}
+
+// sanitize clamps impossible values in stats, such as negative counts or
+// more connections in use than are open, counting each clamped field.
+func (c *Collector) sanitize(stats sql.DBStats) sql.DBStats {
+	var invalid []string
+	clampInt := func(field string, v *int, max int) {
+		switch {
+		case *v < 0:
+			*v = 0
+		case *v > max:
+			*v = max
+		default:
+			return
+		}
+		invalid = append(invalid, field)
+	}
+	clampInt64 := func(field string, v *int64) {
+		if *v < 0 {
+			*v = 0
+			invalid = append(invalid, field)
+		}
+	}
+
+	clampInt("max_open_connections", &stats.MaxOpenConnections, math.MaxInt32)
+	clampInt("open_connections", &stats.OpenConnections, math.MaxInt32)
+	clampInt("in_use", &stats.InUse, stats.OpenConnections)
+	clampInt("idle", &stats.Idle, stats.OpenConnections-stats.InUse)
+	clampInt64("wait_count", &stats.WaitCount)
+	if stats.WaitDuration < 0 {
+		stats.WaitDuration = 0
+		invalid = append(invalid, "wait_duration")
+	}
+	clampInt64("max_idle_closed", &stats.MaxIdleClosed)
+	clampInt64("max_idle_time_closed", &stats.MaxIdleTimeClosed)
+	clampInt64("max_lifetime_closed", &stats.MaxLifetimeClosed)
+
+	if len(invalid) > 0 {
+		c.invalidMu.Lock()
+		for _, field := range invalid {
+			c.invalid[field]++
+		}
+		c.invalidMu.Unlock()
+	}
+	return stats
+}
+
+// Reasons of sqlmetrics_stats_read_errors_total
+const (
+	statsReadTimeout = "timeout"
+	statsReadPanic   = "panic"
+)
+
+// statsRead is a read of a DB's stats, which may outlive the collection
+// that started it if it takes longer than Options.StatsTimeout
+type statsRead struct {
+	// done is closed once stats and ok are set
+	done  chan struct{}
+	stats sql.DBStats
+	ok    bool
+}
+
+// readStats returns the stats of e, or ok false if reading them panicked
+// or took longer than Options.StatsTimeout. Each DB has at most one read
+// in flight: while one is hung, later collections wait on it rather than
+// start another, so a stuck DB doesn't pile up goroutines.
+func (c *Collector) readStats(e *dbEntry) (stats sql.DBStats, ok bool) {
+	if c.o.StatsTimeout <= 0 {
+		stats, ok = safeStats(e.provider)
+		if !ok {
+			c.statsPanics.Add(1)
+		}
+		return stats, ok
+	}
+
+	e.statsMu.Lock()
+	r := e.statsRead
+	if r != nil {
+		select {
+		case <-r.done:
+			// Finished after its collection gave up on it, so it's stale
+			r = nil
+		default:
+		}
+	}
+	if r == nil {
+		r = &statsRead{done: make(chan struct{})}
+		go func() {
+			r.stats, r.ok = safeStats(e.provider)
+			close(r.done)
+		}()
+		e.statsRead = r
+	}
+	e.statsMu.Unlock()
+
+	timer := time.NewTimer(c.o.StatsTimeout)
+	defer timer.Stop()
+	select {
+	case <-r.done:
+		e.statsMu.Lock()
+		if e.statsRead == r {
+			e.statsRead = nil
+		}
+		e.statsMu.Unlock()
+		if !r.ok {
+			c.statsPanics.Add(1)
+		}
+		return r.stats, r.ok
+	case <-timer.C:
+		c.statsTimeouts.Add(1)
+		return sql.DBStats{}, false
+	}
+}
+
+func safeStats(p StatsProvider) (stats sql.DBStats, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+		}
+	}()
+	return p.Stats(), true
+}
+
+// collectStats emits the pool status gauges and counters for stats
+func (c *Collector) collectStats(cm *constMetrics, m *metrics, stats sql.DBStats) {
+	c.collectGauges(cm, m, stats)
+	c.collectCounters(cm, m, stats)
+}
+
+func (c *Collector) collectGauges(cm *constMetrics, m *metrics, stats sql.DBStats) {
+	if c.o.SemanticConventions {
+		cm.with(ConnectionStateUsed).emit(m.usage, prometheus.GaugeValue, float64(stats.InUse))
+		cm.with(ConnectionStateIdle).emit(m.usage, prometheus.GaugeValue, float64(stats.Idle))
+		return
+	}
+	cm.emit(m.openConns, prometheus.GaugeValue, float64(stats.OpenConnections))
+	cm.emit(m.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	cm.emit(m.idle, prometheus.GaugeValue, float64(stats.Idle))
+}
+
+func (c *Collector) collectCounters(cm *constMetrics, m *metrics, stats sql.DBStats) {
+	counter := func(desc *prometheus.Desc, v float64) {
+		if v == 0 && c.o.SkipZeroCounters {
+			return
+		}
+		cm.emit(desc, prometheus.CounterValue, v)
+	}
+	counter(m.waitCount, float64(stats.WaitCount))
+	counter(m.waitDuration, c.o.Duration(stats.WaitDuration))
+	if c.o.EmitWaitDurationNanoseconds {
+		counter(m.waitDurationNanos, float64(stats.WaitDuration.Nanoseconds()))
 	}
+	counter(m.maxIdleClosed, float64(stats.MaxIdleClosed))
+	counter(m.maxIdleTimeClosed, float64(stats.MaxIdleTimeClosed))
+	counter(m.maxLifetimeClosed, float64(stats.MaxLifetimeClosed))
 }
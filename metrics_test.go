@@ -0,0 +1,1450 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/jacksontj/gosqlmetrics/sqlmetricstest"
+)
+
+// nopConnector is a connector, and its own driver, whose connections
+// always fail to open, for DBs that are only registered and never queried
+type nopConnector struct{}
+
+func (nopConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, errors.New("not connected")
+}
+
+func (nopConnector) Open(string) (driver.Conn, error) {
+	return nil, errors.New("not connected")
+}
+
+func (nopConnector) Driver() driver.Driver { return nopConnector{} }
+
+// openTestDB returns a *sql.DB that is closed when the test ends
+func openTestDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db := sql.OpenDB(nopConnector{})
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// gather collects c once through a pedantic registry, returning the
+// metric families by name
+func gather(t testing.TB, c prometheus.Collector) map[string]*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	return families
+}
+
+// metricValue returns the value of the gauge or counter name with exactly
+// labels in families, and whether there is one
+func metricValue(families map[string]*dto.MetricFamily, name string, labels map[string]string) (float64, bool) {
+	m := findMetric(families, name, labels)
+	switch {
+	case m == nil:
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue(), true
+	case m.Counter != nil:
+		return m.GetCounter().GetValue(), true
+	case m.Untyped != nil:
+		return m.GetUntyped().GetValue(), true
+	}
+	return 0, false
+}
+
+// findMetric returns the series of name with exactly labels in families,
+// or nil if there is none
+func findMetric(families map[string]*dto.MetricFamily, name string, labels map[string]string) *dto.Metric {
+	for _, m := range families[name].GetMetric() {
+		if len(m.GetLabel()) != len(labels) {
+			continue
+		}
+		matches := true
+		for _, lp := range m.GetLabel() {
+			if v, ok := labels[lp.GetName()]; !ok || v != lp.GetValue() {
+				matches = false
+			}
+		}
+		if matches {
+			return m
+		}
+	}
+	return nil
+}
+
+// assertValue fails t unless families has the gauge or counter name with
+// exactly labels and the value want
+func assertValue(t testing.TB, families map[string]*dto.MetricFamily, name string, labels map[string]string, want float64) {
+	t.Helper()
+	got, ok := metricValue(families, name, labels)
+	if !ok {
+		t.Errorf("no %s%v emitted", name, labels)
+	} else if got != want {
+		t.Errorf("%s%v = %g, want %g", name, labels, got, want)
+	}
+}
+
+// assertAbsent fails t if families has name with exactly labels
+func assertAbsent(t testing.TB, families map[string]*dto.MetricFamily, name string, labels map[string]string) {
+	t.Helper()
+	if got, ok := metricValue(families, name, labels); ok {
+		t.Errorf("%s%v = %g emitted, want none", name, labels, got)
+	}
+}
+
+func TestCollectorPedanticRegistry(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	if err := c.RegisterDB(openTestDB(t), []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterDBWithConstLabels(openTestDB(t), []string{"replica"}, prometheus.Labels{"zone": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterDBWithNamespace(openTestDB(t), "readmodel", "db", []string{"readmodel"}); err != nil {
+		t.Fatal(err)
+	}
+	g, err := c.LabelGroup("tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RegisterDB(openTestDB(t), []string{"acme"}); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, c)
+	assertValue(t, families, "connections_open", map[string]string{"db": "main"}, 0)
+	assertValue(t, families, "connections_open", map[string]string{"db": "replica", "zone": "b"}, 0)
+	assertValue(t, families, "readmodel_db_connections_open", map[string]string{"db": "readmodel"}, 0)
+	assertValue(t, families, "connections_open", map[string]string{"tenant": "acme"}, 0)
+}
+
+func TestDescribe(t *testing.T) {
+	describes := func(c *Collector) int {
+		ch := make(chan *prometheus.Desc)
+		go func() {
+			c.Describe(ch)
+			close(ch)
+		}()
+		n := 0
+		for range ch {
+			n++
+		}
+		return n
+	}
+
+	// Without per-DB label sets, the collector is checked
+	c := NewCollector(Options{Labels: []string{"db"}})
+	if err := c.RegisterDB(openTestDB(t), []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	if describes(c) == 0 {
+		t.Fatal("collector without per-DB label sets sent no Descs")
+	}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	var already prometheus.AlreadyRegisteredError
+	if err := reg.Register(c); !errors.As(err, &already) {
+		t.Errorf("registering a checked collector twice: %v, want AlreadyRegisteredError", err)
+	}
+	// It stays checked, so registries can unregister it
+	if _, err := c.LabelGroup("tenant"); err != nil {
+		t.Fatal(err)
+	}
+	if !reg.Unregister(c) {
+		t.Error("unregistering the checked collector failed")
+	}
+
+	for name, register := range map[string]func(c *Collector) error{
+		"RegisterDBWithConstLabels": func(c *Collector) error {
+			return c.RegisterDBWithConstLabels(openTestDB(t), []string{"replica"}, prometheus.Labels{"zone": "b"})
+		},
+		"RegisterDBWithNamespace": func(c *Collector) error {
+			return c.RegisterDBWithNamespace(openTestDB(t), "readmodel", "db", []string{"readmodel"})
+		},
+		"LabelGroup": func(c *Collector) error {
+			_, err := c.LabelGroup("tenant")
+			return err
+		},
+	} {
+		c := NewCollector(Options{Labels: []string{"db"}})
+		if err := register(c); err != nil {
+			t.Fatal(err)
+		}
+		if n := describes(c); n != 0 {
+			t.Errorf("collector with %s sent %d Descs, want none", name, n)
+		}
+	}
+}
+
+func TestFleetTotals(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db", "region"}, EmitFleetTotals: true})
+	for _, db := range []struct {
+		values []string
+		stats  sql.DBStats
+	}{
+		{[]string{"a", "eu"}, sql.DBStats{MaxOpenConnections: 10, OpenConnections: 5, InUse: 3, Idle: 2, WaitCount: 4, MaxIdleClosed: 1}},
+		{[]string{"b", "us"}, sql.DBStats{MaxOpenConnections: 20, OpenConnections: 7, InUse: 1, Idle: 6, WaitCount: 6, MaxLifetimeClosed: 2}},
+	} {
+		if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(db.stats), db.values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The DBs of LabelGroups aren't part of the fleet
+	g, err := c.LabelGroup("tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RegisterProvider(sqlmetricstest.NewFakeProvider(sql.DBStats{OpenConnections: 100, InUse: 100}), []string{"acme"}); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, c)
+	total := map[string]string{"db": FleetTotalLabelValue, "region": FleetTotalLabelValue}
+	for name, want := range map[string]float64{
+		"connections_open":                      12,
+		"connections_in_use":                    4,
+		"connections_idle":                      8,
+		"connections_wait_count_total":          10,
+		"connections_max_idle_closed_total":     1,
+		"connections_max_lifetime_closed_total": 2,
+	} {
+		assertValue(t, families, name, total, want)
+	}
+	assertValue(t, families, "connections_open", map[string]string{"db": "a", "region": "eu"}, 5)
+}
+
+func TestFleetTotalsReservedLabelValue(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, EmitFleetTotals: true})
+	if err := c.RegisterDB(openTestDB(t), []string{FleetTotalLabelValue}); err == nil {
+		t.Error("registering a DB with the fleet total label value succeeded")
+	}
+	db := openTestDB(t)
+	if err := c.RegisterDB(db, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateLabels(db, []string{FleetTotalLabelValue}); err == nil {
+		t.Error("relabeling a DB with the fleet total label value succeeded")
+	}
+}
+
+func TestRegisterDBWithDriverName(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db", DriverLabel}})
+	if err := c.RegisterDBWithDriverName(openTestDB(t), "postgres", []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterDBWithDriverName(openTestDB(t), "mysql", []string{"legacy"}); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, c)
+	assertValue(t, families, "connections_open", map[string]string{"db": "main", DriverLabel: "postgres"}, 0)
+	assertValue(t, families, "connections_open", map[string]string{"db": "legacy", DriverLabel: "mysql"}, 0)
+}
+
+func TestRegisterDBWithDriverNameErrors(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	if err := c.RegisterDBWithDriverName(openTestDB(t), "postgres", nil); err == nil {
+		t.Error("registering without the driver label in Options.Labels succeeded")
+	}
+
+	c = NewCollector(Options{Labels: []string{"db", DriverLabel}})
+	if err := c.RegisterDBWithDriverName(openTestDB(t), "postgres", []string{"main", "extra"}); err == nil {
+		t.Error("registering with too many label values succeeded")
+	}
+}
+
+// fakeClock is a settable clock for Collector.now
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(c *Collector) *fakeClock {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c.now = clock.Now
+	return clock
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestWarmupDelay(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, WarmupDelay: time.Minute})
+	clock := newFakeClock(c)
+	p := sqlmetricstest.NewFakeProvider(sql.DBStats{OpenConnections: 3, WaitCount: 2})
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"db": "main"}
+
+	families := gather(t, c)
+	assertAbsent(t, families, "connections_open", labels)
+	assertAbsent(t, families, "connections_wait_count_total", labels)
+
+	clock.Advance(59 * time.Second)
+	assertAbsent(t, gather(t, c), "connections_open", labels)
+
+	clock.Advance(time.Second)
+	families = gather(t, c)
+	assertValue(t, families, "connections_open", labels, 3)
+	assertValue(t, families, "connections_wait_count_total", labels, 2)
+}
+
+func TestRelabelAll(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db", "region"}})
+	for _, db := range []string{"a", "b"} {
+		if err := c.RegisterDB(openTestDB(t), []string{db, "eu-west"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := c.RelabelAll(func(old []string) []string {
+		return []string{old[0], "europe-west"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := gather(t, c)
+	for _, db := range []string{"a", "b"} {
+		assertValue(t, families, "connections_open", map[string]string{"db": db, "region": "europe-west"}, 0)
+		assertAbsent(t, families, "connections_open", map[string]string{"db": db, "region": "eu-west"})
+	}
+}
+
+func TestRelabelAllRollback(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db", "region"}})
+	for _, db := range []string{"a", "b"} {
+		if err := c.RegisterDB(openTestDB(t), []string{db, "eu-west"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only b's new values are invalid, so neither DB may be relabeled
+	err := c.RelabelAll(func(old []string) []string {
+		if old[0] == "b" {
+			return []string{old[0]}
+		}
+		return []string{old[0], "europe-west"}
+	})
+	if err == nil {
+		t.Fatal("RelabelAll with invalid label values succeeded")
+	}
+	families := gather(t, c)
+	for _, db := range []string{"a", "b"} {
+		assertValue(t, families, "connections_open", map[string]string{"db": db, "region": "eu-west"}, 0)
+	}
+}
+
+func TestFrozen(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, FrozenThreshold: 3})
+	busy := sql.DBStats{OpenConnections: 2, InUse: 2}
+	p := sqlmetricstest.NewFakeProvider(busy, busy, busy, busy, sql.DBStats{OpenConnections: 2, InUse: 1})
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"db": "main"}
+
+	for i, want := range []float64{0, 0, 1, 1, 0} {
+		if got, _ := metricValue(gather(t, c), "connections_frozen", labels); got != want {
+			t.Errorf("collection %d: connections_frozen = %g, want %g", i+1, got, want)
+		}
+	}
+}
+
+func TestFrozenIdlePool(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, FrozenThreshold: 2})
+	if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(sql.DBStats{OpenConnections: 2, Idle: 2}), []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	// Identical stats of a pool without connections in use are just idle
+	for i := 0; i < 3; i++ {
+		assertValue(t, gather(t, c), "connections_frozen", map[string]string{"db": "main"}, 0)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		o    Options
+	}{
+		{"reserved label", Options{Labels: []string{"__db"}}},
+		{"duplicate label", Options{Labels: []string{"db", "db"}}},
+		{"const label in labels", Options{Labels: []string{"db"}, ConstLabels: prometheus.Labels{"db": "main"}}},
+		{"per-metric const label in labels", Options{
+			Labels:               []string{"db"},
+			PerMetricConstLabels: map[string]prometheus.Labels{"connections_open": {"db": "main"}},
+		}},
+		{"state label of connections_usage in labels", Options{Labels: []string{"db", StateLabel}, SemanticConventions: true}},
+	} {
+		if err := tc.o.Validate(); err == nil {
+			t.Errorf("%s: Validate succeeded", tc.name)
+		}
+	}
+	if err := (Options{Labels: []string{"db"}, ConstLabels: prometheus.Labels{"service": "api"}}).Validate(); err != nil {
+		t.Errorf("Validate of valid labels: %v", err)
+	}
+	// Metrics that aren't enabled can't clash
+	if err := (Options{Labels: []string{"db", StateLabel}}).Validate(); err != nil {
+		t.Errorf("Validate of the state label without connections_usage: %v", err)
+	}
+}
+
+func TestPerMetricConstLabels(t *testing.T) {
+	c := NewCollector(Options{
+		Labels:      []string{"db"},
+		ConstLabels: prometheus.Labels{"service": "api"},
+		PerMetricConstLabels: map[string]prometheus.Labels{
+			"connections_wait_duration_seconds_total": {"unit": "seconds"},
+		},
+	})
+	if err := c.RegisterDB(openTestDB(t), []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, c)
+	assertValue(t, families, "connections_wait_duration_seconds_total", map[string]string{"db": "main", "service": "api", "unit": "seconds"}, 0)
+	assertValue(t, families, "connections_wait_count_total", map[string]string{"db": "main", "service": "api"}, 0)
+	assertValue(t, families, "connections_open", map[string]string{"db": "main", "service": "api"}, 0)
+}
+
+func TestPerMetricConstLabelsCollision(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewCollector with a per-metric const label in Labels didn't panic")
+		}
+	}()
+	NewCollector(Options{
+		Labels:               []string{"db"},
+		PerMetricConstLabels: map[string]prometheus.Labels{"connections_open": {"db": "main"}},
+	})
+}
+
+// slowProvider is a StatsProvider whose reads take a second of the fake
+// clock, recording the order DBs were read in
+type slowProvider struct {
+	name  string
+	clock *fakeClock
+	read  *[]string
+}
+
+func (p *slowProvider) Stats() sql.DBStats {
+	*p.read = append(*p.read, p.name)
+	p.clock.Advance(time.Second)
+	return sql.DBStats{OpenConnections: 1}
+}
+
+func TestRegisterDBPrioritizedOrder(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	for _, db := range []struct {
+		name     string
+		priority int
+	}{{"low", -1}, {"default", 0}, {"critical", 10}, {"high", 5}} {
+		if err := c.RegisterDBPrioritized(openTestDB(t), db.priority, []string{db.name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.RegisterDB(openTestDB(t), []string{"later"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	for _, s := range c.Snapshot() {
+		order = append(order, s.Labels["db"])
+	}
+	want := []string{"critical", "high", "default", "later", "low"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("collection order = %q, want %q", order, want)
+	}
+}
+
+func TestCollectDeadlineDropsLowPriority(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, CollectDeadline: 2500 * time.Millisecond})
+	clock := newFakeClock(c)
+	var read []string
+	for _, db := range []struct {
+		name     string
+		priority int
+	}{{"low", 0}, {"critical", 3}, {"medium", 1}, {"high", 2}} {
+		p := &slowProvider{name: db.name, clock: clock, read: &read}
+		e := &dbEntry{labelValues: []string{db.name}, priority: db.priority}
+		if err := c.register(p, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each read takes a second, so the deadline passes after the third
+	families := gather(t, c)
+	if want := []string{"critical", "high", "medium"}; !reflect.DeepEqual(read, want) {
+		t.Errorf("read %q, want %q", read, want)
+	}
+	for _, db := range []string{"critical", "high", "medium"} {
+		assertValue(t, families, "connections_open", map[string]string{"db": db}, 1)
+	}
+	assertAbsent(t, families, "connections_open", map[string]string{"db": "low"})
+	assertValue(t, families, "sqlmetrics_dropped_dbs_total", nil, 1)
+}
+
+func TestWaitDurationNanoseconds(t *testing.T) {
+	wait := 1234567891 * time.Nanosecond
+	newCollector := func(o Options) *Collector {
+		c := NewCollector(o)
+		if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(sql.DBStats{WaitCount: 3, WaitDuration: wait}), []string{"main"}); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	labels := map[string]string{"db": "main"}
+
+	families := gather(t, newCollector(Options{Labels: []string{"db"}, EmitWaitDurationNanoseconds: true}))
+	assertValue(t, families, "connections_wait_duration_nanoseconds_total", labels, float64(wait.Nanoseconds()))
+	assertValue(t, families, "connections_wait_duration_seconds_total", labels, wait.Seconds())
+
+	families = gather(t, newCollector(Options{Labels: []string{"db"}}))
+	assertAbsent(t, families, "connections_wait_duration_nanoseconds_total", labels)
+}
+
+func TestIdleRatioAvg(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, IdleRatioWindow: 3})
+	p := sqlmetricstest.NewFakeProvider(
+		sql.DBStats{},
+		sql.DBStats{OpenConnections: 4, Idle: 2},
+		sql.DBStats{},
+		sql.DBStats{OpenConnections: 4, Idle: 4},
+		sql.DBStats{OpenConnections: 2, InUse: 2},
+	)
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"db": "main"}
+
+	// Without any open connections there is no ratio to average
+	assertAbsent(t, gather(t, c), "connections_idle_ratio_avg", labels)
+	// Collections without open connections are left out of the average,
+	// including once the window is full
+	for i, want := range []float64{0.5, 0.5, 0.75, 0.5} {
+		if got, ok := metricValue(gather(t, c), "connections_idle_ratio_avg", labels); !ok || got != want {
+			t.Errorf("collection %d: connections_idle_ratio_avg = %g, %v, want %g", i+2, got, ok, want)
+		}
+	}
+}
+
+func TestRecentWaitMax(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, RecentWaitWindow: 2})
+	p := sqlmetricstest.NewFakeProvider(
+		sql.DBStats{},
+		sql.DBStats{WaitCount: 2, WaitDuration: 2 * time.Second},
+		sql.DBStats{WaitCount: 3, WaitDuration: 5 * time.Second},
+		sql.DBStats{WaitCount: 3, WaitDuration: 5 * time.Second},
+		sql.DBStats{WaitCount: 4, WaitDuration: 5500 * time.Millisecond},
+	)
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"db": "main"}
+
+	// The first collection has no interval before it
+	assertAbsent(t, gather(t, c), "connections_wait_duration_recent_max_seconds", labels)
+	// The interval averages are 1s, 3s, 0 (no waits) and 0.5s, and the
+	// oldest falls out of the window of 2
+	for i, want := range []float64{1, 3, 3, 0.5} {
+		if got, ok := metricValue(gather(t, c), "connections_wait_duration_recent_max_seconds", labels); !ok || got != want {
+			t.Errorf("collection %d: connections_wait_duration_recent_max_seconds = %g, %v, want %g", i+2, got, ok, want)
+		}
+	}
+}
+
+func TestRegisterDBStatsFunc(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, StatsTimeout: 100 * time.Millisecond})
+	var calls int
+	if err := c.RegisterDBStatsFunc(func() sql.DBStats {
+		calls++
+		return sql.DBStats{OpenConnections: calls, WaitCount: int64(2 * calls)}
+	}, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterDBStatsFunc(func() sql.DBStats {
+		panic("stats")
+	}, []string{"panics"}); err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	release := sync.OnceFunc(func() { close(block) })
+	t.Cleanup(release)
+	var hangs atomic.Int64
+	if err := c.RegisterDBStatsFunc(func() sql.DBStats {
+		hangs.Add(1)
+		<-block
+		return sql.DBStats{}
+	}, []string{"hangs"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		families := gather(t, c)
+		assertValue(t, families, "connections_open", map[string]string{"db": "main"}, float64(i))
+		assertValue(t, families, "connections_wait_count_total", map[string]string{"db": "main"}, float64(2*i))
+		// DBs whose stats func panics or outlasts StatsTimeout are left
+		// out of the collection
+		assertAbsent(t, families, "connections_open", map[string]string{"db": "panics"})
+		assertAbsent(t, families, "connections_open", map[string]string{"db": "hangs"})
+		assertValue(t, families, "sqlmetrics_stats_read_errors_total", map[string]string{"reason": "panic"}, float64(i))
+		assertValue(t, families, "sqlmetrics_stats_read_errors_total", map[string]string{"reason": "timeout"}, float64(i))
+	}
+	// The collections waited on the hung read rather than start their own
+	if n := hangs.Load(); n != 1 {
+		t.Errorf("the hung stats func was called %d times, want 1", n)
+	}
+
+	release()
+	assertValue(t, gather(t, c), "connections_open", map[string]string{"db": "hangs"}, 0)
+}
+
+func TestSwapsTotal(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	labels := map[string]string{"db": "tenant"}
+	if err := c.RegisterNamed("tenant", openTestDB(t), labels); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterDB(openTestDB(t), []string{"unnamed"}); err != nil {
+		t.Fatal(err)
+	}
+	families := gather(t, c)
+	assertValue(t, families, "connections_swaps_total", labels, 0)
+	assertAbsent(t, families, "connections_swaps_total", map[string]string{"db": "unnamed"})
+
+	for i := 1; i <= 3; i++ {
+		if _, err := c.ReplaceNamed("tenant", openTestDB(t), labels); err != nil {
+			t.Fatal(err)
+		}
+		assertValue(t, gather(t, c), "connections_swaps_total", labels, float64(i))
+	}
+	// Replacing a DB with itself isn't a swap
+	db, _ := c.NamedDB("tenant")
+	if _, err := c.ReplaceNamed("tenant", db, labels); err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, gather(t, c), "connections_swaps_total", labels, 3)
+}
+
+func TestReplaceNamedSameDB(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	clock := newFakeClock(c)
+	db := openTestDB(t)
+	if err := c.RegisterNamed("tenant", db, map[string]string{"db": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	registered := c.Registered()[0].Registered
+
+	clock.Advance(time.Minute)
+	old, err := c.ReplaceNamed("tenant", db, map[string]string{"db": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != nil {
+		t.Error("replacing a DB with itself returned it to be closed")
+	}
+	got := c.Registered()
+	if len(got) != 1 || got[0].Labels["db"] != "b" {
+		t.Fatalf("Registered = %+v, want the DB relabeled b", got)
+	}
+	if !got[0].Registered.Equal(registered) {
+		t.Errorf("DB registered at %v after replacing it with itself, want %v", got[0].Registered, registered)
+	}
+	assertValue(t, gather(t, c), "sqlmetrics_label_updates_total", nil, 1)
+}
+
+func TestCounterRefreshInterval(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, CounterRefreshInterval: 3})
+	p := sqlmetricstest.NewFakeProvider()
+	for i := 1; i <= 7; i++ {
+		p.Append(sql.DBStats{OpenConnections: i, WaitCount: int64(10 * i)})
+	}
+	// A counter read lower than before is never emitted
+	p.Append(sql.DBStats{OpenConnections: 8, WaitCount: 5})
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"db": "main"}
+
+	// Counters are read on collections 1, 4 and 7; gauges on every one
+	for i, want := range []float64{10, 10, 10, 40, 40, 40, 70, 70} {
+		families := gather(t, c)
+		assertValue(t, families, "connections_open", labels, float64(i+1))
+		assertValue(t, families, "connections_wait_count_total", labels, want)
+	}
+}
+
+func TestSetDerivedMetrics(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, EmitUtilization: true})
+	with, without := openTestDB(t), openTestDB(t)
+	with.SetMaxOpenConns(5)
+	without.SetMaxOpenConns(5)
+	if err := c.RegisterDB(with, []string{"with"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterDB(without, []string{"without"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDerivedMetrics(without, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDerivedMetrics(openTestDB(t), false); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("SetDerivedMetrics of an unregistered DB = %v, want ErrNotRegistered", err)
+	}
+
+	families := gather(t, c)
+	for _, name := range []string{"connections_utilization_ratio", "connections_saturation"} {
+		assertValue(t, families, name, map[string]string{"db": "with"}, 0)
+		assertAbsent(t, families, name, map[string]string{"db": "without"})
+	}
+	// The stats themselves are emitted either way
+	assertValue(t, families, "connections_max", map[string]string{"db": "without"}, 5)
+
+	if err := c.SetDerivedMetrics(without, true); err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, gather(t, c), "connections_utilization_ratio", map[string]string{"db": "without"}, 0)
+}
+
+func TestMaxConcurrentStats(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, CollectConcurrency: 4})
+	if err := c.RegisterDB(openTestDB(t), []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, gather(t, c), "sqlmetrics_max_concurrent_stats", nil, 4)
+
+	// Serial collections have no limit to report
+	assertAbsent(t, gather(t, NewCollector(Options{})), "sqlmetrics_max_concurrent_stats", nil)
+}
+
+func TestEmitMetricInfo(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, EmitMetricInfo: true})
+	families := gather(t, c)
+	assertValue(t, families, "metric_info", map[string]string{
+		"metric": "connections_open",
+		"type":   "gauge",
+		"unit":   "connections",
+		"help":   "The number of established connections, both in use and idle",
+	}, 1)
+	assertValue(t, families, "metric_info", map[string]string{
+		"metric": "connections_wait_duration_seconds_total",
+		"type":   "counter",
+		"unit":   "seconds",
+		"help":   "The total time blocked waiting for a new connection in seconds",
+	}, 1)
+	// Optional metrics that aren't enabled aren't described
+	for _, m := range families["metric_info"].GetMetric() {
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() == "metric" && lp.GetValue() == "connections_idle_ratio_avg" {
+				t.Error("metric_info describes connections_idle_ratio_avg without IdleRatioWindow")
+			}
+		}
+	}
+
+	assertAbsent(t, gather(t, NewCollector(Options{Labels: []string{"db"}})), "metric_info", map[string]string{
+		"metric": "connections_open",
+		"type":   "gauge",
+		"unit":   "connections",
+		"help":   "The number of established connections, both in use and idle",
+	})
+}
+
+func TestInvalidStats(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	p := sqlmetricstest.NewFakeProvider(sql.DBStats{
+		OpenConnections: 3,
+		InUse:           5,
+		Idle:            -1,
+		WaitCount:       -2,
+		WaitDuration:    -time.Second,
+	})
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"db": "main"}
+
+	for i := 1; i <= 2; i++ {
+		families := gather(t, c)
+		assertValue(t, families, "connections_open", labels, 3)
+		assertValue(t, families, "connections_in_use", labels, 3)
+		assertValue(t, families, "connections_idle", labels, 0)
+		assertValue(t, families, "connections_wait_count_total", labels, 0)
+		assertValue(t, families, "connections_wait_duration_seconds_total", labels, 0)
+		for _, field := range []string{"in_use", "idle", "wait_count", "wait_duration"} {
+			assertValue(t, families, "sqlmetrics_invalid_stats_total", map[string]string{"field": field}, float64(i))
+		}
+		assertAbsent(t, families, "sqlmetrics_invalid_stats_total", map[string]string{"field": "open_connections"})
+	}
+}
+
+func TestUnhealthyDBs(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	for name, stats := range map[string]sql.DBStats{
+		"unlimited": {OpenConnections: 50, InUse: 50},
+		"headroom":  {MaxOpenConnections: 10, OpenConnections: 9, InUse: 9},
+		"saturated": {MaxOpenConnections: 10, OpenConnections: 10, InUse: 10},
+		"overfull":  {MaxOpenConnections: 2, OpenConnections: 3, InUse: 3},
+	} {
+		if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(stats), []string{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertValue(t, gather(t, c), "sqlmetrics_unhealthy_dbs", nil, 2)
+
+	assertValue(t, gather(t, NewCollector(Options{})), "sqlmetrics_unhealthy_dbs", nil, 0)
+}
+
+func TestRegisterDBWithStateLabel(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db", StateLabel}})
+	db := openTestDB(t)
+	state := func(stats sql.DBStats) string {
+		if stats.MaxOpenConnections > 0 {
+			return "limited"
+		}
+		return "unlimited"
+	}
+	if err := c.RegisterDBWithStateLabel(db, state, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	unlimited := map[string]string{"db": "main", StateLabel: "unlimited"}
+	limited := map[string]string{"db": "main", StateLabel: "limited"}
+
+	families := gather(t, c)
+	assertValue(t, families, "connections_max", unlimited, 0)
+	assertAbsent(t, families, "connections_max", limited)
+
+	db.SetMaxOpenConns(3)
+	families = gather(t, c)
+	assertValue(t, families, "connections_max", limited, 3)
+	assertAbsent(t, families, "connections_max", unlimited)
+
+	if err := NewCollector(Options{Labels: []string{"db"}}).RegisterDBWithStateLabel(openTestDB(t), state, []string{"main"}); err == nil {
+		t.Error("registering without the state label in Options.Labels succeeded")
+	}
+}
+
+func TestStateLabelFleetTotal(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db", StateLabel}, EmitFleetTotals: true})
+	reserved := func(sql.DBStats) string { return FleetTotalLabelValue }
+	if err := c.RegisterDBWithStateLabel(openTestDB(t), reserved, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, c)
+	assertValue(t, families, "connections_open", map[string]string{"db": "main", StateLabel: InvalidStateLabelValue}, 0)
+	assertAbsent(t, families, "connections_open", map[string]string{"db": "main", StateLabel: FleetTotalLabelValue})
+	assertValue(t, families, "sqlmetrics_invalid_stats_total", map[string]string{"field": "state"}, 1)
+}
+
+// sleepProvider is a StatsProvider whose stats take d to read
+type sleepProvider struct {
+	d time.Duration
+}
+
+func (p *sleepProvider) Stats() sql.DBStats {
+	time.Sleep(p.d)
+	return sql.DBStats{}
+}
+
+func TestStatsReadDuration(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, EmitStatsReadDuration: true})
+	if err := c.RegisterProvider(&sleepProvider{20 * time.Millisecond}, []string{"slow"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(), []string{"fast"}); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, c)
+	slow, ok := metricValue(families, "connections_stats_read_duration_seconds", map[string]string{"db": "slow"})
+	if !ok || slow < 0.02 {
+		t.Errorf("connections_stats_read_duration_seconds of the slow DB = %g, %v, want at least 0.02", slow, ok)
+	}
+	if fast, ok := metricValue(families, "connections_stats_read_duration_seconds", map[string]string{"db": "fast"}); !ok || fast >= slow {
+		t.Errorf("connections_stats_read_duration_seconds of the fast DB = %g, %v, want less than %g", fast, ok, slow)
+	}
+
+	c = NewCollector(Options{Labels: []string{"db"}})
+	if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(), []string{"fast"}); err != nil {
+		t.Fatal(err)
+	}
+	assertAbsent(t, gather(t, c), "connections_stats_read_duration_seconds", map[string]string{"db": "fast"})
+}
+
+func TestAutoAggregateDuplicateLabels(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, AutoAggregateDuplicateLabels: true, FrozenThreshold: 2})
+	for _, stats := range []sql.DBStats{
+		{MaxOpenConnections: 10, OpenConnections: 4, InUse: 1, Idle: 3, WaitCount: 2},
+		{MaxOpenConnections: 5, OpenConnections: 2, InUse: 2, WaitCount: 3},
+	} {
+		if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(stats), []string{"shard"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(sql.DBStats{OpenConnections: 1}), []string{"unique"}); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, c)
+	shard := map[string]string{"db": "shard"}
+	if n := len(families["connections_open"].GetMetric()); n != 2 {
+		t.Errorf("%d connections_open series, want 2", n)
+	}
+	assertValue(t, families, "connections_max", shard, 15)
+	assertValue(t, families, "connections_open", shard, 6)
+	assertValue(t, families, "connections_in_use", shard, 3)
+	assertValue(t, families, "connections_idle", shard, 3)
+	assertValue(t, families, "connections_wait_count_total", shard, 5)
+	assertValue(t, families, "connections_open", map[string]string{"db": "unique"}, 1)
+	// Metrics of a DB's own history are left out of aggregates
+	assertAbsent(t, families, "connections_frozen", shard)
+	assertValue(t, families, "connections_frozen", map[string]string{"db": "unique"}, 0)
+}
+
+func TestLabelUpdatesTotal(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	db := openTestDB(t)
+	if err := c.RegisterDB(db, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterDB(openTestDB(t), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	role := "primary"
+	if err := c.RegisterDBWithLabelFunc(openTestDB(t), func() []string { return []string{role} }); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterNamed("tenant", openTestDB(t), map[string]string{"db": "tenant"}); err != nil {
+		t.Fatal(err)
+	}
+	updates := func() float64 {
+		t.Helper()
+		v, _ := metricValue(gather(t, c), "sqlmetrics_label_updates_total", nil)
+		return v
+	}
+	if got := updates(); got != 0 {
+		t.Fatalf("sqlmetrics_label_updates_total = %g before any updates", got)
+	}
+
+	for _, step := range []struct {
+		name   string
+		update func() error
+		want   float64
+	}{
+		{"UpdateLabels", func() error { return c.UpdateLabels(db, []string{"a2"}) }, 1},
+		{"UpdateLabels without a change", func() error { return c.UpdateLabels(db, []string{"a2"}) }, 1},
+		// Only the three DBs whose labels change count
+		{"RelabelAll", func() error {
+			return c.RelabelAll(func(old []string) []string {
+				if old[0] == "primary" {
+					return old
+				}
+				return []string{old[0] + "-eu"}
+			})
+		}, 4},
+		{"label func", func() error { role = "replica"; return nil }, 5},
+		{"ReplaceNamed", func() error {
+			_, err := c.ReplaceNamed("tenant", openTestDB(t), map[string]string{"db": "tenant2"})
+			return err
+		}, 6},
+	} {
+		if err := step.update(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := updates(); got != step.want {
+			t.Errorf("%s: sqlmetrics_label_updates_total = %g, want %g", step.name, got, step.want)
+		}
+	}
+}
+
+func TestDurationUnitHelp(t *testing.T) {
+	for _, tc := range []struct {
+		unit     DurationUnit
+		wait     string
+		lifetime string
+	}{
+		{Seconds, "connections_wait_duration_seconds_total", "connections_max_lifetime_seconds"},
+		{Milliseconds, "connections_wait_duration_milliseconds_total", "connections_max_lifetime_milliseconds"},
+	} {
+		c := NewCollector(Options{Labels: []string{"db"}, DurationUnit: tc.unit})
+		if err := c.RegisterDBWithPoolConfig(openTestDB(t), PoolConfig{ConnMaxLifetime: time.Minute}, []string{"main"}); err != nil {
+			t.Fatal(err)
+		}
+		families := gather(t, c)
+		for _, name := range []string{tc.wait, tc.lifetime} {
+			help := families[name].GetHelp()
+			if !strings.Contains(help, " in "+tc.unit.String()) {
+				t.Errorf("%s: help %q doesn't name the unit %s", name, help, tc.unit)
+			}
+		}
+		// Help text that names no unit is unchanged
+		if help := families["connections_open"].GetHelp(); help != "The number of established connections, both in use and idle" {
+			t.Errorf("connections_open: help %q", help)
+		}
+	}
+}
+
+func TestCountersOnFirstScrape(t *testing.T) {
+	labels := map[string]string{"db": "main"}
+	active := sql.DBStats{OpenConnections: 2, InUse: 1, Idle: 1, WaitCount: 2}
+	for _, tc := range []struct {
+		name string
+		o    Options
+		// gauges is whether connections_open is on the first scrape
+		gauges bool
+		// zero is whether the zero connections_max_idle_closed_total is
+		zero bool
+	}{
+		{"default", Options{}, true, true},
+		{"warmup", Options{WarmupDelay: time.Minute, WarmupEmitCounters: true}, false, true},
+		{"skip zero counters", Options{SkipZeroCounters: true}, true, false},
+		{"warmup skipping zero counters", Options{WarmupDelay: time.Minute, WarmupEmitCounters: true, SkipZeroCounters: true}, false, false},
+	} {
+		tc.o.Labels = []string{"db"}
+		c := NewCollector(tc.o)
+		if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(active), []string{"main"}); err != nil {
+			t.Fatal(err)
+		}
+		families := gather(t, c)
+		// Counters that have counted are always on the first scrape
+		if got, ok := metricValue(families, "connections_wait_count_total", labels); !ok || got != 2 {
+			t.Errorf("%s: connections_wait_count_total = %g, %v, want 2", tc.name, got, ok)
+		}
+		if _, ok := metricValue(families, "connections_max_idle_closed_total", labels); ok != tc.zero {
+			t.Errorf("%s: connections_max_idle_closed_total emitted: %v, want %v", tc.name, ok, tc.zero)
+		}
+		if _, ok := metricValue(families, "connections_open", labels); ok != tc.gauges {
+			t.Errorf("%s: connections_open emitted: %v, want %v", tc.name, ok, tc.gauges)
+		}
+	}
+}
+
+func TestMetricTypes(t *testing.T) {
+	c := NewCollector(Options{
+		Labels:                      []string{"db"},
+		EmitWaitDurationNanoseconds: true,
+		IdleRatioWindow:             2,
+		RecentWaitWindow:            2,
+		EmitUtilization:             true,
+		WaitDurationBuckets:         []float64{0.1, 1},
+		FrozenThreshold:             2,
+		EmitStatsReadDuration:       true,
+		SampleInterval:              time.Hour,
+		DatabaseInfo:                true,
+		EmitStartTime:               true,
+		EmitMetricInfo:              true,
+		CollectDeadline:             time.Hour,
+		CollectConcurrency:          2,
+		UtilizationBands:            DefaultUtilizationBands,
+	})
+	if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(sql.DBStats{MaxOpenConnections: 4, OpenConnections: 2, InUse: 3}), []string{"provider"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterNamed("named", openTestDB(t), map[string]string{"db": "named"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetPoolConfig(mustNamedDB(t, c, "named"), PoolConfig{MaxIdleConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	c.HealthCheck("named")(context.Background())
+	gather(t, c)
+	families := gather(t, c)
+
+	histogram := dto.MetricType_HISTOGRAM
+	gauge := dto.MetricType_GAUGE
+	counter := dto.MetricType_COUNTER
+	want := map[string]dto.MetricType{
+		"connections_max":                                gauge,
+		"connections_open":                               gauge,
+		"connections_in_use":                             gauge,
+		"connections_idle":                               gauge,
+		"connections_wait_count_total":                   counter,
+		"connections_wait_duration_seconds_total":        counter,
+		"connections_wait_duration_nanoseconds_total":    counter,
+		"connections_max_idle_closed_total":              counter,
+		"connections_max_idle_time_closed_total":         counter,
+		"connections_max_lifetime_closed_total":          counter,
+		"connections_max_idle":                           gauge,
+		"connections_max_lifetime_seconds":               gauge,
+		"connections_max_idle_time_seconds":              gauge,
+		"connections_idle_ratio_avg":                     gauge,
+		"connections_wait_duration_recent_max_seconds":   gauge,
+		"connections_utilization_ratio":                  gauge,
+		"connections_saturation":                         gauge,
+		"connections_wait_seconds":                       histogram,
+		"connections_in_use_peak":                        gauge,
+		"connections_open_peak":                          gauge,
+		"connections_wait_duration_interval_max_seconds": gauge,
+		"db_up":                  gauge,
+		"ping_duration_seconds":  gauge,
+		"collect_timeouts_total": counter,
+		"connections_frozen":     gauge,
+		"connections_stats_read_duration_seconds": gauge,
+		"connections_swaps_total":                 counter,
+		"metric_info":                             gauge,
+		"sqlmetrics_invalid_stats_total":          counter,
+		"sqlmetrics_unhealthy_dbs":                gauge,
+		"sqlmetrics_label_updates_total":          counter,
+		"sqlmetrics_start_time_seconds":           gauge,
+		"sqlmetrics_dropped_dbs_total":            counter,
+		"sqlmetrics_stats_read_errors_total":      counter,
+		"sqlmetrics_dbs_by_utilization":           gauge,
+		"sqlmetrics_max_concurrent_stats":         gauge,
+	}
+	for name, typ := range want {
+		if mf, ok := families[name]; !ok {
+			t.Errorf("%s wasn't emitted", name)
+		} else if mf.GetType() != typ {
+			t.Errorf("%s is a %v, want a %v", name, mf.GetType(), typ)
+		}
+	}
+	// New metrics need their type added above
+	for name, mf := range families {
+		if _, ok := want[name]; !ok {
+			t.Errorf("%s, a %v, has no expected type", name, mf.GetType())
+		}
+	}
+}
+
+// mustNamedDB returns the DB registered under name with c
+func mustNamedDB(t testing.TB, c *Collector, name string) *sql.DB {
+	t.Helper()
+	db, ok := c.NamedDB(name)
+	if !ok {
+		t.Fatalf("no DB named %q", name)
+	}
+	return db
+}
+
+func TestStartTime(t *testing.T) {
+	before := time.Now()
+	c := NewCollector(Options{EmitStartTime: true})
+	after := time.Now()
+
+	time.Sleep(10 * time.Millisecond)
+	got, ok := metricValue(gather(t, c), "sqlmetrics_start_time_seconds", nil)
+	if !ok {
+		t.Fatal("no sqlmetrics_start_time_seconds emitted")
+	}
+	// The float seconds only keep about a microsecond of precision
+	if start := time.Unix(0, int64(got*1e9)); start.Before(before.Add(-time.Millisecond)) || start.After(after.Add(time.Millisecond)) {
+		t.Errorf("sqlmetrics_start_time_seconds = %v, want between %v and %v", start, before, after)
+	}
+
+	assertAbsent(t, gather(t, NewCollector(Options{})), "sqlmetrics_start_time_seconds", nil)
+}
+
+func TestDBsByUtilization(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, UtilizationBands: DefaultUtilizationBands})
+	for name, stats := range map[string]sql.DBStats{
+		"idle":      {MaxOpenConnections: 10},
+		"half":      {MaxOpenConnections: 10, OpenConnections: 5, InUse: 5},
+		"busy":      {MaxOpenConnections: 10, OpenConnections: 7, InUse: 7},
+		"saturated": {MaxOpenConnections: 10, OpenConnections: 10, InUse: 10},
+		// Pools without a limit have no utilization
+		"unlimited": {OpenConnections: 50, InUse: 50},
+	} {
+		if err := c.RegisterProvider(sqlmetricstest.NewFakeProvider(stats), []string{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	families := gather(t, c)
+	for band, want := range map[string]float64{"low": 2, "medium": 1, "high": 1} {
+		assertValue(t, families, "sqlmetrics_dbs_by_utilization", map[string]string{"band": band}, want)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	o := Options{
+		Prefix:           "app_",
+		Labels:           []string{"db", "region"},
+		ConstLabels:      prometheus.Labels{"service": "api"},
+		IdleRatioWindow:  5,
+		WarmupDelay:      time.Minute,
+		DisabledMetrics:  []string{"connections_idle"},
+		UtilizationBands: DefaultUtilizationBands,
+	}
+	b, err := NewCollector(o).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Options
+		Metrics []string
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Config isn't JSON: %v\n%s", err, b)
+	}
+	if !reflect.DeepEqual(got.Options, o) {
+		t.Errorf("Config round-trips to %+v, want %+v", got.Options, o)
+	}
+	metrics := map[string]bool{}
+	for _, name := range got.Metrics {
+		metrics[name] = true
+	}
+	if !metrics["app_connections_open"] || !metrics["app_connections_idle_ratio_avg"] {
+		t.Errorf("Config metrics %q lack enabled metrics", got.Metrics)
+	}
+	if metrics["app_connections_idle"] || metrics["app_connections_utilization_ratio"] {
+		t.Errorf("Config metrics %q have disabled metrics", got.Metrics)
+	}
+
+	// Options that can't be JSON, such as callbacks, are left out
+	o.OnSaturationChange = func([]string, bool) {}
+	if _, err := NewCollector(o).Config(); err != nil {
+		t.Errorf("Config with a callback: %v", err)
+	}
+}
+
+func TestRegisterOnFirstDB(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := NewCollector(Options{Labels: []string{"db"}, RegisterOnFirstDB: reg})
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 0 {
+		t.Errorf("%d metric families before the first DB, want none", len(families))
+	}
+
+	for _, name := range []string{"a", "b"} {
+		if err := c.RegisterDB(openTestDB(t), []string{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	families, err = reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+	assertValue(t, byName, "connections_open", map[string]string{"db": "a"}, 0)
+	assertValue(t, byName, "connections_open", map[string]string{"db": "b"}, 0)
+}
+
+func TestReplaceNamedRegisterSelfFails(t *testing.T) {
+	// The registry already has a collector of the same metrics, so the
+	// collector fails to register itself
+	o := Options{Labels: []string{"db"}}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(o))
+	o.RegisterOnFirstDB = reg
+	c := NewCollector(o)
+
+	if err := c.RegisterNamed("main", openTestDB(t), map[string]string{"db": "main"}); err == nil {
+		t.Fatal("RegisterNamed succeeded though the collector failed to register itself")
+	}
+	if names := c.Names(); len(names) != 0 {
+		t.Errorf("names %v registered after a failed RegisterNamed", names)
+	}
+
+	// A DB registered before the collector registers itself, as a
+	// concurrent registration could, survives a failed replacement
+	old := openTestDB(t)
+	if _, err := c.addNamed("main", old, &dbEntry{labelValues: []string{"main"}, name: "main"}, false); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := c.ReplaceNamed("main", openTestDB(t), map[string]string{"db": "main"})
+	if err == nil || replaced != nil {
+		t.Fatalf("ReplaceNamed = %v, %v, want an error", replaced, err)
+	}
+	if got := mustNamedDB(t, c, "main"); got != old {
+		t.Error("a failed ReplaceNamed replaced the DB")
+	}
+	assertValue(t, gather(t, c), "connections_open", map[string]string{"db": "main"}, 0)
+}
+
+func TestOnSaturationChange(t *testing.T) {
+	type change struct {
+		db        string
+		saturated bool
+	}
+	var changes []change
+	c := NewCollector(Options{
+		Labels:          []string{"db"},
+		SaturationDwell: 10 * time.Second,
+		OnSaturationChange: func(labelValues []string, saturated bool) {
+			changes = append(changes, change{labelValues[0], saturated})
+		},
+	})
+	clock := newFakeClock(c)
+	healthy := sql.DBStats{MaxOpenConnections: 2, OpenConnections: 1, InUse: 1}
+	saturated := sql.DBStats{MaxOpenConnections: 2, OpenConnections: 2, InUse: 2}
+	p := sqlmetricstest.NewFakeProvider(healthy)
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, step := range []struct {
+		stats   sql.DBStats
+		advance time.Duration
+		want    []change
+	}{
+		{healthy, 0, nil},
+		// A blip shorter than the dwell isn't reported
+		{saturated, time.Second, nil},
+		{healthy, time.Second, nil},
+		{saturated, time.Second, nil},
+		{saturated, 5 * time.Second, nil},
+		{saturated, 5 * time.Second, []change{{"main", true}}},
+		{saturated, 5 * time.Second, nil},
+		{healthy, 5 * time.Second, nil},
+		{healthy, 10 * time.Second, []change{{"main", false}}},
+	} {
+		clock.Advance(step.advance)
+		p.Set(step.stats)
+		changes = nil
+		gather(t, c)
+		if !reflect.DeepEqual(changes, step.want) {
+			t.Errorf("collection %d: changes %v, want %v", i+1, changes, step.want)
+		}
+	}
+}
+
+func TestMetricFilter(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		o             Options
+		kept, dropped []string
+	}{
+		{
+			name:    "enabled",
+			o:       Options{EnabledMetrics: []string{"connections_open", "transactions_begun_total"}},
+			kept:    []string{"connections_open", "readmodel_db_connections_open", "transactions_begun_total"},
+			dropped: []string{"connections_idle", "readmodel_db_connections_idle", "transactions_committed_total", "sqlmetrics_unhealthy_dbs"},
+		},
+		{
+			name:    "disabled",
+			o:       Options{DisabledMetrics: []string{"connections_open", "transactions_begun_total", "sqlmetrics_unhealthy_dbs"}},
+			kept:    []string{"connections_idle", "readmodel_db_connections_idle", "transactions_committed_total"},
+			dropped: []string{"connections_open", "readmodel_db_connections_open", "transactions_begun_total", "sqlmetrics_unhealthy_dbs"},
+		},
+		{
+			name:    "renamed",
+			o:       Options{DisabledMetrics: []string{"connections_open"}, MetricNames: map[string]string{"connections_open": "pool_open"}},
+			kept:    []string{"connections_idle"},
+			dropped: []string{"pool_open", "connections_open"},
+		},
+	} {
+		test.o.Labels = []string{"db"}
+		c := NewCollector(test.o)
+		db, err := c.Open(fakeDriverName, "", []string{"main"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if err := c.RegisterDBWithNamespace(openTestDB(t), "readmodel", "db", []string{"readmodel"}); err != nil {
+			t.Fatal(err)
+		}
+
+		families := gather(t, c)
+		for _, name := range test.kept {
+			if _, ok := families[name]; !ok {
+				t.Errorf("%s: %s was filtered out", test.name, name)
+			}
+		}
+		for _, name := range test.dropped {
+			if _, ok := families[name]; ok {
+				t.Errorf("%s: %s wasn't filtered out", test.name, name)
+			}
+		}
+	}
+}
+
+func TestValidateMetricFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		o    Options
+	}{
+		{"misspelled enabled metric", Options{EnabledMetrics: []string{"connections_open", "conections_idle"}}},
+		{"misspelled disabled metric", Options{DisabledMetrics: []string{"connection_open"}}},
+		{"renamed metric", Options{DisabledMetrics: []string{"pool_open"}, MetricNames: map[string]string{"connections_open": "pool_open"}}},
+		{"histogram suffix", Options{DisabledMetrics: []string{"query_duration_seconds_bucket"}}},
+		{"prefixed metric", Options{Prefix: "app_", DisabledMetrics: []string{"app_connections_open"}}},
+	} {
+		if err := tc.o.Validate(); err == nil {
+			t.Errorf("%s: Validate succeeded", tc.name)
+		}
+	}
+	// Metrics of features that aren't enabled can still be named
+	o := Options{
+		EnabledMetrics:  []string{"connections_open", "query_duration_seconds", "slow_queries_total", "circuit_breaker_state", "queries_total", "db_up"},
+		DisabledMetrics: []string{"database_info", "sqlmetrics_unhealthy_dbs", "connections_usage", "metric_info"},
+	}
+	if err := o.Validate(); err != nil {
+		t.Errorf("Validate of known metrics: %v", err)
+	}
+}
+
+func BenchmarkCollect(b *testing.B) {
+	for _, filtered := range []bool{false, true} {
+		for _, n := range []int{1, 10, 100} {
+			b.Run(fmt.Sprintf("dbs=%d/filtered=%t", n, filtered), func(b *testing.B) {
+				o := Options{Labels: []string{"db"}}
+				if filtered {
+					o.DisabledMetrics = []string{"connections_idle", "connections_max_idle_closed_total"}
+				}
+				c := NewCollector(o)
+				for i := 0; i < n; i++ {
+					if err := c.RegisterDB(openTestDB(b), []string{fmt.Sprint(i)}); err != nil {
+						b.Fatal(err)
+					}
+				}
+				ch := make(chan prometheus.Metric, 1024)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for range ch {
+					}
+				}()
+
+				b.ReportAllocs()
+				for b.Loop() {
+					c.Collect(ch)
+				}
+				b.StopTimer()
+				close(ch)
+				<-done
+			})
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Package mysqlmetrics reports server-side MySQL stats, from SHOW GLOBAL
+// STATUS and SHOW GLOBAL VARIABLES, of DBs registered with a
+// sqlmetrics.Collector, with the same metric naming and labels.
+package mysqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// DefaultTimeout is the Options.Timeout used when it is 0
+const DefaultTimeout = 5 * time.Second
+
+// DefaultStatus is the Options.Status used when it is nil
+var DefaultStatus = []string{
+	"Threads_connected",
+	"Threads_running",
+	"Connections",
+	"Aborted_connects",
+	"Questions",
+	"Slow_queries",
+	"Innodb_buffer_pool_pages_total",
+	"Innodb_buffer_pool_pages_free",
+	"Innodb_buffer_pool_pages_dirty",
+	"Innodb_buffer_pool_read_requests",
+	"Innodb_buffer_pool_reads",
+	"Innodb_row_lock_waits",
+}
+
+// DefaultVariables is the Options.Variables used when it is nil
+var DefaultVariables = []string{
+	"max_connections",
+	"innodb_buffer_pool_size",
+}
+
+// Options configures a Collector
+type Options struct {
+	// Status is the allowlist of SHOW GLOBAL STATUS variables to export, as
+	// mysql_global_status_<name>
+	Status []string
+	// Variables is the allowlist of SHOW GLOBAL VARIABLES to export, as
+	// mysql_global_variables_<name>
+	Variables []string
+	// Timeout bounds the queries of each DB during a collection
+	Timeout time.Duration
+}
+
+// Collector emits the server status of registered MySQL DBs, named and
+// labeled per the Options of their sqlmetrics.Collector. Status and
+// variables that aren't numeric, other than ON and OFF, are skipped.
+type Collector struct {
+	o       sqlmetrics.Options
+	timeout time.Duration
+
+	status       map[string]status
+	variables    map[string]*prometheus.Desc
+	scrapeErrors *prometheus.CounterVec
+
+	l   sync.RWMutex
+	dbs map[*sql.DB][]string
+}
+
+// status is an exported SHOW GLOBAL STATUS variable
+type status struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+}
+
+// NewCollector returns a collector for the given options
+func NewCollector(o sqlmetrics.Options, mo Options) *Collector {
+	if mo.Status == nil {
+		mo.Status = DefaultStatus
+	}
+	if mo.Variables == nil {
+		mo.Variables = DefaultVariables
+	}
+	if mo.Timeout <= 0 {
+		mo.Timeout = DefaultTimeout
+	}
+
+	c := &Collector{
+		o:         o,
+		timeout:   mo.Timeout,
+		status:    make(map[string]status, len(mo.Status)),
+		variables: make(map[string]*prometheus.Desc, len(mo.Variables)),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("mysql_scrape_errors_total"),
+			Help:        o.Help("mysql_scrape_errors_total", "The total number of collections that failed to query the server's status"),
+			ConstLabels: o.ConstLabels,
+		}, o.Labels),
+		dbs: make(map[*sql.DB][]string),
+	}
+	for _, name := range mo.Status {
+		valueType := prometheus.CounterValue
+		if gaugeStatus(name) {
+			valueType = prometheus.GaugeValue
+		}
+		c.status[strings.ToLower(name)] = status{
+			desc: prometheus.NewDesc(
+				o.MetricName("mysql_global_status_"+strings.ToLower(name)),
+				o.Help("mysql_global_status_"+strings.ToLower(name), "The "+name+" variable of SHOW GLOBAL STATUS"),
+				o.Labels, o.ConstLabels,
+			),
+			valueType: valueType,
+		}
+	}
+	for _, name := range mo.Variables {
+		c.variables[strings.ToLower(name)] = prometheus.NewDesc(
+			o.MetricName("mysql_global_variables_"+strings.ToLower(name)),
+			o.Help("mysql_global_variables_"+strings.ToLower(name), "The "+name+" variable of SHOW GLOBAL VARIABLES"),
+			o.Labels, o.ConstLabels,
+		)
+	}
+	return c
+}
+
+// gaugeStatus reports whether the status variable name is a current value
+// rather than a total
+func gaugeStatus(name string) bool {
+	name = strings.ToLower(name)
+	for _, prefix := range []string{"threads_", "open_", "innodb_buffer_pool_pages_", "innodb_buffer_pool_bytes_", "max_used_"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Register adds db to the collector with the given label values
+func (c *Collector) Register(db *sql.DB, labelValues []string) error {
+	if len(labelValues) != len(c.o.Labels) {
+		return fmt.Errorf("expected %d label values %v, got %d", len(c.o.Labels), c.o.Labels, len(labelValues))
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if _, ok := c.dbs[db]; ok {
+		return sqlmetrics.ErrAlreadyRegistered
+	}
+	c.dbs[db] = append([]string(nil), labelValues...)
+	return nil
+}
+
+// Unregister removes db from the collector, reporting whether it was
+// registered
+func (c *Collector) Unregister(db *sql.DB) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	_, ok := c.dbs[db]
+	delete(c.dbs, db)
+	return ok
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, s := range c.status {
+		ch <- s.desc
+	}
+	for _, d := range c.variables {
+		ch <- d
+	}
+	c.scrapeErrors.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	for db, labelValues := range c.dbs {
+		if err := c.collectDB(ch, db, labelValues); err != nil {
+			c.scrapeErrors.WithLabelValues(labelValues...).Inc()
+		}
+	}
+	c.scrapeErrors.Collect(ch)
+}
+
+func (c *Collector) collectDB(ch chan<- prometheus.Metric, db *sql.DB, labelValues []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	if len(c.status) > 0 {
+		values, err := show(ctx, db, "SHOW GLOBAL STATUS")
+		if err != nil {
+			return err
+		}
+		for name, s := range c.status {
+			if v, ok := values[name]; ok {
+				ch <- prometheus.MustNewConstMetric(s.desc, s.valueType, v, labelValues...)
+			}
+		}
+	}
+	if len(c.variables) > 0 {
+		values, err := show(ctx, db, "SHOW GLOBAL VARIABLES")
+		if err != nil {
+			return err
+		}
+		for name, d := range c.variables {
+			if v, ok := values[name]; ok {
+				ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labelValues...)
+			}
+		}
+	}
+	return nil
+}
+
+// show runs a SHOW statement of name and value rows, returning the numeric
+// values by lowercased name
+func show(ctx context.Context, db *sql.DB, query string) (map[string]float64, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]float64)
+	for rows.Next() {
+		var name string
+		var raw sql.RawBytes
+		if err := rows.Scan(&name, &raw); err != nil {
+			return nil, err
+		}
+		if v, ok := parseValue(string(raw)); ok {
+			values[strings.ToLower(name)] = v
+		}
+	}
+	return values, rows.Err()
+}
+
+// parseValue parses a numeric status or variable value, and ON and OFF as
+// 1 and 0
+func parseValue(s string) (float64, bool) {
+	switch strings.ToUpper(s) {
+	case "ON", "YES":
+		return 1, true
+	case "OFF", "NO":
+		return 0, true
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
@@ -0,0 +1,142 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// RegisterNamed registers db under name, such as a tenant's name, with its
+// label values given by name as for RegisterDBWithLabels. Code managing
+// many pools can then reconcile the collector against its own state with
+// Names, NamedDB, ReplaceNamed and UnregisterNamed. It returns an error
+// wrapping ErrAlreadyRegistered if name or db is already registered.
+func (c *Collector) RegisterNamed(name string, db *sql.DB, labels map[string]string) error {
+	_, err := c.registerNamed(name, db, labels, false)
+	return err
+}
+
+// ReplaceNamed registers db under name in place of the DB registered under
+// it, if any, which it returns so that it can be closed. Replacing a DB
+// with itself only updates its labels, keeping its registration and
+// history, and returns nil. Series of the replaced DB are no longer
+// emitted from the same collection on, and connections_swaps_total of
+// name counts the replacements. Changed labels count in
+// sqlmetrics_label_updates_total, as those of UpdateLabels do.
+func (c *Collector) ReplaceNamed(name string, db *sql.DB, labels map[string]string) (*sql.DB, error) {
+	return c.registerNamed(name, db, labels, true)
+}
+
+func (c *Collector) registerNamed(name string, db *sql.DB, labels map[string]string, replace bool) (*sql.DB, error) {
+	values, err := c.labelValues(labels)
+	if err != nil {
+		return nil, err
+	}
+	e := &dbEntry{labelValues: values, name: name}
+	// The entry is checked before the collector registers itself, so a DB
+	// being replaced stays registered if that fails
+	c.l.Lock()
+	_, err = c.checkNamed(name, db, e, replace)
+	c.l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.registerSelf(); err != nil {
+		return nil, err
+	}
+	return c.addNamed(name, db, e, replace)
+}
+
+// checkNamed returns the entry registered under name, if any, unless e
+// can't be registered under name with db. c.l must be held.
+func (c *Collector) checkNamed(name string, db *sql.DB, e *dbEntry, replace bool) (*dbEntry, error) {
+	old, ok := c.named[name]
+	if ok && !replace {
+		return nil, fmt.Errorf("%w: name %q", ErrAlreadyRegistered, name)
+	}
+	if existing, registered := c.dbs[db]; registered && existing != old {
+		return nil, ErrAlreadyRegistered
+	}
+	if err := c.validateLabelValues(e.labelValues); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+func (c *Collector) addNamed(name string, db *sql.DB, e *dbEntry, replace bool) (*sql.DB, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	old, err := c.checkNamed(name, db, e, replace)
+	if err != nil {
+		return nil, err
+	}
+	ok := old != nil
+	if ok && old.provider == StatsProvider(db) {
+		// The DB keeps its entry, and with it its registration time and
+		// history
+		old.mu.Lock()
+		changed := !equalLabelValues(old.labelValues, e.labelValues)
+		old.labelValues = e.labelValues
+		old.mu.Unlock()
+		if changed {
+			c.labelUpdates.Add(1)
+		}
+		return nil, nil
+	}
+	var oldDB *sql.DB
+	if ok {
+		delete(c.dbs, old.provider)
+		oldDB, _ = old.provider.(*sql.DB)
+		e.swaps = old.swaps + 1
+		if !equalLabelValues(old.currentLabelValues(), e.labelValues) {
+			c.labelUpdates.Add(1)
+		}
+	}
+	c.insert(db, e)
+	c.named[name] = e
+	c.publish()
+	return oldDB, nil
+}
+
+// UnregisterNamed removes the DB registered under name, reporting whether
+// there was one
+func (c *Collector) UnregisterNamed(name string) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	e, ok := c.named[name]
+	if !ok {
+		return false
+	}
+	delete(c.dbs, e.provider)
+	delete(c.named, name)
+	c.publish()
+	return true
+}
+
+// NamedDB returns the DB registered under name
+func (c *Collector) NamedDB(name string) (*sql.DB, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	e, ok := c.named[name]
+	if !ok {
+		return nil, false
+	}
+	db, _ := e.provider.(*sql.DB)
+	return db, true
+}
+
+// Names returns the names DBs are registered under, sorted
+func (c *Collector) Names() []string {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	names := make([]string, 0, len(c.named))
+	for name := range c.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
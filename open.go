@@ -0,0 +1,115 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"database/sql/driver"
+)
+
+// OpenOption configures the DBs opened with Open and OpenDB
+type OpenOption func(*openConfig)
+
+type openConfig struct {
+	c      *Collector
+	labels map[string]string
+	pool   *PoolConfig
+}
+
+// WithCollector makes Open and OpenDB instrument the DB with c in place of
+// Default
+func WithCollector(c *Collector) OpenOption {
+	return func(cfg *openConfig) {
+		cfg.c = c
+	}
+}
+
+// WithDBLabels gives the DB's values of the collector's Options.Labels by
+// name. With Open they take precedence over the labels parsed from the
+// DSN.
+func WithDBLabels(labels map[string]string) OpenOption {
+	return func(cfg *openConfig) {
+		cfg.labels = labels
+	}
+}
+
+// WithPoolConfig configures the DB's pool with p, and emits its limits, as
+// Collector.SetPoolConfig does
+func WithPoolConfig(p PoolConfig) OpenOption {
+	return func(cfg *openConfig) {
+		cfg.pool = &p
+	}
+}
+
+func newOpenConfig(opts []OpenOption) openConfig {
+	cfg := openConfig{c: Default()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// Open opens a fully instrumented DB in one call with Collector.Open on
+// the collector, Default unless WithCollector is given, taking the DB's
+// labels by name and optionally configuring its pool. The labels of the
+// collector's Options.Labels that WithDBLabels doesn't give are parsed
+// from dsn, as with RegisterDBWithDSN.
+func Open(driverName, dsn string, opts ...OpenOption) (*sql.DB, error) {
+	cfg := newOpenConfig(opts)
+	labels := cfg.labels
+	for _, name := range cfg.c.o.Labels {
+		if _, ok := labels[name]; !ok {
+			var err error
+			if labels, err = cfg.c.dsnLabels(driverName, dsn, labels); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	values, err := cfg.c.labelValues(labels)
+	if err != nil {
+		return nil, err
+	}
+	db, err := cfg.c.Open(driverName, dsn, values)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.configure(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenDB is like Open for a connector, as sql.OpenDB is, and wires the DB
+// up the same way. The DB's labels
+// must all be given with WithDBLabels, as there is no DSN to parse.
+func OpenDB(connector driver.Connector, opts ...OpenOption) (*sql.DB, error) {
+	cfg := newOpenConfig(opts)
+	values, err := cfg.c.labelValues(cfg.labels)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := cfg.c.WrapConnector(connector, values)
+	if err != nil {
+		return nil, err
+	}
+	db, err := cfg.c.openWrapped(wrapped.(*wrappedConnector), "", values)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.configure(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// configure applies the pool config, if any, to the registered db, closing
+// it if that fails
+func (cfg openConfig) configure(db *sql.DB) error {
+	if cfg.pool == nil {
+		return nil
+	}
+	if err := cfg.c.SetPoolConfig(db, *cfg.pool); err != nil {
+		cfg.c.CloseDB(db)
+		return err
+	}
+	return nil
+}
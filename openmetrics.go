@@ -0,0 +1,55 @@
+package sqlmetrics
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// openMetricsUnits are the units metric names end with, optionally
+// followed by _total, which get OpenMetrics UNIT metadata
+var openMetricsUnits = []string{"seconds", "milliseconds", "bytes", "ratio"}
+
+// openMetricsUnit returns the OpenMetrics unit of the metric fqName, the
+// unit its name ends with, if Options.OpenMetrics is set. OpenMetrics
+// requires the names of metrics with a unit to end with it.
+func (o Options) openMetricsUnit(fqName string) string {
+	if !o.OpenMetrics {
+		return ""
+	}
+	name := strings.TrimSuffix(fqName, "_total")
+	for _, unit := range openMetricsUnits {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
+
+// newDesc returns the desc of fqName, with its OpenMetrics unit
+func (o Options) newDesc(fqName, help string, variableLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	unit := o.openMetricsUnit(fqName)
+	if unit == "" {
+		return prometheus.NewDesc(fqName, help, variableLabels, constLabels)
+	}
+	return prometheus.V2.NewDesc(fqName, help, prometheus.UnconstrainedLabels(variableLabels), constLabels, prometheus.WithUnit(unit))
+}
+
+// constCounter returns the const counter of desc, created at created if
+// Options.OpenMetrics is set
+func (c *Collector) constCounter(desc *prometheus.Desc, v float64, created time.Time, labelValues ...string) prometheus.Metric {
+	if !c.o.OpenMetrics {
+		return prometheus.MustNewConstMetric(desc, prometheus.CounterValue, v, labelValues...)
+	}
+	return prometheus.MustNewConstMetricWithCreatedTimestamp(desc, prometheus.CounterValue, v, created, labelValues...)
+}
+
+// constHistogram returns the const histogram of desc, created at created
+// if Options.OpenMetrics is set
+func (c *Collector) constHistogram(desc *prometheus.Desc, count uint64, sum float64, buckets map[float64]uint64, created time.Time, labelValues ...string) prometheus.Metric {
+	if !c.o.OpenMetrics {
+		return prometheus.MustNewConstHistogram(desc, count, sum, buckets, labelValues...)
+	}
+	return prometheus.MustNewConstHistogramWithCreatedTimestamp(desc, count, sum, buckets, created, labelValues...)
+}
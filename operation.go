@@ -0,0 +1,23 @@
+package sqlmetrics
+
+import "context"
+
+// OperationLabel is the label carrying the operation queries were tagged
+// with by WithOperation, when Options.OperationLabel is set
+const OperationLabel = "operation"
+
+type operationKey struct{}
+
+// WithOperation returns a copy of ctx tagging the queries made with it as
+// part of operation, such as "get_user", for the operation label of query
+// metrics.
+func WithOperation(ctx context.Context, operation string) context.Context {
+	return context.WithValue(ctx, operationKey{}, operation)
+}
+
+// OperationFromContext returns the operation ctx was tagged with by
+// WithOperation, or "" if it wasn't.
+func OperationFromContext(ctx context.Context) string {
+	operation, _ := ctx.Value(operationKey{}).(string)
+	return operation
+}
@@ -0,0 +1,91 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures the Options of a Collector created with New
+type Option func(*Options)
+
+// New returns a Collector configured by opts
+func New(opts ...Option) *Collector {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return NewCollector(o)
+}
+
+// DBNameLabel is the const label NewDBStatsCollector names its DB with, as
+// collectors.NewDBStatsCollector does
+const DBNameLabel = "db_name"
+
+// goSQLNames are the names collectors.NewDBStatsCollector gives the pool
+// metrics, for NewDBStatsCollector
+var goSQLNames = map[string]string{
+	"connections_max":                         "go_sql_max_open_connections",
+	"connections_open":                        "go_sql_open_connections",
+	"connections_in_use":                      "go_sql_in_use_connections",
+	"connections_idle":                        "go_sql_idle_connections",
+	"connections_wait_count_total":            "go_sql_wait_count_total",
+	"connections_wait_duration_seconds_total": "go_sql_wait_duration_seconds_total",
+	"connections_max_idle_closed_total":       "go_sql_max_idle_closed_total",
+	"connections_max_idle_time_closed_total":  "go_sql_max_idle_time_closed_total",
+	"connections_max_lifetime_closed_total":   "go_sql_max_lifetime_closed_total",
+}
+
+// NewDBStatsCollector returns a Collector configured by opts of db alone,
+// with the const label db_name set to dbName, as a drop-in replacement for
+// collectors.NewDBStatsCollector: the metrics it has are named go_sql_* as
+// there, unless opts set their MetricNames, and the others keep their
+// names. Labels set by opts are ignored, as there is only one DB to tell
+// apart.
+func NewDBStatsCollector(db *sql.DB, dbName string, opts ...Option) *Collector {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.Labels = nil
+	names := make(map[string]string, len(goSQLNames)+len(o.MetricNames))
+	for name, mapped := range goSQLNames {
+		names[name] = mapped
+	}
+	for name, mapped := range o.MetricNames {
+		names[name] = mapped
+	}
+	o.MetricNames = names
+	o.ConstLabels = mergeLabels(o.ConstLabels, prometheus.Labels{DBNameLabel: dbName})
+	c := NewCollector(o)
+	c.MustRegisterDB(db, nil)
+	return c
+}
+
+// WithNamespace sets the namespace metric names start with
+func WithNamespace(namespace string) Option {
+	return func(o *Options) {
+		o.Namespace = namespace
+	}
+}
+
+// WithSubsystem sets the subsystem metric names start with, after the namespace
+func WithSubsystem(subsystem string) Option {
+	return func(o *Options) {
+		o.Subsystem = subsystem
+	}
+}
+
+// WithConstLabels adds const labels to every metric
+func WithConstLabels(labels prometheus.Labels) Option {
+	return func(o *Options) {
+		o.ConstLabels = mergeLabels(o.ConstLabels, labels)
+	}
+}
+
+// WithLabels sets the names of the labels DBs are registered with
+func WithLabels(labels ...string) Option {
+	return func(o *Options) {
+		o.Labels = labels
+	}
+}
@@ -0,0 +1,38 @@
+package sqlmetrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+func TestNewDBStatsCollectorNames(t *testing.T) {
+	db := openTestDB(t)
+	upstream := gather(t, collectors.NewDBStatsCollector(db, "main"))
+	families := gather(t, NewDBStatsCollector(db, "main"))
+	labels := map[string]string{DBNameLabel: "main"}
+
+	// Every upstream series is there, with the same name, type and labels
+	for name, want := range upstream {
+		got, ok := families[name]
+		if !ok {
+			t.Errorf("no %s", name)
+			continue
+		}
+		if got.GetType() != want.GetType() {
+			t.Errorf("%s is a %s, want %s", name, got.GetType(), want.GetType())
+		}
+		if v, ok := metricValue(upstream, name, labels); ok {
+			assertValue(t, families, name, labels, v)
+		} else {
+			t.Errorf("upstream %s has no series %v", name, labels)
+		}
+	}
+
+	// MetricNames given in the opts take precedence
+	renamed := gather(t, NewDBStatsCollector(db, "main", func(o *Options) {
+		o.MetricNames = map[string]string{"connections_open": "pool_open"}
+	}))
+	assertValue(t, renamed, "pool_open", labels, 0)
+	assertAbsent(t, renamed, "go_sql_open_connections", labels)
+}
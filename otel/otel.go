@@ -0,0 +1,109 @@
+// Package otel reports the pool stats of the DBs registered with a
+// sqlmetrics.Collector as OpenTelemetry metrics, for setups exporting OTLP
+// rather than being scraped by prometheus.
+package otel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// Register creates observable instruments on meter reporting the stats of
+// the DBs registered with c, with each DB's labels as attributes. The
+// instruments are named after the collector's prometheus metrics, with the
+// counters' _total suffix left to the exporter. Under the collector's
+// Options.SemanticConventions the pool's connections are reported as the
+// db.client.connections.usage and db.client.connections.max up-down
+// counters of the database client semantic conventions instead, with a
+// state attribute of used or idle for the former. Unregister the returned
+// registration to stop reporting.
+func Register(meter metric.Meter, c *sqlmetrics.Collector) (metric.Registration, error) {
+	var err error
+	gauge := func(name, description string) metric.Int64ObservableGauge {
+		g, gerr := meter.Int64ObservableGauge(name, metric.WithDescription(description), metric.WithUnit("{connection}"))
+		if err == nil {
+			err = gerr
+		}
+		return g
+	}
+	counter := func(name, description string) metric.Int64ObservableCounter {
+		ctr, cerr := meter.Int64ObservableCounter(name, metric.WithDescription(description), metric.WithUnit("{connection}"))
+		if err == nil {
+			err = cerr
+		}
+		return ctr
+	}
+
+	upDownCounter := func(name, description string) metric.Int64ObservableUpDownCounter {
+		ctr, cerr := meter.Int64ObservableUpDownCounter(name, metric.WithDescription(description), metric.WithUnit("{connection}"))
+		if err == nil {
+			err = cerr
+		}
+		return ctr
+	}
+
+	semconv := c.Options().SemanticConventions
+	var pool []metric.Observable
+	var maxConns, openConns, inUse, idle metric.Int64ObservableGauge
+	var usage, semconvMax metric.Int64ObservableUpDownCounter
+	if semconv {
+		usage = upDownCounter("db.client.connections.usage", "The number of connections that are currently in the state described by the state attribute")
+		semconvMax = upDownCounter("db.client.connections.max", "The maximum number of open connections allowed")
+		pool = []metric.Observable{usage, semconvMax}
+	} else {
+		maxConns = gauge("connections_max", "Max number of open connections to the DB")
+		openConns = gauge("connections_open", "Current number of established connections both in use and idle")
+		inUse = gauge("connections_in_use", "The number of connections currently in use")
+		idle = gauge("connections_idle", "The number of idle connections")
+		pool = []metric.Observable{maxConns, openConns, inUse, idle}
+	}
+	waitCount := counter("connections_wait_count", "The total number of connections waited for")
+	waitDuration, werr := meter.Float64ObservableCounter(
+		"connections_wait_duration",
+		metric.WithDescription("The total time blocked waiting for a new connection"),
+		metric.WithUnit("s"),
+	)
+	if err == nil {
+		err = werr
+	}
+	maxIdleClosed := counter("connections_max_idle_closed", "The total number of connections closed due to SetMaxIdleConns")
+	maxIdleTimeClosed := counter("connections_max_idle_time_closed", "The total number of connections closed due to SetConnMaxIdleTime")
+	maxLifetimeClosed := counter("connections_max_lifetime_closed", "The total number of connections closed due to SetConnMaxLifetime")
+	if err != nil {
+		return nil, err
+	}
+
+	return meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		for _, s := range c.Snapshot() {
+			attrs := make([]attribute.KeyValue, 0, len(s.Labels))
+			for k, v := range s.Labels {
+				attrs = append(attrs, attribute.String(k, v))
+			}
+			opt := metric.WithAttributeSet(attribute.NewSet(attrs...))
+
+			if semconv {
+				state := func(state string) metric.ObserveOption {
+					return metric.WithAttributeSet(attribute.NewSet(append(attrs, attribute.String(sqlmetrics.ConnectionStateLabel, state))...))
+				}
+				o.ObserveInt64(usage, int64(s.Stats.InUse), state(sqlmetrics.ConnectionStateUsed))
+				o.ObserveInt64(usage, int64(s.Stats.Idle), state(sqlmetrics.ConnectionStateIdle))
+				o.ObserveInt64(semconvMax, int64(s.Stats.MaxOpenConnections), opt)
+			} else {
+				o.ObserveInt64(maxConns, int64(s.Stats.MaxOpenConnections), opt)
+				o.ObserveInt64(openConns, int64(s.Stats.OpenConnections), opt)
+				o.ObserveInt64(inUse, int64(s.Stats.InUse), opt)
+				o.ObserveInt64(idle, int64(s.Stats.Idle), opt)
+			}
+			o.ObserveInt64(waitCount, s.Stats.WaitCount, opt)
+			o.ObserveFloat64(waitDuration, s.Stats.WaitDuration.Seconds(), opt)
+			o.ObserveInt64(maxIdleClosed, s.Stats.MaxIdleClosed, opt)
+			o.ObserveInt64(maxIdleTimeClosed, s.Stats.MaxIdleTimeClosed, opt)
+			o.ObserveInt64(maxLifetimeClosed, s.Stats.MaxLifetimeClosed, opt)
+		}
+		return nil
+	}, append(pool, waitCount, waitDuration, maxIdleClosed, maxIdleTimeClosed, maxLifetimeClosed)...)
+}
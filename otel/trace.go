@@ -0,0 +1,88 @@
+package otel
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// tracerName is the instrumentation name of the tracer spans are created
+// with
+const tracerName = "github.com/jacksontj/gosqlmetrics/otel"
+
+// NewTracingHook returns a QueryHook emitting a client span for every
+// driver operation of wrapped drivers and connectors, with the db.system,
+// db.operation and db.statement attributes and the DB's labels. Add it to
+// sqlmetrics.Options.QueryHooks.
+func NewTracingHook(tp trace.TracerProvider, system string) sqlmetrics.QueryHook {
+	return &tracingHook{
+		tracer: tp.Tracer(tracerName),
+		system: attribute.String("db.system", system),
+	}
+}
+
+type tracingHook struct {
+	tracer trace.Tracer
+	system attribute.KeyValue
+}
+
+func (h *tracingHook) Before(ctx context.Context, e sqlmetrics.QueryEvent) context.Context {
+	attrs := make([]attribute.KeyValue, 0, len(e.Labels)+3)
+	attrs = append(attrs, h.system, attribute.String("db.operation", e.Method))
+	if e.Query != "" {
+		attrs = append(attrs, attribute.String("db.statement", e.Query))
+	}
+	for k, v := range e.Labels {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	ctx, _ = h.tracer.Start(ctx, "sql."+e.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	return ctx
+}
+
+func (h *tracingHook) After(ctx context.Context, e sqlmetrics.QueryEvent, err error) {
+	span := trace.SpanFromContext(ctx)
+	if err != nil && !errors.Is(err, driver.ErrSkip) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceExemplar returns the trace ID of the span in ctx as a trace_id
+// exemplar label, for sqlmetrics.Options.ExemplarFromContext. It returns nil
+// for contexts without a sampled span.
+func TraceExemplar(ctx context.Context) prometheus.Labels {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() || !sc.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": sc.TraceID().String()}
+}
+
+// TraceCommentTags returns the W3C traceparent, and tracestate if any, of the
+// span in ctx as comment tags, for sqlmetrics.Options.CommentTags. It returns
+// nil for contexts without a valid span.
+func TraceCommentTags(ctx context.Context) map[string]string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	tags := map[string]string{
+		"traceparent": fmt.Sprintf("00-%s-%s-%s", sc.TraceID(), sc.SpanID(), sc.TraceFlags()),
+	}
+	if ts := sc.TraceState().String(); ts != "" {
+		tags["tracestate"] = ts
+	}
+	return tags
+}
@@ -0,0 +1,145 @@
+// Package pgxpoolmetrics reports the stats of pgxpool pools, which don't go
+// through database/sql, with the same metrics and labels as the
+// sqlmetrics.Collector.
+package pgxpoolmetrics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// Provider adapts a pool to sqlmetrics.StatsProvider, so it can be
+// registered with a Collector's RegisterProvider.
+type Provider struct {
+	pool *pgxpool.Pool
+}
+
+// NewProvider returns the Provider of pool
+func NewProvider(pool *pgxpool.Pool) *Provider {
+	return &Provider{pool: pool}
+}
+
+// Stats maps the pool's stats onto sql.DBStats. Acquires that had to wait
+// for a connection count as waits, and connections destroyed for being idle
+// too long or too old as closed by SetConnMaxIdleTime and
+// SetConnMaxLifetime. pgxpool has no limit on idle connections.
+func (p *Provider) Stats() sql.DBStats {
+	s := p.pool.Stat()
+	return sql.DBStats{
+		MaxOpenConnections: int(s.MaxConns()),
+		OpenConnections:    int(s.TotalConns()),
+		InUse:              int(s.AcquiredConns()),
+		Idle:               int(s.IdleConns()),
+		WaitCount:          s.EmptyAcquireCount(),
+		WaitDuration:       s.EmptyAcquireWaitTime(),
+		MaxIdleTimeClosed:  s.MaxIdleDestroyCount(),
+		MaxLifetimeClosed:  s.MaxLifetimeDestroyCount(),
+	}
+}
+
+// PingContext pings the pool, for the prober of sqlmetrics.Options.PingInterval
+func (p *Provider) PingContext(ctx context.Context) error {
+	return p.pool.Ping(ctx)
+}
+
+// Collector emits the pgxpool stats that have no sql.DBStats field, named
+// and labeled per the Options of the sqlmetrics.Collector the pools'
+// Providers are registered with, and the configured statement cache
+// capacity of the pools' connections. pgx keeps no hit, miss or eviction
+// counts of its statement caches, nor exposes their size, so those can't
+// be reported.
+type Collector struct {
+	o sqlmetrics.Options
+
+	constructing      *prometheus.Desc
+	acquires          *prometheus.Desc
+	acquireDur        *prometheus.Desc
+	canceled          *prometheus.Desc
+	newConns          *prometheus.Desc
+	stmtCacheCapacity *prometheus.Desc
+
+	l     sync.RWMutex
+	pools map[*pgxpool.Pool]registeredPool
+}
+
+// registeredPool is a registered pool's label values and configuration,
+// which doesn't change once the pool is created
+type registeredPool struct {
+	labelValues       []string
+	stmtCacheCapacity int
+}
+
+// NewCollector returns a collector for the given options
+func NewCollector(o sqlmetrics.Options) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(o.MetricName(name), o.Help(name, help), o.Labels, o.ConstLabels)
+	}
+	return &Collector{
+		o:                 o,
+		constructing:      desc("pgxpool_connections_constructing", "The number of connections being established"),
+		acquires:          desc("pgxpool_acquires_total", "The total number of connections acquired from the pool"),
+		acquireDur:        desc("pgxpool_acquire_duration_seconds_total", "The total time spent acquiring connections from the pool in seconds"),
+		canceled:          desc("pgxpool_canceled_acquires_total", "The total number of acquires canceled by their context"),
+		newConns:          desc("pgxpool_new_connections_total", "The total number of new connections opened"),
+		stmtCacheCapacity: desc("pgxpool_statement_cache_capacity", "The configured capacity of each connection's prepared statement cache"),
+		pools:             make(map[*pgxpool.Pool]registeredPool),
+	}
+}
+
+// Register adds pool to the collector with the given label values
+func (c *Collector) Register(pool *pgxpool.Pool, labelValues []string) error {
+	if len(labelValues) != len(c.o.Labels) {
+		return fmt.Errorf("expected %d label values %v, got %d", len(c.o.Labels), c.o.Labels, len(labelValues))
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if _, ok := c.pools[pool]; ok {
+		return sqlmetrics.ErrAlreadyRegistered
+	}
+	c.pools[pool] = registeredPool{
+		labelValues:       append([]string(nil), labelValues...),
+		stmtCacheCapacity: pool.Config().ConnConfig.StatementCacheCapacity,
+	}
+	return nil
+}
+
+// Unregister removes pool from the collector, reporting whether it was
+// registered
+func (c *Collector) Unregister(pool *pgxpool.Pool) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	_, ok := c.pools[pool]
+	delete(c.pools, pool)
+	return ok
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.constructing
+	ch <- c.acquires
+	ch <- c.acquireDur
+	ch <- c.canceled
+	ch <- c.newConns
+	ch <- c.stmtCacheCapacity
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	for pool, p := range c.pools {
+		s, labelValues := pool.Stat(), p.labelValues
+		ch <- prometheus.MustNewConstMetric(c.constructing, prometheus.GaugeValue, float64(s.ConstructingConns()), labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.acquires, prometheus.CounterValue, float64(s.AcquireCount()), labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.acquireDur, prometheus.CounterValue, c.o.Duration(s.AcquireDuration()), labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.canceled, prometheus.CounterValue, float64(s.CanceledAcquireCount()), labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.newConns, prometheus.CounterValue, float64(s.NewConnsCount()), labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.stmtCacheCapacity, prometheus.GaugeValue, float64(p.stmtCacheCapacity), labelValues...)
+	}
+}
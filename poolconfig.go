@@ -0,0 +1,61 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"time"
+)
+
+// PoolConfig is the configuration of a DB's connection pool, which
+// database/sql doesn't expose beyond MaxOpenConnections
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// apply configures db's pool with p
+func (p PoolConfig) apply(db *sql.DB) {
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	db.SetMaxIdleConns(p.MaxIdleConns)
+	db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+}
+
+// maxIdle returns the max idle connections database/sql keeps with p,
+// which are never more than the max open connections
+func (p PoolConfig) maxIdle() int {
+	n := max(p.MaxIdleConns, 0)
+	if p.MaxOpenConns > 0 && n > p.MaxOpenConns {
+		n = p.MaxOpenConns
+	}
+	return n
+}
+
+// SetPoolConfig configures the pool of the registered db with p, as
+// db.SetMaxOpenConns, SetMaxIdleConns, SetConnMaxLifetime and
+// SetConnMaxIdleTime do, and emits connections_max_idle,
+// connections_max_lifetime_seconds and connections_max_idle_time_seconds
+// for it from then on, next to the pool's live numbers. Durations of 0 are
+// unlimited.
+func (c *Collector) SetPoolConfig(db *sql.DB, p PoolConfig) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	e, ok := c.dbs[db]
+	if !ok {
+		return ErrNotRegistered
+	}
+	p.apply(db)
+	e.poolConfig.Store(&p)
+	return nil
+}
+
+// RegisterDBWithPoolConfig registers db as RegisterDB does, along with the
+// configuration its pool was given elsewhere, which is emitted as with
+// SetPoolConfig but not applied to db.
+func (c *Collector) RegisterDBWithPoolConfig(db *sql.DB, p PoolConfig, labelValues []string) error {
+	e := &dbEntry{labelValues: labelValues}
+	e.poolConfig.Store(&p)
+	return c.register(db, e)
+}
@@ -0,0 +1,179 @@
+// Package postgresmetrics reports server-side Postgres stats, from
+// pg_stat_database and pg_stat_activity, of the databases of DBs registered
+// with a sqlmetrics.Collector, with the same metric naming and labels.
+package postgresmetrics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// DefaultTimeout is the Options.Timeout used when it is 0
+const DefaultTimeout = 5 * time.Second
+
+// StateLabel is the label of pg_stat_activity_backends with the state of
+// the backends
+const StateLabel = "backend_state"
+
+// databaseQuery reads the pg_stat_database row of the connection's database
+const databaseQuery = `SELECT numbackends, xact_commit, xact_rollback, blks_read, blks_hit, deadlocks, temp_files, temp_bytes
+FROM pg_stat_database WHERE datname = current_database()`
+
+// activityQuery counts the backends of the connection's database by state
+const activityQuery = `SELECT COALESCE(state, ''), count(*)
+FROM pg_stat_activity WHERE datname = current_database() GROUP BY 1`
+
+// Options configures a Collector
+type Options struct {
+	// Timeout bounds the queries of each DB during a collection
+	Timeout time.Duration
+}
+
+// Collector emits the pg_stat_database and pg_stat_activity stats of the
+// databases of registered Postgres DBs, named and labeled per the Options
+// of their sqlmetrics.Collector.
+type Collector struct {
+	o       sqlmetrics.Options
+	timeout time.Duration
+
+	backends     *prometheus.Desc
+	commits      *prometheus.Desc
+	rollbacks    *prometheus.Desc
+	blocksRead   *prometheus.Desc
+	blocksHit    *prometheus.Desc
+	deadlocks    *prometheus.Desc
+	tempFiles    *prometheus.Desc
+	tempBytes    *prometheus.Desc
+	activity     *prometheus.Desc
+	scrapeErrors *prometheus.CounterVec
+
+	l   sync.RWMutex
+	dbs map[*sql.DB][]string
+}
+
+// NewCollector returns a collector for the given options
+func NewCollector(o sqlmetrics.Options, po Options) *Collector {
+	if po.Timeout <= 0 {
+		po.Timeout = DefaultTimeout
+	}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(o.MetricName(name), o.Help(name, help), o.Labels, o.ConstLabels)
+	}
+	return &Collector{
+		o:          o,
+		timeout:    po.Timeout,
+		backends:   desc("pg_stat_database_backends", "The number of backends connected to the database"),
+		commits:    desc("pg_stat_database_xact_commit_total", "The total number of transactions committed in the database"),
+		rollbacks:  desc("pg_stat_database_xact_rollback_total", "The total number of transactions rolled back in the database"),
+		blocksRead: desc("pg_stat_database_blks_read_total", "The total number of disk blocks read in the database"),
+		blocksHit:  desc("pg_stat_database_blks_hit_total", "The total number of disk blocks found in the buffer cache in the database"),
+		deadlocks:  desc("pg_stat_database_deadlocks_total", "The total number of deadlocks detected in the database"),
+		tempFiles:  desc("pg_stat_database_temp_files_total", "The total number of temporary files created by queries in the database"),
+		tempBytes:  desc("pg_stat_database_temp_bytes_total", "The total bytes written to temporary files by queries in the database"),
+		activity: prometheus.NewDesc(
+			o.MetricName("pg_stat_activity_backends"),
+			o.Help("pg_stat_activity_backends", "The number of backends connected to the database by state"),
+			append(append([]string(nil), o.Labels...), StateLabel), o.ConstLabels,
+		),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("postgres_scrape_errors_total"),
+			Help:        o.Help("postgres_scrape_errors_total", "The total number of collections that failed to query the database's stats"),
+			ConstLabels: o.ConstLabels,
+		}, o.Labels),
+		dbs: make(map[*sql.DB][]string),
+	}
+}
+
+// Register adds db to the collector with the given label values
+func (c *Collector) Register(db *sql.DB, labelValues []string) error {
+	if len(labelValues) != len(c.o.Labels) {
+		return fmt.Errorf("expected %d label values %v, got %d", len(c.o.Labels), c.o.Labels, len(labelValues))
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if _, ok := c.dbs[db]; ok {
+		return sqlmetrics.ErrAlreadyRegistered
+	}
+	c.dbs[db] = append([]string(nil), labelValues...)
+	return nil
+}
+
+// Unregister removes db from the collector, reporting whether it was
+// registered
+func (c *Collector) Unregister(db *sql.DB) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	_, ok := c.dbs[db]
+	delete(c.dbs, db)
+	return ok
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.backends
+	ch <- c.commits
+	ch <- c.rollbacks
+	ch <- c.blocksRead
+	ch <- c.blocksHit
+	ch <- c.deadlocks
+	ch <- c.tempFiles
+	ch <- c.tempBytes
+	ch <- c.activity
+	c.scrapeErrors.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	for db, labelValues := range c.dbs {
+		if err := c.collectDB(ch, db, labelValues); err != nil {
+			c.scrapeErrors.WithLabelValues(labelValues...).Inc()
+		}
+	}
+	c.scrapeErrors.Collect(ch)
+}
+
+func (c *Collector) collectDB(ch chan<- prometheus.Metric, db *sql.DB, labelValues []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var backends, commits, rollbacks, blocksRead, blocksHit, deadlocks, tempFiles, tempBytes float64
+	err := db.QueryRowContext(ctx, databaseQuery).Scan(
+		&backends, &commits, &rollbacks, &blocksRead, &blocksHit, &deadlocks, &tempFiles, &tempBytes,
+	)
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(c.backends, prometheus.GaugeValue, backends, labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.commits, prometheus.CounterValue, commits, labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.rollbacks, prometheus.CounterValue, rollbacks, labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.blocksRead, prometheus.CounterValue, blocksRead, labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.blocksHit, prometheus.CounterValue, blocksHit, labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.deadlocks, prometheus.CounterValue, deadlocks, labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.tempFiles, prometheus.CounterValue, tempFiles, labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.tempBytes, prometheus.CounterValue, tempBytes, labelValues...)
+
+	rows, err := db.QueryContext(ctx, activityQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	lv := append(append(make([]string, 0, len(labelValues)+1), labelValues...), "")
+	for rows.Next() {
+		var state string
+		var count float64
+		if err := rows.Scan(&state, &count); err != nil {
+			return err
+		}
+		lv[len(labelValues)] = state
+		ch <- prometheus.MustNewConstMetric(c.activity, prometheus.GaugeValue, count, lv...)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,140 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
+)
+
+// pinger is a StatsProvider that can check the database is reachable, as
+// *sql.DB can
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// probe pings every registered DB that can be pinged each
+// Options.PingInterval, starting right away, one at a time unless
+// Options.PingConcurrency is set
+func (c *Collector) probe(stop <-chan struct{}) {
+	defer c.samplerWG.Done()
+	timeout := c.o.PingTimeout
+	if timeout <= 0 {
+		timeout = c.o.PingInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(c.o.PingInterval)
+	defer ticker.Stop()
+	for {
+		var entries []*dbEntry
+		for _, e := range c.entries() {
+			if e.closed != nil && e.closed.Load() {
+				c.unregister(e.provider)
+				continue
+			}
+			if _, ok := e.provider.(pinger); ok {
+				entries = append(entries, e)
+			}
+		}
+		parallel(c.o.PingConcurrency, len(entries), func(i int) {
+			e := entries[i]
+			if err := e.ping(ctx, e.provider.(pinger), timeout); errors.Is(err, errDBClosed) {
+				c.unregister(e.provider)
+			}
+		})
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ping pings p within timeout, if set, recording the result unless ctx is
+// done, as when the prober was stopped
+func (e *dbEntry) ping(ctx context.Context, p pinger, timeout time.Duration) error {
+	pingCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		pingCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	start := time.Now()
+	err := p.PingContext(pingCtx)
+	d := time.Since(start)
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pinged = true
+	e.up = err == nil
+	e.pingDur = d
+	return err
+}
+
+// HealthCheck returns a check that pings the DB registered under name with
+// RegisterNamed, within Options.PingTimeout if set, for health check
+// frameworks and readiness handlers. Its result is the DB's db_up and
+// ping_duration_seconds from then on, as the prober's are, so health and
+// metrics agree. The DB is looked up on every check, so it follows
+// ReplaceNamed, and the check fails with ErrNotRegistered while there is
+// none. From the first HealthCheck on, metric_info and Config list db_up
+// and ping_duration_seconds even if PingInterval isn't set.
+func (c *Collector) HealthCheck(name string) func(ctx context.Context) error {
+	c.healthChecked.Store(true)
+	return func(ctx context.Context) error {
+		c.l.Lock()
+		e, ok := c.named[name]
+		c.l.Unlock()
+		if !ok {
+			return ErrNotRegistered
+		}
+		p, ok := e.provider.(pinger)
+		if !ok {
+			return ErrNotRegistered
+		}
+		err := e.ping(ctx, p, c.o.PingTimeout)
+		if err == nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+}
+
+// errDBClosed is the error of a ping of a closed *sql.DB, which
+// database/sql doesn't export. DBs opened on a wrapped connector are known
+// to be closed without it, by dbEntry.closed.
+var errDBClosed = func() error {
+	db := sql.OpenDB(closedConnector{})
+	db.Close()
+	return db.PingContext(context.Background())
+}()
+
+// closedConnector is the connector of the DB errDBClosed is read from,
+// which never connects
+type closedConnector struct{}
+
+func (closedConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, errors.New("closedConnector doesn't connect")
+}
+
+func (closedConnector) Driver() driver.Driver { return nil }
+
+// pingResult returns the result of the latest ping, if the DB was pinged
+func (e *dbEntry) pingResult() (up bool, d time.Duration, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.up, e.pingDur, e.pinged
+}
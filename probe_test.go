@@ -0,0 +1,163 @@
+package sqlmetrics
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pingCounter tracks the pings of pingProviders in flight
+type pingCounter struct {
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+	pings    int
+	// goroutines are the goroutines the pings ran on
+	goroutines map[string]bool
+}
+
+// pingProvider is a StatsProvider whose pings take a while
+type pingProvider struct {
+	pings *pingCounter
+}
+
+func (p *pingProvider) Stats() sql.DBStats { return sql.DBStats{} }
+
+func (p *pingProvider) PingContext(ctx context.Context) error {
+	// The stack trace starts with "goroutine <id> ["
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	goroutine, _, _ := bytes.Cut(buf, []byte(" ["))
+
+	p.pings.mu.Lock()
+	p.pings.inFlight++
+	p.pings.peak = max(p.pings.peak, p.pings.inFlight)
+	p.pings.goroutines[string(goroutine)] = true
+	p.pings.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	p.pings.mu.Lock()
+	p.pings.inFlight--
+	p.pings.pings++
+	p.pings.mu.Unlock()
+	return nil
+}
+
+func TestProbeConcurrency(t *testing.T) {
+	for _, concurrency := range []int{0, 3} {
+		// CollectConcurrency doesn't apply to the prober
+		c := NewCollector(Options{Labels: []string{"db"}, PingInterval: time.Hour, PingConcurrency: concurrency, CollectConcurrency: 5})
+		pings := &pingCounter{goroutines: map[string]bool{}}
+		for i := 0; i < 10; i++ {
+			if err := c.RegisterProvider(&pingProvider{pings}, []string{fmt.Sprint(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.Start()
+		// The first round of pings starts right away
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			pings.mu.Lock()
+			done := pings.pings
+			pings.mu.Unlock()
+			if done == 10 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("PingConcurrency %d: %d of 10 DBs pinged", concurrency, done)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		c.Stop()
+
+		if want := max(concurrency, 1); pings.peak > want {
+			t.Errorf("PingConcurrency %d: %d pings at once, want at most %d", concurrency, pings.peak, want)
+		}
+		if concurrency == 0 && len(pings.goroutines) != 1 {
+			t.Errorf("default prober pinged 10 DBs on %d goroutines, want 1", len(pings.goroutines))
+		}
+		assertValue(t, gather(t, c), "db_up", map[string]string{"db": "0"}, 1)
+	}
+}
+
+func TestProbeUnregistersClosedDBs(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, PingInterval: 5 * time.Millisecond})
+	// A DB opened by the collector is known to be closed once its
+	// connector is, and any other *sql.DB by the error of its ping
+	wrapped, err := c.Open(fakeDriverName, "", []string{"wrapped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := openTestDB(t)
+	if err := c.RegisterDB(plain, []string{"plain"}); err != nil {
+		t.Fatal(err)
+	}
+	open := openTestDB(t)
+	if err := c.RegisterDB(open, []string{"open"}); err != nil {
+		t.Fatal(err)
+	}
+	wrapped.Close()
+	plain.Close()
+
+	c.Start()
+	defer c.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.DBs()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d DBs registered, want only the open one", len(c.DBs()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.DBs()[0] != open {
+		t.Error("the prober unregistered an open DB")
+	}
+}
+
+func TestHealthCheckEnablesPingMetrics(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, EmitMetricInfo: true})
+	if err := c.RegisterNamed("main", openTestDB(t), map[string]string{"db": "main"}); err != nil {
+		t.Fatal(err)
+	}
+	listed := func() map[string]bool {
+		t.Helper()
+		b, err := c.Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config struct{ Metrics []string }
+		if err := json.Unmarshal(b, &config); err != nil {
+			t.Fatal(err)
+		}
+		names := map[string]bool{}
+		for _, name := range config.Metrics {
+			names[name] = true
+		}
+		for _, m := range gather(t, c)["metric_info"].GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "metric" && !names[lp.GetValue()] {
+					t.Errorf("metric_info describes %s, which Config doesn't list", lp.GetValue())
+				}
+			}
+		}
+		return names
+	}
+	if names := listed(); names["db_up"] || names["ping_duration_seconds"] {
+		t.Error("ping metrics listed without PingInterval or HealthCheck")
+	}
+
+	// The test DB can't connect, so it is down
+	if err := c.HealthCheck("main")(context.Background()); err == nil {
+		t.Fatal("HealthCheck of a DB that can't connect succeeded")
+	}
+	if names := listed(); !names["db_up"] || !names["ping_duration_seconds"] {
+		t.Errorf("ping metrics not listed once HealthCheck is used: %v", names)
+	}
+	assertValue(t, gather(t, c), "db_up", map[string]string{"db": "main"}, 0)
+}
@@ -0,0 +1,76 @@
+// Package pushgateway periodically pushes the metrics of a
+// sqlmetrics.Collector to a Prometheus Pushgateway, for batch jobs that
+// don't live long enough to be scraped.
+package pushgateway
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// DefaultInterval is the push interval of Options that don't set one
+const DefaultInterval = 15 * time.Second
+
+// Options for the Pusher
+type Options struct {
+	// URL is the Pushgateway's address, such as http://pushgateway:9091
+	URL string
+	// Job is the job label of the pushed group
+	Job string
+	// Instance, if set, is the instance label of the pushed group
+	Instance string
+	// Client makes the pushes, http.DefaultClient if unset
+	Client *http.Client
+
+	// Interval is the time between pushes, DefaultInterval if unset
+	Interval time.Duration
+}
+
+// Pusher pushes the collector's metrics, replacing the group's previous
+// push each time.
+type Pusher struct {
+	o Options
+	p *push.Pusher
+}
+
+// NewPusher returns a Pusher of c. The collector is collected by each push,
+// so it shouldn't also be scraped.
+func NewPusher(c *sqlmetrics.Collector, o Options) *Pusher {
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	p := push.New(o.URL, o.Job).Collector(c)
+	if o.Instance != "" {
+		p = p.Grouping("instance", o.Instance)
+	}
+	if o.Client != nil {
+		p = p.Client(o.Client)
+	}
+	return &Pusher{o: o, p: p}
+}
+
+// Run pushes every Options.Interval until ctx is done, then pushes a final
+// snapshot and returns that push's error. Call it for the lifetime of the
+// job and cancel ctx on shutdown, once the DBs' final stats are in.
+func (p *Pusher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.o.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return p.Push(context.Background())
+		case <-ticker.C:
+			p.Push(ctx)
+		}
+	}
+}
+
+// Push pushes the current metrics
+func (p *Pusher) Push(ctx context.Context) error {
+	return p.p.PushContext(ctx)
+}
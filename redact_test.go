@@ -0,0 +1,36 @@
+package sqlmetrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactDSN(t *testing.T) {
+	for _, test := range []struct {
+		dsn, want string
+	}{
+		// URL DSNs
+		{"postgres://bob:hunter2@db:5432/app?sslmode=disable", "postgres://bob:xxxxx@db:5432/app?sslmode=disable"},
+		{"postgres://db/app?password=hunter2&sslmode=disable", "postgres://db/app?password=xxxxx&sslmode=disable"},
+		{"postgres://bob@db/app?sslpassword=hunter2", "postgres://bob@db/app?sslpassword=xxxxx"},
+		{"postgres://bob@db/app?sslmode=disable", "postgres://bob@db/app?sslmode=disable"},
+		{"postgres://bob:hunter2%zz@db/app", "xxxxx"},
+		// key=value connection strings
+		{"host=db user=bob password=hunter2 dbname=app", "host=db user=bob password=xxxxx dbname=app"},
+		{"host=db password='hunter 2' dbname=app", "host=db password=xxxxx dbname=app"},
+		{`host=db password='it\'s hunter2'`, "host=db password=xxxxx"},
+		{"host=db user=bob dbname=app", "host=db user=bob dbname=app"},
+		// go-sql-driver/mysql DSNs
+		{"bob:hunter2@tcp(db:3306)/app?parseTime=true", "bob:xxxxx@tcp(db:3306)/app?parseTime=true"},
+		{"bob:hun@ter2@tcp(db:3306)/app", "bob:xxxxx@tcp(db:3306)/app"},
+		{"bob@tcp(db:3306)/app?access_token=hunter2", "bob@tcp(db:3306)/app?access_token=xxxxx"},
+	} {
+		got := RedactDSN(test.dsn)
+		if got != test.want {
+			t.Errorf("RedactDSN(%q) = %q, want %q", test.dsn, got, test.want)
+		}
+		if strings.Contains(got, "hunter") {
+			t.Errorf("RedactDSN(%q) = %q, which has the password", test.dsn, got)
+		}
+	}
+}
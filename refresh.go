@@ -0,0 +1,107 @@
+package sqlmetrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// refreshedMetrics are the metrics of a collection made by the refresher
+type refreshedMetrics struct {
+	at      time.Time
+	metrics []prometheus.Metric
+}
+
+// collectRefreshed sends the metrics of the last refresh, refreshing them
+// first if there is none within the last RefreshInterval, and when they
+// were refreshed
+func (c *Collector) collectRefreshed(ch chan<- prometheus.Metric) {
+	r := c.refreshed.Load()
+	if c.stale(r) {
+		c.refreshMu.Lock()
+		if r = c.refreshed.Load(); c.stale(r) {
+			r = c.refreshLocked()
+		}
+		c.refreshMu.Unlock()
+	}
+	for _, m := range r.metrics {
+		ch <- m
+	}
+	if c.m.refreshTime != nil {
+		ch <- prometheus.MustNewConstMetric(
+			c.m.refreshTime,
+			prometheus.GaugeValue,
+			float64(r.at.UnixNano())/1e9,
+		)
+	}
+}
+
+// stale reports whether r is nil or older than RefreshInterval, as when
+// the refresher isn't started
+func (c *Collector) stale(r *refreshedMetrics) bool {
+	return r == nil || c.now().Sub(r.at) >= c.o.RefreshInterval
+}
+
+// refresh collects the registered DBs for the scrapes to serve
+func (c *Collector) refresh() *refreshedMetrics {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	return c.refreshLocked()
+}
+
+// RefreshHandler returns an http.Handler that refreshes the metrics served
+// under Options.RefreshInterval right away, as before grabbing a snapshot
+// during an incident, and serves the registered DBs as JSON, as
+// DebugHandler does, along with when they were refreshed. Without
+// RefreshInterval every scrape reads fresh stats, so it only serves them.
+func (c *Collector) RefreshHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var refreshed *time.Time
+		if c.o.RefreshInterval > 0 {
+			at := c.refresh().at
+			refreshed = &at
+		}
+		dbs := c.Registered()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Refreshed *time.Time     `json:"refreshed,omitempty"`
+			DBs       []RegisteredDB `json:"dbs"`
+		}{refreshed, dbs})
+	})
+}
+
+func (c *Collector) refreshLocked() *refreshedMetrics {
+	at := c.now()
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	var metrics []prometheus.Metric
+	go func() {
+		defer close(done)
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+	}()
+	c.collect(ch)
+	close(ch)
+	<-done
+	r := &refreshedMetrics{at: at, metrics: metrics}
+	c.refreshed.Store(r)
+	return r
+}
+
+func (c *Collector) refreshLoop(stop <-chan struct{}) {
+	defer c.samplerWG.Done()
+	ticker := time.NewTicker(c.o.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		c.refresh()
+	}
+}
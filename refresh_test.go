@@ -0,0 +1,77 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jacksontj/gosqlmetrics/sqlmetricstest"
+)
+
+func TestRefreshHandler(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, RefreshInterval: time.Hour})
+	clock := newFakeClock(c)
+	start := clock.Now()
+	p := sqlmetricstest.NewFakeProvider(sql.DBStats{OpenConnections: 1})
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"db": "main"}
+
+	assertValue(t, gather(t, c), "connections_open", labels, 1)
+	p.Set(sql.DBStats{OpenConnections: 2})
+	clock.Advance(time.Minute)
+	// Scrapes serve the cached refresh
+	families := gather(t, c)
+	assertValue(t, families, "connections_open", labels, 1)
+	assertValue(t, families, "sqlmetrics_last_refresh_timestamp_seconds", nil, float64(start.Unix()))
+
+	rec := httptest.NewRecorder()
+	c.RefreshHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/refresh", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("RefreshHandler returned %d", rec.Code)
+	}
+	var body struct {
+		Refreshed *time.Time     `json:"refreshed"`
+		DBs       []RegisteredDB `json:"dbs"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Refreshed == nil || !body.Refreshed.Equal(clock.Now()) {
+		t.Errorf("refreshed = %v, want %v", body.Refreshed, clock.Now())
+	}
+	if len(body.DBs) != 1 || body.DBs[0].LastCollectedStats == nil || body.DBs[0].LastCollectedStats.OpenConnections != 2 {
+		t.Errorf("dbs = %+v, want main with 2 open connections collected", body.DBs)
+	}
+
+	// The scrapes after serve the refresh the handler made
+	families = gather(t, c)
+	assertValue(t, families, "connections_open", labels, 2)
+	assertValue(t, families, "sqlmetrics_last_refresh_timestamp_seconds", nil, float64(clock.Now().Unix()))
+}
+
+func TestRefreshWithoutStart(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, RefreshInterval: time.Minute, DurationUnit: Milliseconds})
+	clock := newFakeClock(c)
+	p := sqlmetricstest.NewFakeProvider(sql.DBStats{OpenConnections: 1})
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"db": "main"}
+
+	assertValue(t, gather(t, c), "connections_open", labels, 1)
+	p.Set(sql.DBStats{OpenConnections: 2})
+	clock.Advance(time.Second)
+	assertValue(t, gather(t, c), "connections_open", labels, 1)
+
+	// Once RefreshInterval passes, a scrape refreshes the metrics itself
+	clock.Advance(time.Minute)
+	families := gather(t, c)
+	assertValue(t, families, "connections_open", labels, 2)
+	// The timestamp stays in seconds whatever the DurationUnit
+	assertValue(t, families, "sqlmetrics_last_refresh_timestamp_seconds", nil, float64(clock.Now().Unix()))
+}
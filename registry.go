@@ -0,0 +1,74 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry bundles a Collector with a prometheus.Registry that it is
+// registered with, for programs that only need to expose DB metrics.
+type Registry struct {
+	reg *prometheus.Registry
+	c   *Collector
+}
+
+// NewRegistry returns a Registry whose Collector is built from o
+func NewRegistry(o Options) *Registry {
+	c := NewCollector(o)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	return &Registry{reg: reg, c: c}
+}
+
+// Register adds db to the Collector
+func (r *Registry) Register(db *sql.DB, labelValues []string) error {
+	return r.c.RegisterDB(db, labelValues)
+}
+
+// Unregister removes db from the Collector, reporting whether it was registered
+func (r *Registry) Unregister(db *sql.DB) bool {
+	return r.c.UnregisterDB(db)
+}
+
+// Handler returns an http.Handler serving the registry's metrics. It
+// negotiates the OpenMetrics format, which carries exemplars, when
+// Options.ExemplarFromContext is set.
+func (r *Registry) Handler() http.Handler {
+	return handlerFor(r.reg, r.c)
+}
+
+// MetricsPath is the path ListenAndServe serves the metrics on
+const MetricsPath = "/metrics"
+
+// Handler returns an http.Handler serving the metrics of Default, so small
+// tools can expose their DBs' metrics without importing promhttp.
+func Handler() http.Handler {
+	return HandlerFor(Default())
+}
+
+// HandlerFor returns an http.Handler serving the metrics of c from a
+// registry of its own, without the Go runtime and process metrics of
+// prometheus.DefaultRegisterer.
+func HandlerFor(c *Collector) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	return handlerFor(reg, c)
+}
+
+// ListenAndServe serves Handler on MetricsPath at addr, returning once the
+// server fails, as http.ListenAndServe does.
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+func handlerFor(reg *prometheus.Registry, c *Collector) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		EnableOpenMetrics:                   c.o.ExemplarFromContext != nil || c.o.OpenMetrics,
+		EnableOpenMetricsTextCreatedSamples: c.o.OpenMetrics,
+	})
+}
@@ -0,0 +1,163 @@
+package sqlmetrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the body h serves for a scrape
+func scrape(t testing.TB, h http.Handler) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", MetricsPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape returned %d", rec.Code)
+	}
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestRegistryLifecycle(t *testing.T) {
+	r := NewRegistry(Options{Labels: []string{"db"}})
+	h := r.Handler()
+	if body := scrape(t, h); strings.Contains(body, "connections_open{") {
+		t.Errorf("scrape before registering a DB has a DB series:\n%s", body)
+	}
+
+	db := openTestDB(t)
+	if err := r.Register(db, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(db, []string{"main"}); err != ErrAlreadyRegistered {
+		t.Errorf("registering twice = %v, want ErrAlreadyRegistered", err)
+	}
+	if body := scrape(t, h); !strings.Contains(body, `connections_open{db="main"} 0`) {
+		t.Errorf("scrape is missing the registered DB:\n%s", body)
+	}
+
+	if !r.Unregister(db) {
+		t.Error("Unregister of a registered DB returned false")
+	}
+	if r.Unregister(db) {
+		t.Error("Unregister of an unregistered DB returned true")
+	}
+	if body := scrape(t, h); strings.Contains(body, `db="main"`) {
+		t.Errorf("scrape after unregistering still has the DB:\n%s", body)
+	}
+}
+
+func TestOpenMetricsOutput(t *testing.T) {
+	c := NewCollector(Options{
+		Labels:        []string{"db", "az"},
+		ConstLabels:   map[string]string{"zone": "b", "app": "billing"},
+		OpenMetrics:   true,
+		EmitStartTime: true,
+	})
+	if err := c.RegisterDB(openTestDB(t), []string{"main", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterDBWithConstLabels(openTestDB(t), []string{"replica", "2"}, map[string]string{"cluster": "c2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", MetricsPath, nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	HandlerFor(c).ServeHTTP(rec, req)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Fatalf("Content-Type = %q, want OpenMetrics", ct)
+	}
+
+	sample := regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})? (\S+)(?: \S+)?$`)
+	label := regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\.)*)"`)
+	typed := map[string]bool{}
+	lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	if lines[len(lines)-1] != "# EOF" {
+		t.Errorf("output doesn't end with # EOF:\n%s", rec.Body)
+	}
+	for _, line := range lines[:len(lines)-1] {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "#" {
+			if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE" && fields[1] != "UNIT") {
+				t.Errorf("malformed metadata line %q", line)
+			} else if fields[1] == "TYPE" {
+				typed[fields[2]] = true
+			}
+			continue
+		}
+		m := sample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("malformed sample line %q", line)
+			continue
+		}
+		typedFamily := typed[m[1]]
+		for _, suffix := range []string{"_total", "_created", "_bucket", "_count", "_sum"} {
+			if family, ok := strings.CutSuffix(m[1], suffix); ok && typed[family] {
+				typedFamily = true
+			}
+		}
+		if !typedFamily {
+			t.Errorf("sample %q has no TYPE before it", line)
+		}
+		if _, err := strconv.ParseFloat(m[3], 64); err != nil {
+			t.Errorf("sample %q has value %q: %v", line, m[3], err)
+		}
+		// The label names of every sample are sorted, whichever of
+		// Labels, ConstLabels and the DB's const labels they come from
+		var names, pairs []string
+		for _, lp := range label.FindAllStringSubmatch(m[2], -1) {
+			pairs = append(pairs, lp[0])
+			if lp[1] != "le" {
+				names = append(names, lp[1])
+			}
+		}
+		if strings.Join(pairs, ",") != m[2] {
+			t.Errorf("sample %q has malformed labels", line)
+		}
+		if !sort.StringsAreSorted(names) {
+			t.Errorf("sample %q has unsorted label names %q", line, names)
+		}
+	}
+	if !strings.Contains(rec.Body.String(), `connections_open{app="billing",az="2",cluster="c2",db="replica",zone="b"} 0`) {
+		t.Errorf("output has no sorted connections_open of the replica:\n%s", rec.Body)
+	}
+}
+
+func TestOpenMetricsWaitHistogram(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}, OpenMetrics: true, WaitDurationBuckets: []float64{0.1, 1}})
+	if err := c.RegisterDB(openTestDB(t), []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", MetricsPath, nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	HandlerFor(c).ServeHTTP(rec, req)
+
+	// The histogram and the wait duration counter are separate families
+	types := map[string]string{}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" {
+			if _, ok := types[fields[2]]; ok {
+				t.Errorf("family %s has more than one TYPE", fields[2])
+			}
+			types[fields[2]] = fields[3]
+		}
+	}
+	for family, want := range map[string]string{
+		"connections_wait_seconds":          "histogram",
+		"connections_wait_duration_seconds": "counter",
+	} {
+		if got := types[family]; got != want {
+			t.Errorf("family %s has TYPE %q, want %q:\n%s", family, got, want, rec.Body)
+		}
+	}
+}
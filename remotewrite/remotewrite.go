@@ -0,0 +1,259 @@
+// Package remotewrite periodically pushes the metrics of a
+// sqlmetrics.Collector to a Prometheus remote_write endpoint, for
+// serverless functions and batch jobs that have no scrape target. It
+// speaks version 1.0 of the remote write protocol: snappy compressed
+// protobuf WriteRequests.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// Defaults of the Options that aren't set
+const (
+	DefaultInterval   = 15 * time.Second
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+)
+
+// Options for the Writer
+type Options struct {
+	// URL is the remote_write endpoint, such as
+	// http://prometheus:9090/api/v1/write
+	URL string
+	// Client makes the requests, http.DefaultClient if unset
+	Client *http.Client
+	// Headers are added to every request, such as Authorization or a
+	// tenant header like X-Scope-OrgID
+	Headers map[string]string
+	// Labels are added to every series, such as job and instance, which
+	// remote_write doesn't add the way scrapes do
+	Labels map[string]string
+
+	// Interval is the time between writes, DefaultInterval if unset
+	Interval time.Duration
+	// MaxRetries is how many times a write that failed with a network
+	// error, a 5xx or a 429 is retried, DefaultMaxRetries if 0, and never
+	// if negative
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled on every retry
+	// up to MaxBackoff. They are DefaultBackoff and DefaultMaxBackoff if
+	// unset.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Writer writes the collector's metrics to a remote_write endpoint
+type Writer struct {
+	o   Options
+	reg *prometheus.Registry
+	now func() time.Time
+}
+
+// NewWriter returns a Writer of c. The collector is collected by each
+// write, so it shouldn't also be scraped.
+func NewWriter(c *sqlmetrics.Collector, o Options) *Writer {
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = DefaultMaxRetries
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = DefaultBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = DefaultMaxBackoff
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	return &Writer{o: o, reg: reg, now: time.Now}
+}
+
+// Run writes every Options.Interval until ctx is done, then writes a final
+// time and returns that write's error. Call it for the lifetime of the
+// process and cancel ctx on shutdown, once the DBs' final stats are in.
+func (w *Writer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.o.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return w.Write(context.Background())
+		case <-ticker.C:
+			w.Write(ctx)
+		}
+	}
+}
+
+// Write gathers the current metrics and writes them, retrying per the
+// Options
+func (w *Writer) Write(ctx context.Context) error {
+	mfs, err := w.reg.Gather()
+	if err != nil {
+		return err
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(w.timeSeries(mfs)))
+
+	backoff := w.o.Backoff
+	for retry := 0; ; retry++ {
+		retryable, err := w.send(ctx, body)
+		if err == nil || !retryable || retry >= w.o.MaxRetries {
+			return err
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		backoff = min(2*backoff, w.o.MaxBackoff)
+	}
+}
+
+// send posts body once, reporting whether a failure may be retried
+func (w *Writer) send(ctx context.Context, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.o.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for name, v := range w.o.Headers {
+		req.Header.Set(name, v)
+	}
+	resp, err := w.o.Client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote write to %s failed with %s: %s", w.o.URL, resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// series is a time series of a WriteRequest with a single sample
+type series struct {
+	labels []label
+	value  float64
+}
+
+type label struct {
+	name, value string
+}
+
+// timeSeries flattens the metric families into series timestamped now,
+// histograms and summaries into their _bucket or quantile, _sum and
+// _count series
+func (w *Writer) timeSeries(mfs []*dto.MetricFamily) ([]series, int64) {
+	var ss []series
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			add := func(suffix string, v float64, extra ...label) {
+				labels := make([]label, 0, len(m.GetLabel())+len(w.o.Labels)+len(extra)+1)
+				labels = append(labels, label{"__name__", name + suffix})
+				for n, v := range w.o.Labels {
+					labels = append(labels, label{n, v})
+				}
+				for _, lp := range m.GetLabel() {
+					labels = append(labels, label{lp.GetName(), lp.GetValue()})
+				}
+				labels = append(labels, extra...)
+				// Remote write requires labels sorted by name
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				ss = append(ss, series{labels: labels, value: v})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())})
+				}
+				add("_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"})
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			default:
+				add("", m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return ss, w.now().UnixMilli()
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes the protobuf WriteRequest of the series with
+// their samples at timestamp:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(ss []series, timestamp int64) []byte {
+	var req, ts, msg []byte
+	for _, s := range ss {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
@@ -0,0 +1,295 @@
+// Package replicationmetrics probes the replication lag of MySQL and
+// Postgres replica DBs registered with a sqlmetrics.Collector, with the
+// same metric naming and labels.
+package replicationmetrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// DefaultInterval is the Options.Interval used when it is 0
+const DefaultInterval = 15 * time.Second
+
+// Dialect is the database of a replica, which determines how its lag is
+// measured
+type Dialect int
+
+const (
+	// MySQL replicas report Seconds_Behind_Source from SHOW REPLICA STATUS,
+	// or Seconds_Behind_Master from SHOW SLAVE STATUS before MySQL 8.0.22
+	MySQL Dialect = iota
+	// Postgres standbys report the time since the last replayed
+	// transaction, pg_last_xact_replay_timestamp, or 0 once they have
+	// replayed all the WAL they received
+	Postgres
+)
+
+// postgresLagQuery is NULL on primaries
+const postgresLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() THEN NULL
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+END`
+
+// errNotReplica is returned by the lag queries of DBs that aren't
+// replicating
+var errNotReplica = errors.New("not replicating")
+
+// Options configures a Collector
+type Options struct {
+	// Interval is how often Start probes the registered replicas
+	Interval time.Duration
+	// Timeout bounds each probe. 0 means Interval.
+	Timeout time.Duration
+}
+
+// Collector emits the replication lag of registered replicas, named and
+// labeled per the Options of their sqlmetrics.Collector. Lags are probed in
+// the background between Start and Stop, and replicas that aren't
+// replicating, or whose latest probe failed, have no lag.
+type Collector struct {
+	o        sqlmetrics.Options
+	interval time.Duration
+	timeout  time.Duration
+
+	lag         *prometheus.Desc
+	probeErrors *prometheus.CounterVec
+
+	l   sync.RWMutex
+	dbs map[*sql.DB]*replica
+
+	runMu sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// replica is a registered replica and the result of its latest probe
+type replica struct {
+	dialect     Dialect
+	labelValues []string
+
+	mu    sync.Mutex
+	lag   time.Duration
+	lagOK bool
+}
+
+// NewCollector returns a collector for the given options
+func NewCollector(o sqlmetrics.Options, ro Options) *Collector {
+	if ro.Interval <= 0 {
+		ro.Interval = DefaultInterval
+	}
+	if ro.Timeout <= 0 {
+		ro.Timeout = ro.Interval
+	}
+	return &Collector{
+		o:        o,
+		interval: ro.Interval,
+		timeout:  ro.Timeout,
+		lag: prometheus.NewDesc(
+			o.MetricName("replication_lag_seconds"),
+			o.Help("replication_lag_seconds", "How far the replica was behind its primary at the latest probe in seconds"),
+			o.Labels, o.ConstLabels,
+		),
+		probeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("replication_lag_probe_errors_total"),
+			Help:        o.Help("replication_lag_probe_errors_total", "The total number of probes that failed to query the replica's lag"),
+			ConstLabels: o.ConstLabels,
+		}, o.Labels),
+		dbs: make(map[*sql.DB]*replica),
+	}
+}
+
+// Register adds the replica db of the given dialect to the collector with
+// the given label values
+func (c *Collector) Register(db *sql.DB, dialect Dialect, labelValues []string) error {
+	if len(labelValues) != len(c.o.Labels) {
+		return fmt.Errorf("expected %d label values %v, got %d", len(c.o.Labels), c.o.Labels, len(labelValues))
+	}
+	if dialect != MySQL && dialect != Postgres {
+		return fmt.Errorf("unknown dialect %d", dialect)
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if _, ok := c.dbs[db]; ok {
+		return sqlmetrics.ErrAlreadyRegistered
+	}
+	c.dbs[db] = &replica{dialect: dialect, labelValues: append([]string(nil), labelValues...)}
+	return nil
+}
+
+// Unregister removes db from the collector, reporting whether it was
+// registered
+func (c *Collector) Unregister(db *sql.DB) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	_, ok := c.dbs[db]
+	delete(c.dbs, db)
+	return ok
+}
+
+// Start starts probing the registered replicas each Options.Interval,
+// starting right away. It does nothing if probing is already running.
+func (c *Collector) Start() {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.run(c.stop, c.done)
+}
+
+// Stop stops probing, waiting for the probe in progress to finish
+func (c *Collector) Stop() {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
+	c.stop = nil
+	c.done = nil
+}
+
+func (c *Collector) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.probe()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe probes every registered replica concurrently
+func (c *Collector) probe() {
+	c.l.RLock()
+	dbs := make(map[*sql.DB]*replica, len(c.dbs))
+	for db, r := range c.dbs {
+		dbs[db] = r
+	}
+	c.l.RUnlock()
+
+	var wg sync.WaitGroup
+	for db, r := range dbs {
+		wg.Add(1)
+		go func(db *sql.DB, r *replica) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			defer cancel()
+			lag, err := queryLag(ctx, db, r.dialect)
+			if err != nil && !errors.Is(err, errNotReplica) {
+				c.probeErrors.WithLabelValues(r.labelValues...).Inc()
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.lag, r.lagOK = lag, err == nil
+		}(db, r)
+	}
+	wg.Wait()
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.lag
+	c.probeErrors.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	for _, r := range c.dbs {
+		r.mu.Lock()
+		lag, ok := r.lag, r.lagOK
+		r.mu.Unlock()
+		if ok {
+			ch <- prometheus.MustNewConstMetric(c.lag, prometheus.GaugeValue, c.o.Duration(lag), r.labelValues...)
+		}
+	}
+	c.probeErrors.Collect(ch)
+}
+
+// queryLag returns the replication lag of db, or errNotReplica if it isn't
+// replicating
+func queryLag(ctx context.Context, db *sql.DB, dialect Dialect) (time.Duration, error) {
+	if dialect == Postgres {
+		var lag sql.NullFloat64
+		if err := db.QueryRowContext(ctx, postgresLagQuery).Scan(&lag); err != nil {
+			return 0, err
+		}
+		if !lag.Valid {
+			return 0, errNotReplica
+		}
+		return time.Duration(lag.Float64 * float64(time.Second)), nil
+	}
+
+	lag, err := mysqlLag(ctx, db, "SHOW REPLICA STATUS", "Seconds_Behind_Source")
+	if err != nil && !errors.Is(err, errNotReplica) {
+		// Before MySQL 8.0.22
+		lag, err = mysqlLag(ctx, db, "SHOW SLAVE STATUS", "Seconds_Behind_Master")
+	}
+	return lag, err
+}
+
+// mysqlLag returns the column of the replica status of query
+func mysqlLag(ctx context.Context, db *sql.DB, query, column string) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	idx := -1
+	for i, name := range columns {
+		if strings.EqualFold(name, column) {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return 0, fmt.Errorf("%s has no %s column", query, column)
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, errNotReplica
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	// NULL while replication isn't running
+	if values[idx] == nil {
+		return 0, errNotReplica
+	}
+	seconds, err := strconv.ParseFloat(string(values[idx]), 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,145 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultRetryAttempts is the RetryPolicy.MaxAttempts used when it is 0
+const DefaultRetryAttempts = 3
+
+// DefaultRetryBackoff is the first backoff of RetryPolicy.Backoff's
+// default, which doubles it on every retry up to MaxRetryBackoff
+const DefaultRetryBackoff = 50 * time.Millisecond
+
+// MaxRetryBackoff is the longest backoff of RetryPolicy.Backoff's default
+const MaxRetryBackoff = 5 * time.Second
+
+// RetryPolicy configures a Retrier
+type RetryPolicy struct {
+	// MaxAttempts is how many times an operation is attempted before its
+	// error is returned, DefaultRetryAttempts if unset
+	MaxAttempts int
+	// Backoff returns how long to wait before retrying for the retry-th
+	// time. It defaults to DefaultRetryBackoff doubled on every retry, up
+	// to MaxRetryBackoff.
+	Backoff func(retry int) time.Duration
+	// Retryable reports whether an operation that failed with err may be
+	// retried. It defaults to RetryableError.
+	Retryable func(err error) bool
+}
+
+// RetryableError is the default RetryPolicy.Retryable. It retries
+// driver.ErrBadConn and transaction rollback errors, SQLSTATE class 40,
+// such as serialization failures and deadlocks.
+func RetryableError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var sqlState interface{ SQLState() string }
+	if errors.As(err, &sqlState) {
+		state := sqlState.SQLState()
+		return len(state) == 5 && state[:2] == "40"
+	}
+	return false
+}
+
+// Retrier runs the queries and execs of a DB, retrying them per its
+// RetryPolicy, and counts the retries in query_retries_total and the
+// operations that still failed after their last attempt in
+// retry_exhausted_total, labeled by the DB's label values and the method.
+// Operations whose context is done are not retried.
+type Retrier struct {
+	db          *sql.DB
+	p           RetryPolicy
+	retries     *prometheus.CounterVec
+	exhausted   *prometheus.CounterVec
+	labelValues []string
+}
+
+// NewRetrier returns a Retrier of db with the given label values
+func (c *Collector) NewRetrier(db *sql.DB, p RetryPolicy, labelValues []string) (*Retrier, error) {
+	if len(labelValues) != len(c.o.Labels) {
+		return nil, fmt.Errorf("expected %d label values %v, got %d", len(c.o.Labels), c.o.Labels, len(labelValues))
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryAttempts
+	}
+	if p.Backoff == nil {
+		p.Backoff = defaultBackoff
+	}
+	if p.Retryable == nil {
+		p.Retryable = RetryableError
+	}
+	return &Retrier{
+		db:          db,
+		p:           p,
+		retries:     c.q.retries,
+		exhausted:   c.q.retryExhausted,
+		labelValues: append([]string(nil), labelValues...),
+	}, nil
+}
+
+// defaultBackoff is RetryPolicy.Backoff's default. It doubles rather than
+// shifts, which would overflow for the retries of a large MaxAttempts.
+func defaultBackoff(retry int) time.Duration {
+	d := DefaultRetryBackoff
+	for i := 1; i < retry && d < MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, MaxRetryBackoff)
+}
+
+// ExecContext execs query, retrying it per the policy
+func (r *Retrier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	err := r.Do(ctx, MethodExec, func(ctx context.Context) error {
+		var err error
+		result, err = r.db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+// QueryContext queries query, retrying it per the policy. Only the query
+// itself is retried, not errors reading its rows.
+func (r *Retrier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := r.Do(ctx, MethodQuery, func(ctx context.Context) error {
+		var err error
+		rows, err = r.db.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// Do calls fn, retrying it per the policy, counting its retries with the
+// given MethodLabel value. It returns fn's last error, or ctx's error if
+// ctx is done while backing off.
+func (r *Retrier) Do(ctx context.Context, method string, fn func(ctx context.Context) error) error {
+	labelValues := append(append(make([]string, 0, len(r.labelValues)+1), r.labelValues...), method)
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !r.p.Retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= r.p.MaxAttempts {
+			r.exhausted.WithLabelValues(labelValues...).Inc()
+			return err
+		}
+		t := time.NewTimer(r.p.Backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		r.retries.WithLabelValues(labelValues...).Inc()
+	}
+}
@@ -0,0 +1,132 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetrier(t *testing.T) {
+	errFatal := errors.New("syntax error")
+	for _, test := range []struct {
+		name string
+		// errs are the errors of the attempts, the last one repeating
+		errs              []error
+		attempts, retries int
+		exhausted         bool
+		wantErr           error
+	}{
+		{"success", []error{nil}, 1, 0, false, nil},
+		{"retried", []error{driver.ErrBadConn, driver.ErrBadConn, nil}, 3, 2, false, nil},
+		{"exhausted", []error{driver.ErrBadConn}, 4, 3, true, driver.ErrBadConn},
+		{"not retryable", []error{driver.ErrBadConn, errFatal}, 2, 1, false, errFatal},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewCollector(Options{Labels: []string{"db"}})
+			r, err := c.NewRetrier(openTestDB(t), RetryPolicy{
+				MaxAttempts: 4,
+				Backoff:     func(int) time.Duration { return time.Millisecond },
+			}, []string{"main"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			attempts := 0
+			err = r.Do(context.Background(), MethodExec, func(context.Context) error {
+				err := test.errs[min(attempts, len(test.errs)-1)]
+				attempts++
+				return err
+			})
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("Do = %v, want %v", err, test.wantErr)
+			}
+			if attempts != test.attempts {
+				t.Errorf("%d attempts, want %d", attempts, test.attempts)
+			}
+
+			families := gather(t, c)
+			labels := map[string]string{"db": "main", "method": MethodExec}
+			if test.retries > 0 {
+				assertValue(t, families, "query_retries_total", labels, float64(test.retries))
+			} else {
+				assertAbsent(t, families, "query_retries_total", labels)
+			}
+			if test.exhausted {
+				assertValue(t, families, "retry_exhausted_total", labels, 1)
+			} else {
+				assertAbsent(t, families, "retry_exhausted_total", labels)
+			}
+		})
+	}
+}
+
+func TestRetrierCanceledWhileBackingOff(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	r, err := c.NewRetrier(openTestDB(t), RetryPolicy{
+		Backoff: func(int) time.Duration { return time.Hour },
+	}, []string{"main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err = r.Do(ctx, MethodQuery, func(context.Context) error {
+		attempts++
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return driver.ErrBadConn
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do = %v, want context.Canceled", err)
+	}
+	if attempts != 1 {
+		t.Errorf("%d attempts, want 1", attempts)
+	}
+	families := gather(t, c)
+	labels := map[string]string{"db": "main", "method": MethodQuery}
+	assertAbsent(t, families, "query_retries_total", labels)
+	assertAbsent(t, families, "retry_exhausted_total", labels)
+
+	// Operations whose context is done aren't retried
+	attempts = 0
+	if err := r.Do(ctx, MethodQuery, func(context.Context) error {
+		attempts++
+		return driver.ErrBadConn
+	}); !errors.Is(err, driver.ErrBadConn) || attempts != 1 {
+		t.Errorf("Do with a done context = %v after %d attempts, want driver.ErrBadConn after 1", err, attempts)
+	}
+}
+
+func TestRetrierDefaults(t *testing.T) {
+	c := NewCollector(Options{Labels: []string{"db"}})
+	if _, err := c.NewRetrier(openTestDB(t), RetryPolicy{}, nil); err == nil {
+		t.Error("NewRetrier without label values succeeded")
+	}
+	r, err := c.NewRetrier(openTestDB(t), RetryPolicy{}, []string{"main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.p.MaxAttempts != DefaultRetryAttempts {
+		t.Errorf("MaxAttempts = %d, want %d", r.p.MaxAttempts, DefaultRetryAttempts)
+	}
+	for _, test := range []struct {
+		retry int
+		want  time.Duration
+	}{
+		{1, DefaultRetryBackoff},
+		{2, 2 * DefaultRetryBackoff},
+		{3, 4 * DefaultRetryBackoff},
+		{7, 64 * DefaultRetryBackoff},
+		{8, MaxRetryBackoff},
+		// Large retries don't overflow
+		{64, MaxRetryBackoff},
+		{1000, MaxRetryBackoff},
+	} {
+		if got := r.p.Backoff(test.retry); got != test.want {
+			t.Errorf("Backoff(%d) = %v, want %v", test.retry, got, test.want)
+		}
+	}
+	if !r.p.Retryable(driver.ErrBadConn) || r.p.Retryable(errors.New("syntax error")) {
+		t.Error("Retryable isn't RetryableError")
+	}
+}
@@ -0,0 +1,196 @@
+// Package rules generates recommended Prometheus recording and alerting
+// rules for the metrics exported by a sqlmetrics.Collector, named and
+// labeled per the collector's Options so the rules can't drift from what is
+// actually exported.
+package rules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+const (
+	// DefaultGroup is the rule group name of Options that don't set one
+	DefaultGroup = "sqlmetrics"
+	// DefaultSaturationRatio is the Options.SaturationRatio used when it
+	// is 0
+	DefaultSaturationRatio = 0.9
+	// DefaultWaitRatio is the Options.WaitRatio used when it is 0
+	DefaultWaitRatio = 0.1
+	// DefaultFor is the Options.For used when it is 0
+	DefaultFor = 10 * time.Minute
+	// DefaultRateWindow is the Options.RateWindow used when it is 0
+	DefaultRateWindow = 5 * time.Minute
+)
+
+// Options for the rules
+type Options struct {
+	// Group is the name of the rule group, DefaultGroup if unset
+	Group string
+	// SaturationRatio is the ratio of in use to max open connections at
+	// which the pool is saturated. Pools without a max are never saturated.
+	SaturationRatio float64
+	// WaitRatio is the seconds spent waiting for connections per second
+	// above which waits are alerted on, whatever the DurationUnit
+	WaitRatio float64
+	// For is how long alert conditions must hold before they fire
+	For time.Duration
+	// RateWindow is the range of the rates of counters
+	RateWindow time.Duration
+	// Labels are added to every alert, such as a severity
+	Labels map[string]string
+}
+
+// rule is a recording rule if record is set, otherwise an alerting rule
+type rule struct {
+	record      string
+	alert       string
+	expr        string
+	labels      map[string]string
+	annotations map[string]string
+}
+
+// Rules returns a rule file of a group of the recording rules of the
+// pools' utilization and wait rates, and alerting rules of saturated
+// pools, sustained connection waits and, if o.PingInterval is set, DBs that
+// are down.
+func Rules(o sqlmetrics.Options, ro Options) []byte {
+	if ro.Group == "" {
+		ro.Group = DefaultGroup
+	}
+	if ro.SaturationRatio <= 0 {
+		ro.SaturationRatio = DefaultSaturationRatio
+	}
+	if ro.WaitRatio <= 0 {
+		ro.WaitRatio = DefaultWaitRatio
+	}
+	if ro.For <= 0 {
+		ro.For = DefaultFor
+	}
+	if ro.RateWindow <= 0 {
+		ro.RateWindow = DefaultRateWindow
+	}
+
+	window := duration(ro.RateWindow)
+	utilization := "db:" + o.MetricName("connections_utilization") + ":ratio"
+	waitRate := "db:" + o.MetricName("connections_wait_duration_seconds") + ":rate" + window
+	rate := func(name string) string {
+		return "rate(" + o.MetricName(name) + "[" + window + "])"
+	}
+	db := describe(o.Labels)
+	unit := "s"
+	if o.DurationUnit == sqlmetrics.Milliseconds {
+		unit = "ms"
+	}
+
+	rules := []rule{
+		{
+			record: utilization,
+			// A max of 0 is unlimited
+			expr: o.MetricName("connections_in_use") + " / (" + o.MetricName("connections_max") + " > 0)",
+		},
+		{
+			record: waitRate,
+			expr:   rate("connections_wait_duration_seconds_total"),
+		},
+		{
+			record: "db:" + o.MetricName("connections_wait_count") + ":rate" + window,
+			expr:   rate("connections_wait_count_total"),
+		},
+		{
+			alert:  "SQLPoolSaturated",
+			expr:   utilization + " >= " + strconv.FormatFloat(ro.SaturationRatio, 'g', -1, 64),
+			labels: ro.Labels,
+			annotations: map[string]string{
+				"summary":     "SQL connection pool saturated",
+				"description": "The pool" + db + " has had {{ $value | humanizePercentage }} of its max connections in use for " + duration(ro.For) + ".",
+			},
+		},
+		{
+			alert:  "SQLPoolSustainedWait",
+			expr:   waitRate + " > " + strconv.FormatFloat(o.Duration(time.Duration(ro.WaitRatio*float64(time.Second))), 'g', -1, 64),
+			labels: ro.Labels,
+			annotations: map[string]string{
+				"summary":     "SQL connection pool waits",
+				"description": "Queries of the pool" + db + " have waited {{ $value | humanize }}" + unit + " per second for connections for " + duration(ro.For) + ".",
+			},
+		},
+	}
+	if o.PingInterval > 0 {
+		rules = append(rules, rule{
+			alert:  "SQLDatabaseDown",
+			expr:   o.MetricName("db_up") + " == 0",
+			labels: ro.Labels,
+			annotations: map[string]string{
+				"summary":     "SQL database down",
+				"description": "Pings of the database" + db + " have failed for " + duration(ro.For) + ".",
+			},
+		})
+	}
+
+	var b strings.Builder
+	b.WriteString("groups:\n")
+	fmt.Fprintf(&b, "  - name: %s\n", strconv.Quote(ro.Group))
+	b.WriteString("    rules:\n")
+	for _, r := range rules {
+		if r.record != "" {
+			fmt.Fprintf(&b, "      - record: %s\n", r.record)
+		} else {
+			fmt.Fprintf(&b, "      - alert: %s\n", r.alert)
+		}
+		fmt.Fprintf(&b, "        expr: %s\n", strconv.Quote(r.expr))
+		if r.alert != "" {
+			fmt.Fprintf(&b, "        for: %s\n", duration(ro.For))
+		}
+		writeMap(&b, "labels", r.labels)
+		writeMap(&b, "annotations", r.annotations)
+	}
+	return []byte(b.String())
+}
+
+// describe returns the DB of an alert's description, by its labels
+func describe(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	values := make([]string, len(labels))
+	for i, label := range labels {
+		values[i] = label + "={{ $labels." + label + " }}"
+	}
+	return " " + strings.Join(values, " ")
+}
+
+// writeMap writes the map m of a rule as the field key, sorted by key
+func writeMap(b *strings.Builder, key string, m map[string]string) {
+	if len(m) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(b, "        %s:\n", key)
+	for _, k := range keys {
+		fmt.Fprintf(b, "          %s: %s\n", k, strconv.Quote(m[k]))
+	}
+}
+
+// duration formats d as a Prometheus duration
+func duration(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	}
+	if d%time.Minute == 0 {
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	}
+	if d%time.Second == 0 {
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	}
+	return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+}
@@ -0,0 +1,110 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Start starts the background sampler, which reads the stats of every
+// registered DB each Options.SampleInterval so that the peak gauges catch
+// spikes between scrapes, the wait histogram sees shorter intervals and
+// Options.StatsHistory records them, the prober, which pings them each
+// Options.PingInterval, and the refresher, which collects them each
+// Options.RefreshInterval. It starts none of them without their interval,
+// and does nothing if they are already running.
+func (c *Collector) Start() {
+	if c.o.SampleInterval <= 0 && c.o.PingInterval <= 0 && c.o.RefreshInterval <= 0 {
+		return
+	}
+	c.samplerMu.Lock()
+	defer c.samplerMu.Unlock()
+	if c.stopSampler != nil {
+		return
+	}
+	c.stopSampler = make(chan struct{})
+	if c.o.SampleInterval > 0 {
+		c.samplerWG.Add(1)
+		go c.sample(c.stopSampler)
+	}
+	if c.o.PingInterval > 0 {
+		c.samplerWG.Add(1)
+		go c.probe(c.stopSampler)
+	}
+	if c.o.RefreshInterval > 0 {
+		c.samplerWG.Add(1)
+		go c.refreshLoop(c.stopSampler)
+	}
+}
+
+// Stop stops the background sampler, prober and refresher, waiting for
+// them to finish
+func (c *Collector) Stop() {
+	c.samplerMu.Lock()
+	defer c.samplerMu.Unlock()
+	if c.stopSampler == nil {
+		return
+	}
+	close(c.stopSampler)
+	c.samplerWG.Wait()
+	c.stopSampler = nil
+}
+
+func (c *Collector) sample(stop <-chan struct{}) {
+	defer c.samplerWG.Done()
+	ticker := time.NewTicker(c.o.SampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		entries := c.entries()
+		for _, e := range entries {
+			if stats, ok := c.readStats(e); ok {
+				e.observePeaks(stats)
+				if c.o.StatsHistory > 0 {
+					e.recordStats(c.now(), stats, c.o.StatsHistory)
+				}
+				if len(c.o.WaitDurationBuckets) > 0 {
+					e.observeWaits(stats, c.o.WaitDurationBuckets, c.o.DurationUnit)
+				}
+			}
+		}
+	}
+}
+
+// observePeaks records stats in the peaks since the previous collection
+func (e *dbEntry) observePeaks(stats sql.DBStats) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.observePeaksLocked(stats)
+}
+
+func (e *dbEntry) observePeaksLocked(stats sql.DBStats) {
+	if stats.InUse > e.peakInUse {
+		e.peakInUse = stats.InUse
+	}
+	if stats.OpenConnections > e.peakOpen {
+		e.peakOpen = stats.OpenConnections
+	}
+	if e.sampledWait && stats.WaitDuration >= e.sampledWaitDur {
+		if wait := stats.WaitDuration - e.sampledWaitDur; wait > e.peakWait {
+			e.peakWait = wait
+		}
+	}
+	e.sampledWaitDur = stats.WaitDuration
+	e.sampledWait = true
+}
+
+// takePeaks records stats, read by a collection, in the peaks and returns
+// them, resetting them for the next collection
+func (e *dbEntry) takePeaks(stats sql.DBStats) (inUse, open int, wait time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.observePeaksLocked(stats)
+	inUse, open, wait = e.peakInUse, e.peakOpen, e.peakWait
+	e.peakInUse, e.peakOpen, e.peakWait = 0, 0, 0
+	return inUse, open, wait
+}
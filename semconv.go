@@ -0,0 +1,37 @@
+package sqlmetrics
+
+import "strings"
+
+// ConnectionStateLabel is the label of db_client_connections_usage with
+// the state of the connections under Options.SemanticConventions
+const ConnectionStateLabel = "state"
+
+// Values of ConnectionStateLabel
+const (
+	ConnectionStateIdle = "idle"
+	ConnectionStateUsed = "used"
+)
+
+// semconvNames are the names of the metrics that have an OpenTelemetry
+// database client semantic convention, as the OpenTelemetry prometheus
+// exporter names them, for Options.SemanticConventions
+var semconvNames = map[string]string{
+	"connections_usage":                     "db_client_connections_usage",
+	"connections_max":                       "db_client_connections_max",
+	"connections_max_idle":                  "db_client_connections_idle_max",
+	"connection_establish_duration_seconds": "db_client_connections_create_time_seconds",
+	"connections_wait_seconds":              "db_client_connections_wait_time_seconds",
+}
+
+// semconvName returns the semantic convention name of the metric name in
+// the DurationUnit, if it has one
+func (o Options) semconvName(name string) (string, bool) {
+	semconv, ok := semconvNames[name]
+	if !ok || !o.SemanticConventions {
+		return "", false
+	}
+	if o.DurationUnit == Milliseconds && strings.HasSuffix(semconv, "_seconds") {
+		semconv = strings.TrimSuffix(semconv, "_seconds") + "_milliseconds"
+	}
+	return semconv, true
+}
@@ -0,0 +1,99 @@
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SlowQuery is a query or exec of a wrapped driver that took at least
+// Options.SlowQueryThreshold
+type SlowQuery struct {
+	// Method is MethodQuery or MethodExec
+	Method string
+	// Query is the query, fingerprinted if Options.SlowQueryFingerprint is
+	// set and truncated to Options.SlowQueryMaxLength
+	Query string
+	// Duration is how long the query took
+	Duration time.Duration
+	// Labels maps each of Options.Labels to the label value the driver was
+	// wrapped with. It must not be modified.
+	Labels map[string]string
+	// Err is the error the query returned, if any
+	Err error
+}
+
+// slowQueries counts and reports the slow queries of wrapped drivers
+type slowQueries struct {
+	threshold   time.Duration
+	maxLength   int
+	fingerprint bool
+	hook        func(context.Context, SlowQuery)
+	events      *eventBus
+
+	total *prometheus.CounterVec
+}
+
+// newSlowQueries returns the slowQueries of o, publishing them to events,
+// or nil if o.SlowQueryThreshold isn't set
+func newSlowQueries(o Options, events *eventBus) *slowQueries {
+	if o.SlowQueryThreshold <= 0 {
+		return nil
+	}
+	return &slowQueries{
+		threshold:   o.SlowQueryThreshold,
+		maxLength:   o.SlowQueryMaxLength,
+		fingerprint: o.SlowQueryFingerprint,
+		hook:        o.OnSlowQuery,
+		events:      events,
+		total: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("slow_queries_total"),
+			Help:        o.Help("slow_queries_total", "The total number of queries and execs that took at least the slow query threshold"),
+			ConstLabels: o.metricConstLabels("slow_queries_total"),
+		}, append(append([]string(nil), o.Labels...), MethodLabel)),
+	}
+}
+
+// observe counts e, and calls the hook with it and publishes it, if it was
+// a slow query or exec
+func (s *slowQueries) observe(ctx context.Context, labelValues []string, e QueryEvent, err error) {
+	if s == nil || e.Duration < s.threshold || e.Method != MethodQuery && e.Method != MethodExec || errors.Is(err, driver.ErrSkip) {
+		return
+	}
+	s.total.WithLabelValues(append(append(make([]string, 0, len(labelValues)+1), labelValues...), e.Method)...).Inc()
+	if s.hook == nil && !s.events.active() {
+		return
+	}
+	query := e.Query
+	if s.fingerprint {
+		query = Fingerprint(query)
+	}
+	if s.maxLength > 0 && len(query) > s.maxLength {
+		n := s.maxLength
+		for n > 0 && !utf8.RuneStart(query[n]) {
+			n--
+		}
+		query = query[:n]
+	}
+	if s.hook != nil {
+		s.hook(ctx, SlowQuery{
+			Method:   e.Method,
+			Query:    query,
+			Duration: e.Duration,
+			Labels:   e.Labels,
+			Err:      err,
+		})
+	}
+	s.events.publish(Event{
+		Type:     EventSlowQuery,
+		Labels:   e.Labels,
+		Duration: e.Duration,
+		Method:   e.Method,
+		Query:    query,
+		Err:      err,
+	})
+}
@@ -0,0 +1,108 @@
+package sqlmetrics
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DBSnapshot is the stats of a registered DB at one point in time
+type DBSnapshot struct {
+	// Labels maps each of Options.Labels, or of the labels of the DB's
+	// LabelGroup, to the DB's label value
+	Labels map[string]string
+	Stats  sql.DBStats
+}
+
+// Snapshot reads the stats of every registered DB, in collection order,
+// for exporters other than prometheus. Unlike Collect it doesn't touch
+// the per-DB state kept between collections, so it can be called at any
+// rate alongside scrapes. DBs whose stats can't be read are left out.
+func (c *Collector) Snapshot() []DBSnapshot {
+	samples := c.readSnapshot()
+	snapshots := make([]DBSnapshot, len(samples))
+	for i, s := range samples {
+		snapshots[i] = DBSnapshot{Labels: c.entryLabelMap(s.entry, s.labelValues), Stats: s.stats}
+	}
+	return snapshots
+}
+
+// labelMap maps each of Options.Labels to its value in labelValues
+func (c *Collector) labelMap(labelValues []string) map[string]string {
+	return labelMapOf(c.o.Labels, labelValues)
+}
+
+// entryLabelMap maps each of the labels of e to its value in labelValues
+func (c *Collector) entryLabelMap(e *dbEntry, labelValues []string) map[string]string {
+	return labelMapOf(c.entryLabels(e), labelValues)
+}
+
+// entryLabels returns the label names of e
+func (c *Collector) entryLabels(e *dbEntry) []string {
+	if e.labelNames != nil {
+		return e.labelNames
+	}
+	return c.o.Labels
+}
+
+func labelMapOf(names, labelValues []string) map[string]string {
+	labels := make(map[string]string, len(names))
+	for i, name := range names {
+		labels[name] = labelValues[i]
+	}
+	return labels
+}
+
+// readSnapshot reads the stats of every registered DB as Snapshot does
+func (c *Collector) readSnapshot() []*sample {
+	var samples []*sample
+	for _, e := range c.entries() {
+		stats, ok := c.readStats(e)
+		if !ok {
+			continue
+		}
+		labelValues := c.refreshLabels(e)
+		if e.stateFn != nil {
+			labelValues[e.stateIdx] = c.state(e, stats)
+		}
+		m := c.m
+		if e.m != nil {
+			m = e.m
+		}
+		samples = append(samples, &sample{
+			entry:       e,
+			m:           m,
+			labelValues: labelValues,
+			stats:       stats,
+			emitted:     stats,
+		})
+	}
+	return samples
+}
+
+// SnapshotCollector returns a prometheus.Collector of the pool gauges and
+// counters of the registered DBs, read as by Snapshot, and the metrics of
+// the collector's wrapped drivers. It keeps no state between collections,
+// so exporters pushing elsewhere can gather it at their own interval
+// without affecting the Collector's scrapes. The metrics that depend on
+// collection history are left out.
+func (c *Collector) SnapshotCollector() prometheus.Collector {
+	return snapshotCollector{c}
+}
+
+type snapshotCollector struct {
+	c *Collector
+}
+
+// Describe sends no Descs, as Collector.Describe doesn't
+func (s snapshotCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (s snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	s.c.pairs.rotate()
+	for _, sample := range s.c.readSnapshot() {
+		cm := s.c.constMetrics(ch, sample.labelValues, sample.entry.registered)
+		cm.emit(sample.m.maxConnsDesc, prometheus.GaugeValue, float64(sample.stats.MaxOpenConnections))
+		s.c.collectStats(cm, sample.m, sample.stats)
+	}
+	s.c.q.collect(ch)
+}
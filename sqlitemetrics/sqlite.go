@@ -0,0 +1,191 @@
+// Package sqlitemetrics reports pragma-derived stats of SQLite DBs
+// registered with a sqlmetrics.Collector, with the same metric naming and
+// labels, since the pool stats say little about an embedded database.
+package sqlitemetrics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// DefaultTimeout is the Options.Timeout used when it is 0
+const DefaultTimeout = 5 * time.Second
+
+// Options configures a Collector
+type Options struct {
+	// Timeout bounds the queries of each DB during a collection
+	Timeout time.Duration
+}
+
+// Collector emits the stats of the main database of registered SQLite DBs,
+// named and labeled per the Options of their sqlmetrics.Collector.
+type Collector struct {
+	o       sqlmetrics.Options
+	timeout time.Duration
+
+	pages        *prometheus.Desc
+	pageSize     *prometheus.Desc
+	freePages    *prometheus.Desc
+	size         *prometheus.Desc
+	walSize      *prometheus.Desc
+	cacheSize    *prometheus.Desc
+	scrapeErrors *prometheus.CounterVec
+
+	l   sync.RWMutex
+	dbs map[*sql.DB][]string
+}
+
+// NewCollector returns a collector for the given options
+func NewCollector(o sqlmetrics.Options, so Options) *Collector {
+	if so.Timeout <= 0 {
+		so.Timeout = DefaultTimeout
+	}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(o.MetricName(name), o.Help(name, help), o.Labels, o.ConstLabels)
+	}
+	return &Collector{
+		o:         o,
+		timeout:   so.Timeout,
+		pages:     desc("sqlite_pages", "The number of pages in the database file, PRAGMA page_count"),
+		pageSize:  desc("sqlite_page_size_bytes", "The size of the database's pages in bytes, PRAGMA page_size"),
+		freePages: desc("sqlite_free_pages", "The number of unused pages in the database file, PRAGMA freelist_count"),
+		size:      desc("sqlite_database_size_bytes", "The size of the database in bytes, its pages times their size"),
+		walSize:   desc("sqlite_wal_size_bytes", "The size of the database's write-ahead log file in bytes"),
+		cacheSize: desc("sqlite_cache_size_bytes", "The suggested maximum size of the page cache of a connection in bytes, PRAGMA cache_size"),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        o.MetricName("sqlite_scrape_errors_total"),
+			Help:        o.Help("sqlite_scrape_errors_total", "The total number of collections that failed to query the database's pragmas"),
+			ConstLabels: o.ConstLabels,
+		}, o.Labels),
+		dbs: make(map[*sql.DB][]string),
+	}
+}
+
+// Register adds db to the collector with the given label values
+func (c *Collector) Register(db *sql.DB, labelValues []string) error {
+	if len(labelValues) != len(c.o.Labels) {
+		return fmt.Errorf("expected %d label values %v, got %d", len(c.o.Labels), c.o.Labels, len(labelValues))
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if _, ok := c.dbs[db]; ok {
+		return sqlmetrics.ErrAlreadyRegistered
+	}
+	c.dbs[db] = append([]string(nil), labelValues...)
+	return nil
+}
+
+// Unregister removes db from the collector, reporting whether it was
+// registered
+func (c *Collector) Unregister(db *sql.DB) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	_, ok := c.dbs[db]
+	delete(c.dbs, db)
+	return ok
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.pages
+	ch <- c.pageSize
+	ch <- c.freePages
+	ch <- c.size
+	ch <- c.walSize
+	ch <- c.cacheSize
+	c.scrapeErrors.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	for db, labelValues := range c.dbs {
+		if err := c.collectDB(ch, db, labelValues); err != nil {
+			c.scrapeErrors.WithLabelValues(labelValues...).Inc()
+		}
+	}
+	c.scrapeErrors.Collect(ch)
+}
+
+func (c *Collector) collectDB(ch chan<- prometheus.Metric, db *sql.DB, labelValues []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var pages, pageSize, freePages, cacheSize int64
+	for _, p := range []struct {
+		pragma string
+		v      *int64
+	}{
+		{"page_count", &pages},
+		{"page_size", &pageSize},
+		{"freelist_count", &freePages},
+		{"cache_size", &cacheSize},
+	} {
+		if err := db.QueryRowContext(ctx, "PRAGMA "+p.pragma).Scan(p.v); err != nil {
+			return err
+		}
+	}
+	// A negative cache_size is in KiB rather than pages
+	cacheBytes := cacheSize * pageSize
+	if cacheSize < 0 {
+		cacheBytes = -cacheSize * 1024
+	}
+	ch <- prometheus.MustNewConstMetric(c.pages, prometheus.GaugeValue, float64(pages), labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.pageSize, prometheus.GaugeValue, float64(pageSize), labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.freePages, prometheus.GaugeValue, float64(freePages), labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(pages*pageSize), labelValues...)
+	ch <- prometheus.MustNewConstMetric(c.cacheSize, prometheus.GaugeValue, float64(cacheBytes), labelValues...)
+
+	var journalMode string
+	if err := db.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		return err
+	}
+	if journalMode != "wal" {
+		return nil
+	}
+	file, err := mainFile(ctx, db)
+	if err != nil {
+		return err
+	}
+	// In-memory and temporary databases have no file
+	if file == "" {
+		return nil
+	}
+	var walSize int64
+	if fi, err := os.Stat(file + "-wal"); err == nil {
+		walSize = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(c.walSize, prometheus.GaugeValue, float64(walSize), labelValues...)
+	return nil
+}
+
+// mainFile returns the file of the main database of db, from PRAGMA
+// database_list
+func mainFile(ctx context.Context, db *sql.DB) (string, error) {
+	rows, err := db.QueryContext(ctx, "PRAGMA database_list")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seq int
+		var name, file string
+		if err := rows.Scan(&seq, &name, &file); err != nil {
+			return "", err
+		}
+		if name == "main" {
+			return file, nil
+		}
+	}
+	return "", rows.Err()
+}
@@ -0,0 +1,38 @@
+// Package sqlmetricstest provides helpers for testing code that feeds
+// sql.DBStats to a sqlmetrics.Collector: a fake StatsProvider of scripted
+// stats, and assertions on the metrics a collector emits.
+package sqlmetricstest
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// AssertMonotonic fails t if any counter field of a DB's stats in b is lower
+// than in a. DBs missing from either snapshot are ignored.
+func AssertMonotonic(t testing.TB, a, b map[*sql.DB]sql.DBStats) {
+	t.Helper()
+
+	for db, before := range a {
+		after, ok := b[db]
+		if !ok {
+			continue
+		}
+
+		counters := []struct {
+			name          string
+			before, after int64
+		}{
+			{"WaitCount", before.WaitCount, after.WaitCount},
+			{"WaitDuration", int64(before.WaitDuration), int64(after.WaitDuration)},
+			{"MaxIdleClosed", before.MaxIdleClosed, after.MaxIdleClosed},
+			{"MaxIdleTimeClosed", before.MaxIdleTimeClosed, after.MaxIdleTimeClosed},
+			{"MaxLifetimeClosed", before.MaxLifetimeClosed, after.MaxLifetimeClosed},
+		}
+		for _, c := range counters {
+			if c.after < c.before {
+				t.Errorf("%p: %s went backwards: %d -> %d", db, c.name, c.before, c.after)
+			}
+		}
+	}
+}
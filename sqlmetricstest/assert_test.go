@@ -0,0 +1,48 @@
+package sqlmetricstest_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/jacksontj/gosqlmetrics/sqlmetricstest"
+)
+
+func TestAssertMonotonic(t *testing.T) {
+	// The DBs are only map keys, so they need no connector
+	db, other := sql.OpenDB(nil), sql.OpenDB(nil)
+	defer db.Close()
+	defer other.Close()
+
+	before := sql.DBStats{WaitCount: 2, WaitDuration: time.Second, MaxIdleClosed: 1, MaxIdleTimeClosed: 1, MaxLifetimeClosed: 1}
+	after := before
+	after.WaitCount++
+	after.MaxLifetimeClosed++
+	// Gauges may go down
+	after.InUse = before.InUse - 1
+
+	sqlmetricstest.AssertMonotonic(t,
+		map[*sql.DB]sql.DBStats{db: before, other: after},
+		map[*sql.DB]sql.DBStats{db: after},
+	)
+
+	for _, tc := range []struct {
+		name  string
+		after func(sql.DBStats) sql.DBStats
+	}{
+		{"WaitCount", func(s sql.DBStats) sql.DBStats { s.WaitCount--; return s }},
+		{"WaitDuration", func(s sql.DBStats) sql.DBStats { s.WaitDuration--; return s }},
+		{"MaxIdleClosed", func(s sql.DBStats) sql.DBStats { s.MaxIdleClosed--; return s }},
+		{"MaxIdleTimeClosed", func(s sql.DBStats) sql.DBStats { s.MaxIdleTimeClosed--; return s }},
+		{"MaxLifetimeClosed", func(s sql.DBStats) sql.DBStats { s.MaxLifetimeClosed--; return s }},
+	} {
+		r := &recorder{TB: t}
+		sqlmetricstest.AssertMonotonic(r,
+			map[*sql.DB]sql.DBStats{db: before},
+			map[*sql.DB]sql.DBStats{db: tc.after(before)},
+		)
+		if !r.failed {
+			t.Errorf("AssertMonotonic passed with %s going backwards", tc.name)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package sqlmetricstest
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// FakeProvider is a sqlmetrics.StatsProvider returning scripted stats, to
+// register with sqlmetrics.Collector.RegisterProvider in place of a real
+// DB. It is safe for concurrent use.
+type FakeProvider struct {
+	mu    sync.Mutex
+	stats []sql.DBStats
+	reads int
+}
+
+// NewFakeProvider returns a FakeProvider whose Stats returns each of stats
+// in turn, then keeps returning the last one. Without stats it returns
+// zero stats until Set or Append is called.
+func NewFakeProvider(stats ...sql.DBStats) *FakeProvider {
+	return &FakeProvider{stats: append([]sql.DBStats(nil), stats...)}
+}
+
+// Stats returns the next scripted stats
+func (p *FakeProvider) Stats() sql.DBStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reads++
+	if len(p.stats) == 0 {
+		return sql.DBStats{}
+	}
+	s := p.stats[0]
+	if len(p.stats) > 1 {
+		p.stats = p.stats[1:]
+	}
+	return s
+}
+
+// Set replaces the scripted stats with stats alone, returned from now on
+func (p *FakeProvider) Set(stats sql.DBStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats = []sql.DBStats{stats}
+}
+
+// Append adds stats to the end of the script
+func (p *FakeProvider) Append(stats ...sql.DBStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats = append(p.stats, stats...)
+}
+
+// Reads returns how many times Stats has been called
+func (p *FakeProvider) Reads() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reads
+}
@@ -0,0 +1,40 @@
+package sqlmetricstest
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestFakeProviderScript(t *testing.T) {
+	p := NewFakeProvider(sql.DBStats{InUse: 1}, sql.DBStats{InUse: 2})
+	for i, want := range []int{1, 2, 2} {
+		if got := p.Stats().InUse; got != want {
+			t.Errorf("read %d: InUse = %d, want %d", i, got, want)
+		}
+	}
+
+	p.Append(sql.DBStats{InUse: 3}, sql.DBStats{InUse: 4})
+	if got := p.Stats().InUse; got != 2 {
+		t.Errorf("InUse = %d, want the current 2 before the appended stats", got)
+	}
+	for _, want := range []int{3, 4} {
+		if got := p.Stats().InUse; got != want {
+			t.Errorf("InUse = %d, want %d", got, want)
+		}
+	}
+
+	p.Set(sql.DBStats{InUse: 5})
+	if got := p.Stats().InUse; got != 5 {
+		t.Errorf("InUse = %d after Set, want 5", got)
+	}
+	if got := p.Reads(); got != 7 {
+		t.Errorf("Reads = %d, want 7", got)
+	}
+}
+
+func TestFakeProviderEmpty(t *testing.T) {
+	p := NewFakeProvider()
+	if got := p.Stats(); got != (sql.DBStats{}) {
+		t.Errorf("Stats = %+v, want zero stats", got)
+	}
+}
@@ -0,0 +1,91 @@
+package sqlmetricstest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// AssertMetrics fails t unless collecting c emits the metrics in expected,
+// in the Prometheus text exposition format with their HELP and TYPE
+// lines. Only the metrics named in names are compared, or all of them if
+// none are.
+func AssertMetrics(t testing.TB, c prometheus.Collector, expected string, names ...string) {
+	t.Helper()
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+}
+
+// AssertValue fails t unless collecting c emits the gauge or counter name
+// with exactly the given labels and the value want
+func AssertValue(t testing.TB, c prometheus.Collector, name string, labels prometheus.Labels, want float64) {
+	t.Helper()
+	got, ok, err := Value(c, name, labels)
+	switch {
+	case err != nil:
+		t.Error(err)
+	case !ok:
+		t.Errorf("no %s%s emitted", name, formatLabels(labels))
+	case got != want:
+		t.Errorf("%s%s = %g, want %g", name, formatLabels(labels), got, want)
+	}
+}
+
+// Value returns the value of the gauge or counter name with exactly the
+// given labels emitted by collecting c, and whether it was emitted
+func Value(c prometheus.Collector, name string, labels prometheus.Labels) (float64, bool, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		return 0, false, err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return 0, false, err
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if !hasLabels(m, labels) {
+				continue
+			}
+			switch {
+			case m.Gauge != nil:
+				return m.GetGauge().GetValue(), true, nil
+			case m.Counter != nil:
+				return m.GetCounter().GetValue(), true, nil
+			case m.Untyped != nil:
+				return m.GetUntyped().GetValue(), true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// hasLabels reports whether m has exactly labels
+func hasLabels(m *dto.Metric, labels prometheus.Labels) bool {
+	if len(m.GetLabel()) != len(labels) {
+		return false
+	}
+	for _, lp := range m.GetLabel() {
+		if v, ok := labels[lp.GetName()]; !ok || v != lp.GetValue() {
+			return false
+		}
+	}
+	return true
+}
+
+func formatLabels(labels prometheus.Labels) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+`"`+v+`"`)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,88 @@
+package sqlmetricstest_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+	"github.com/jacksontj/gosqlmetrics/sqlmetricstest"
+)
+
+// recorder is a testing.TB recording whether an assertion failed
+type recorder struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recorder) Helper()               {}
+func (r *recorder) Error(...any)          { r.failed = true }
+func (r *recorder) Errorf(string, ...any) { r.failed = true }
+func (r *recorder) Fatalf(string, ...any) { r.failed = true }
+func (r *recorder) Fatal(...any)          { r.failed = true }
+
+func newCollector(t *testing.T) (*sqlmetrics.Collector, *sqlmetricstest.FakeProvider) {
+	t.Helper()
+	c := sqlmetrics.NewCollector(sqlmetrics.Options{Labels: []string{"db"}})
+	p := sqlmetricstest.NewFakeProvider(sql.DBStats{MaxOpenConnections: 10, OpenConnections: 4, InUse: 3, Idle: 1})
+	if err := c.RegisterProvider(p, []string{"main"}); err != nil {
+		t.Fatal(err)
+	}
+	return c, p
+}
+
+func TestAssertValue(t *testing.T) {
+	c, _ := newCollector(t)
+	sqlmetricstest.AssertValue(t, c, "connections_in_use", prometheus.Labels{"db": "main"}, 3)
+
+	for _, tc := range []struct {
+		name   string
+		labels prometheus.Labels
+		want   float64
+	}{
+		{"wrong value", prometheus.Labels{"db": "main"}, 4},
+		{"missing labels", prometheus.Labels{"db": "other"}, 3},
+		{"extra labels", prometheus.Labels{"db": "main", "zone": "a"}, 3},
+	} {
+		r := &recorder{TB: t}
+		sqlmetricstest.AssertValue(r, c, "connections_in_use", tc.labels, tc.want)
+		if !r.failed {
+			t.Errorf("%s: AssertValue passed", tc.name)
+		}
+	}
+}
+
+func TestValueConstLabelsDB(t *testing.T) {
+	c := sqlmetrics.NewCollector(sqlmetrics.Options{Labels: []string{"db"}})
+	// The DB is never used, so it needs no connector
+	db := sql.OpenDB(nil)
+	defer db.Close()
+	if err := c.RegisterDBWithConstLabels(db, []string{"main"}, prometheus.Labels{"zone": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := sqlmetricstest.Value(c, "connections_max", prometheus.Labels{"db": "main", "zone": "a"})
+	if err != nil || !ok || got != 0 {
+		t.Errorf("Value = %v, %v, %v, want 0, true, nil", got, ok, err)
+	}
+}
+
+func TestAssertMetrics(t *testing.T) {
+	c, _ := newCollector(t)
+	const expected = `
+# HELP connections_idle The number of idle connections
+# TYPE connections_idle gauge
+connections_idle{db="main"} 1
+`
+	sqlmetricstest.AssertMetrics(t, c, expected, "connections_idle")
+
+	r := &recorder{TB: t}
+	sqlmetricstest.AssertMetrics(r, c, `
+# HELP connections_idle The number of idle connections
+# TYPE connections_idle gauge
+connections_idle{db="main"} 2
+`, "connections_idle")
+	if !r.failed {
+		t.Error("AssertMetrics passed with the wrong value")
+	}
+}
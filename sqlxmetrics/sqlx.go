@@ -0,0 +1,24 @@
+// Package sqlxmetrics registers sqlx DBs with a sqlmetrics.Collector.
+package sqlxmetrics
+
+import (
+	"github.com/jmoiron/sqlx"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// Register registers the *sql.DB underlying db with c for pool metrics
+func Register(c *sqlmetrics.Collector, db *sqlx.DB, labelValues []string) error {
+	return c.RegisterDB(db.DB, labelValues)
+}
+
+// Open opens a *sqlx.DB like sqlx.Open, with the driver wrapped by c so its
+// queries, including named queries and Get and Select, record query
+// metrics, and registers it with c for pool metrics.
+func Open(c *sqlmetrics.Collector, driverName, dataSourceName string, labelValues []string) (*sqlx.DB, error) {
+	db, err := c.Open(driverName, dataSourceName, labelValues)
+	if err != nil {
+		return nil, err
+	}
+	return sqlx.NewDb(db, driverName), nil
+}
@@ -0,0 +1,202 @@
+package sqlmetrics
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatementOrder orders the statements of TopStatements
+type StatementOrder int
+
+const (
+	// ByTotalDuration orders statements by the total time spent on them,
+	// which finds those worth optimizing
+	ByTotalDuration StatementOrder = iota
+	// ByMaxDuration orders statements by their slowest call
+	ByMaxDuration
+	// ByCalls orders statements by how often they were called
+	ByCalls
+)
+
+// StatementStats are the stats of the calls of a statement, by its
+// Fingerprint, on a wrapped driver, as TopStatements returns them
+type StatementStats struct {
+	Fingerprint string `json:"fingerprint"`
+	// Labels maps each of Options.Labels to the label value the driver was
+	// wrapped with
+	Labels        map[string]string `json:"labels"`
+	Calls         uint64            `json:"calls"`
+	Errors        uint64            `json:"errors"`
+	TotalDuration time.Duration     `json:"total_duration"`
+	MaxDuration   time.Duration     `json:"max_duration"`
+}
+
+// MeanDuration returns the average duration of the calls
+func (s StatementStats) MeanDuration() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.TotalDuration / time.Duration(s.Calls)
+}
+
+// statementKey identifies a statement of a wrapped driver
+type statementKey struct {
+	labelValues string
+	fingerprint string
+}
+
+// statementStats tracks the stats of the queries and execs of wrapped
+// drivers by fingerprint, keeping at most max statements. Past that, the
+// statement with the least total duration makes room for a new one.
+type statementStats struct {
+	max int
+
+	mu         sync.Mutex
+	statements map[statementKey]*StatementStats
+}
+
+// newStatementStats returns the statementStats of o, or nil if
+// o.TrackStatements isn't set
+func newStatementStats(o Options) *statementStats {
+	if o.TrackStatements <= 0 {
+		return nil
+	}
+	return &statementStats{max: o.TrackStatements, statements: make(map[statementKey]*StatementStats)}
+}
+
+// observe records e, if it was a query or exec
+func (s *statementStats) observe(labelValues []string, e QueryEvent, err error) {
+	if s == nil || e.Method != MethodQuery && e.Method != MethodExec || errors.Is(err, driver.ErrSkip) {
+		return
+	}
+	key := statementKey{strings.Join(labelValues, "\xff"), Fingerprint(e.Query)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.statements[key]
+	if !ok {
+		if len(s.statements) >= s.max {
+			s.evict()
+		}
+		st = &StatementStats{Fingerprint: key.fingerprint, Labels: e.Labels}
+		s.statements[key] = st
+	}
+	st.Calls++
+	if err != nil {
+		st.Errors++
+	}
+	st.TotalDuration += e.Duration
+	st.MaxDuration = max(st.MaxDuration, e.Duration)
+}
+
+// evict removes the statement with the least total duration. s.mu must be
+// held.
+func (s *statementStats) evict() {
+	var least statementKey
+	var leastTotal time.Duration = -1
+	for key, st := range s.statements {
+		if leastTotal < 0 || st.TotalDuration < leastTotal {
+			least, leastTotal = key, st.TotalDuration
+		}
+	}
+	delete(s.statements, least)
+}
+
+// TopStatements returns the stats of the n statements first by order of
+// the queries and execs of wrapped drivers, or of all of them if n is 0.
+// Statements are tracked by Fingerprint when Options.TrackStatements is
+// set, for a lightweight, pg_stat_statements like view of the application's
+// queries.
+func (c *Collector) TopStatements(n int, order StatementOrder) []StatementStats {
+	s := c.q.statements
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	stats := make([]StatementStats, 0, len(s.statements))
+	for _, st := range s.statements {
+		stats = append(stats, *st)
+	}
+	s.mu.Unlock()
+
+	less := func(a, b StatementStats) bool {
+		switch order {
+		case ByMaxDuration:
+			return a.MaxDuration > b.MaxDuration
+		case ByCalls:
+			return a.Calls > b.Calls
+		}
+		return a.TotalDuration > b.TotalDuration
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if less(stats[i], stats[j]) != less(stats[j], stats[i]) {
+			return less(stats[i], stats[j])
+		}
+		return stats[i].Fingerprint < stats[j].Fingerprint
+	})
+	if n > 0 && n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// ResetStatements forgets the statements TopStatements returns
+func (c *Collector) ResetStatements() {
+	s := c.q.statements
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.statements = make(map[statementKey]*StatementStats)
+	s.mu.Unlock()
+}
+
+// StatementsHandler returns an http.Handler serving TopStatements as JSON.
+// The n query parameter is the number of statements, 20 by default, and
+// the by parameter their order, total, max or calls. A DELETE request
+// resets the statements.
+func (c *Collector) StatementsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			c.ResetStatements()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		n := 20
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 0 {
+				http.Error(w, "invalid n "+strconv.Quote(v), http.StatusBadRequest)
+				return
+			}
+		}
+		var order StatementOrder
+		switch by := r.URL.Query().Get("by"); by {
+		case "", "total":
+			order = ByTotalDuration
+		case "max":
+			order = ByMaxDuration
+		case "calls":
+			order = ByCalls
+		default:
+			http.Error(w, "invalid by "+strconv.Quote(by)+", expected total, max or calls", http.StatusBadRequest)
+			return
+		}
+
+		statements := c.TopStatements(n, order)
+		if statements == nil {
+			statements = []StatementStats{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statements)
+	})
+}
@@ -0,0 +1,219 @@
+// Package statsd periodically flushes the pool stats of the DBs registered
+// with a sqlmetrics.Collector, and the metrics of its wrapped drivers, to
+// statsd or DogStatsD.
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// DefaultInterval is the flush interval of Options that don't set one
+const DefaultInterval = 10 * time.Second
+
+// maxPacketSize keeps each datagram within a typical MTU
+const maxPacketSize = 1432
+
+// Options for the Reporter
+type Options struct {
+	// Addr is the host:port of the statsd server, sent to over UDP
+	Addr string
+	// Interval is the time between flushes, DefaultInterval if unset
+	Interval time.Duration
+	// Prefix is joined to every metric name with a dot
+	Prefix string
+	// DogStatsD sends the metrics' labels as DogStatsD tags. Otherwise the
+	// label values are joined to the metric name with dots, in label name
+	// order.
+	DogStatsD bool
+}
+
+// Reporter sends the collector's metrics to statsd. Gauges are sent as
+// gauges, and counters and the counts and sums of histograms as counters
+// of their increase since the previous flush.
+type Reporter struct {
+	o    Options
+	g    prometheus.Gatherer
+	conn net.Conn
+
+	mu sync.Mutex
+	// last holds the counter values of the previous flush
+	last map[string]float64
+}
+
+// NewReporter returns a Reporter of c's SnapshotCollector, so it doesn't
+// disturb the collector's scrapes.
+func NewReporter(c *sqlmetrics.Collector, o Options) (*Reporter, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c.SnapshotCollector()); err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", o.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	return &Reporter{
+		o:    o,
+		g:    reg,
+		conn: conn,
+		last: make(map[string]float64),
+	}, nil
+}
+
+// Run flushes every Options.Interval until ctx is done, then flushes a
+// final time and returns that flush's error.
+func (r *Reporter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.o.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return r.Flush()
+		case <-ticker.C:
+			r.Flush()
+		}
+	}
+}
+
+// Close closes the connection to the statsd server
+func (r *Reporter) Close() error {
+	return r.conn.Close()
+}
+
+// Flush sends the current metrics
+func (r *Reporter) Flush() error {
+	mfs, err := r.g.Gather()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var packet bytes.Buffer
+	send := func(line string) error {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			if _, err := r.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+		return nil
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			name, tags := r.name(mf.GetName(), m.GetLabel())
+			var lines []string
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				lines = append(lines, r.line(name, m.GetGauge().GetValue(), "g", tags))
+			case dto.MetricType_UNTYPED:
+				lines = append(lines, r.line(name, m.GetUntyped().GetValue(), "g", tags))
+			case dto.MetricType_COUNTER:
+				lines = append(lines, r.line(name, r.delta(name, tags, m.GetCounter().GetValue()), "c", tags))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				lines = append(lines,
+					r.line(name+".count", r.delta(name+".count", tags, float64(h.GetSampleCount())), "c", tags),
+					r.line(name+".sum", r.delta(name+".sum", tags, h.GetSampleSum()), "c", tags),
+				)
+			}
+			for _, line := range lines {
+				if err := send(line); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if packet.Len() > 0 {
+		if _, err := r.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// name returns the statsd name and DogStatsD tags of a metric
+func (r *Reporter) name(name string, labels []*dto.LabelPair) (string, string) {
+	parts := []string{sanitize(name)}
+	if r.o.Prefix != "" {
+		parts = append([]string{r.o.Prefix}, parts...)
+	}
+	labels = append([]*dto.LabelPair(nil), labels...)
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+
+	var tags []string
+	for _, lp := range labels {
+		if r.o.DogStatsD {
+			tags = append(tags, sanitize(lp.GetName())+":"+sanitizeTag(lp.GetValue()))
+		} else {
+			parts = append(parts, sanitize(lp.GetValue()))
+		}
+	}
+	return strings.Join(parts, "."), strings.Join(tags, ",")
+}
+
+func (r *Reporter) line(name string, value float64, kind, tags string) string {
+	line := name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + kind
+	if tags != "" {
+		line += "|#" + tags
+	}
+	return line
+}
+
+// delta returns the increase of a counter since the previous flush, or its
+// value if it is new or was reset. r.mu must be held.
+func (r *Reporter) delta(name, tags string, value float64) float64 {
+	key := name + "|" + tags
+	last, ok := r.last[key]
+	r.last[key] = value
+	if !ok || value < last {
+		return value
+	}
+	return value - last
+}
+
+// sanitize replaces the characters statsd gives meaning to, and dots, in
+// a metric name part
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '.', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// sanitizeTag replaces the characters DogStatsD gives meaning to in a tag
+// value
+func sanitizeTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '|', ',', '#', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
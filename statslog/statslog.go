@@ -0,0 +1,98 @@
+// Package statslog periodically logs the pool stats of the DBs registered
+// with a sqlmetrics.Collector with log/slog, for environments where logs
+// rather than metrics are the primary signal. Other loggers, such as zap
+// or zerolog, plug in through their slog.Handler.
+package statslog
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	sqlmetrics "github.com/jacksontj/gosqlmetrics"
+)
+
+// DefaultInterval is the logging interval of Options that don't set one
+const DefaultInterval = time.Minute
+
+// DefaultMessage is the message of Options that don't set one
+const DefaultMessage = "sql pool stats"
+
+// Options for the Reporter
+type Options struct {
+	// Logger is logged to, slog.Default() if unset
+	Logger *slog.Logger
+	// Level is the level of the records, slog.LevelInfo by default
+	Level slog.Level
+	// Message is the message of the records, DefaultMessage if unset
+	Message string
+	// Interval is the time between logs, DefaultInterval if unset
+	Interval time.Duration
+}
+
+// Reporter logs a record per registered DB, with the DB's labels in a
+// labels group and its stats in a stats group, keyed by the names of the
+// collector's metrics.
+type Reporter struct {
+	o Options
+	c *sqlmetrics.Collector
+}
+
+// NewReporter returns a Reporter of c's Snapshot, so it doesn't disturb
+// the collector's scrapes.
+func NewReporter(c *sqlmetrics.Collector, o Options) *Reporter {
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	if o.Message == "" {
+		o.Message = DefaultMessage
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	return &Reporter{o: o, c: c}
+}
+
+// Run logs every Options.Interval until ctx is done, then logs a final
+// time.
+func (r *Reporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.o.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.Log(context.Background())
+			return
+		case <-ticker.C:
+			r.Log(ctx)
+		}
+	}
+}
+
+// Log logs the current stats of every registered DB
+func (r *Reporter) Log(ctx context.Context) {
+	if !r.o.Logger.Enabled(ctx, r.o.Level) {
+		return
+	}
+	o := r.c.Options()
+	for _, s := range r.c.Snapshot() {
+		labels := make([]any, 0, len(o.Labels))
+		for _, name := range o.Labels {
+			labels = append(labels, slog.String(name, s.Labels[name]))
+		}
+		r.o.Logger.LogAttrs(ctx, r.o.Level, r.o.Message,
+			slog.Group("labels", labels...),
+			slog.Group("stats",
+				slog.Int(o.MetricName("connections_max"), s.Stats.MaxOpenConnections),
+				slog.Int(o.MetricName("connections_open"), s.Stats.OpenConnections),
+				slog.Int(o.MetricName("connections_in_use"), s.Stats.InUse),
+				slog.Int(o.MetricName("connections_idle"), s.Stats.Idle),
+				slog.Int64(o.MetricName("connections_wait_count_total"), s.Stats.WaitCount),
+				slog.Float64(o.MetricName("connections_wait_duration_seconds_total"), o.Duration(s.Stats.WaitDuration)),
+				slog.Int64(o.MetricName("connections_max_idle_closed_total"), s.Stats.MaxIdleClosed),
+				slog.Int64(o.MetricName("connections_max_idle_time_closed_total"), s.Stats.MaxIdleTimeClosed),
+				slog.Int64(o.MetricName("connections_max_lifetime_closed_total"), s.Stats.MaxLifetimeClosed),
+			),
+		)
+	}
+}
@@ -0,0 +1,128 @@
+package sqlmetrics
+
+import "strings"
+
+// StatementKindLabel is the label carrying the StatementKind of the query
+// a query metric observed, when Options.StatementKindLabel is set.
+const StatementKindLabel = "stmt_kind"
+
+// Values of StatementKindLabel
+const (
+	StatementSelect = "select"
+	StatementInsert = "insert"
+	StatementUpdate = "update"
+	StatementDelete = "delete"
+	StatementDDL    = "ddl"
+	StatementOther  = "other"
+)
+
+// statementKinds are the StatementKind of leading keywords
+var statementKinds = map[string]string{
+	"select":   StatementSelect,
+	"values":   StatementSelect,
+	"table":    StatementSelect,
+	"insert":   StatementInsert,
+	"replace":  StatementInsert,
+	"update":   StatementUpdate,
+	"delete":   StatementDelete,
+	"create":   StatementDDL,
+	"alter":    StatementDDL,
+	"drop":     StatementDDL,
+	"truncate": StatementDDL,
+	"rename":   StatementDDL,
+	"comment":  StatementDDL,
+}
+
+// StatementKind classifies query by its leading keyword, after comments
+// and opening parentheses, as StatementSelect, StatementInsert,
+// StatementUpdate, StatementDelete, StatementDDL or StatementOther. A WITH
+// query is of the kind of the statement following its common table
+// expressions. An empty query, as of begins and commits, has an empty
+// kind. It doesn't parse the query, so it is cheap enough to run on every
+// operation.
+func StatementKind(query string) string {
+	word, rest := leadingKeyword(query)
+	if word == "" {
+		if strings.TrimSpace(query) == "" {
+			return ""
+		}
+		return StatementOther
+	}
+	if word == "with" {
+		word = afterCTEs(rest)
+	}
+	if kind, ok := statementKinds[word]; ok {
+		return kind
+	}
+	return StatementOther
+}
+
+// leadingKeyword returns the lowercased first word of query, skipping
+// whitespace, comments and opening parentheses, and the query after it
+func leadingKeyword(query string) (string, string) {
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '(':
+			i++
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return "", ""
+			}
+			i += end + 4
+		default:
+			j := i
+			for j < len(query) && isLetterByte(query[j]) {
+				j++
+			}
+			return strings.ToLower(query[i:j]), query[j:]
+		}
+	}
+	return "", ""
+}
+
+// afterCTEs returns the lowercased first keyword outside of parentheses
+// that starts a statement, skipping the common table expressions of a WITH
+// query
+func afterCTEs(query string) string {
+	depth := 0
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				return ""
+			}
+			i += end + 2
+		case isLetterByte(c):
+			j := i
+			for j < len(query) && isWordByte(query[j]) {
+				j++
+			}
+			if word := strings.ToLower(query[i:j]); depth == 0 && statementKinds[word] != "" && word != "table" {
+				return word
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return ""
+}
+
+func isLetterByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,47 @@
+package sqlmetrics
+
+import "testing"
+
+func TestStatementKind(t *testing.T) {
+	for _, test := range []struct {
+		query, want string
+	}{
+		{"SELECT 1", StatementSelect},
+		{"INSERT INTO t VALUES (1)", StatementInsert},
+		{"REPLACE INTO t VALUES (1)", StatementInsert},
+		{"UPDATE t SET a = 1", StatementUpdate},
+		{"DELETE FROM t", StatementDelete},
+		{"CREATE TABLE t (id int)", StatementDDL},
+		{"ALTER TABLE t ADD COLUMN b int", StatementDDL},
+		{"TRUNCATE t", StatementDDL},
+		{"VALUES (1), (2)", StatementSelect},
+		{"TABLE t", StatementSelect},
+		// Lowercase and mixed case keywords
+		{"select * from t", StatementSelect},
+		{"Update t set a = 1", StatementUpdate},
+		// Leading whitespace, comments and parentheses
+		{"  \n\tSELECT 1", StatementSelect},
+		{"-- find the user\nSELECT * FROM users", StatementSelect},
+		{"/* app=api */ DELETE FROM sessions", StatementDelete},
+		{"/* a */ -- b\n /* c */ insert into t values (1)", StatementInsert},
+		{"(SELECT 1) UNION (SELECT 2)", StatementSelect},
+		// CTEs are of the kind of the statement following them
+		{"WITH recent AS (SELECT * FROM orders) SELECT * FROM recent", StatementSelect},
+		{"WITH moved AS (DELETE FROM a RETURNING *) INSERT INTO b SELECT * FROM moved", StatementInsert},
+		{"with x as (select 1), y as (select 2) update t set a = 1", StatementUpdate},
+		{"WITH RECURSIVE r(n) AS (SELECT 1 UNION SELECT n + 1 FROM r) SELECT n FROM r", StatementSelect},
+		{"WITH q AS (SELECT ')' AS s) DELETE FROM t", StatementDelete},
+		// No statement, or one of no known kind
+		{"", ""},
+		{"   ", ""},
+		{"BEGIN", StatementOther},
+		{"SET search_path = app", StatementOther},
+		{"EXPLAIN SELECT 1", StatementOther},
+		{"/* unterminated", StatementOther},
+		{"WITH x AS (SELECT 1)", StatementOther},
+	} {
+		if got := StatementKind(test.query); got != test.want {
+			t.Errorf("StatementKind(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package sqlmetrics
+
+import "strings"
+
+// TableLabel is the label carrying the TableName of the query a query
+// metric observed, when Options.TableLabel is set.
+const TableLabel = "table"
+
+// UnknownTable is the TableName of queries without a table it can find
+const UnknownTable = "unknown"
+
+// TableName returns the primary table of a simple statement: the first
+// table a SELECT or DELETE reads FROM, the table an INSERT or REPLACE goes
+// INTO, the table of an UPDATE, or the table a CREATE, ALTER, DROP or
+// TRUNCATE TABLE changes. Unquoted names are lowercased, and schema
+// qualified ones keep their schema, as in public.users. Other queries,
+// such as WITH queries, selects from subqueries and queries without a
+// table, are UnknownTable, and an empty query, as of begins and commits,
+// is "".
+func TableName(query string) string {
+	word, rest := leadingKeyword(query)
+	if word == "" {
+		if strings.TrimSpace(query) == "" {
+			return ""
+		}
+		return UnknownTable
+	}
+	var ok bool
+	switch word {
+	case "select", "delete":
+		rest, ok = topLevelKeyword(rest, "from")
+	case "insert", "replace":
+		rest, ok = topLevelKeyword(rest, "into")
+	case "update":
+		rest, ok = skipWords(rest, "only", "low_priority", "ignore"), true
+	case "create", "alter", "drop":
+		if rest, ok = topLevelKeyword(rest, "table"); ok {
+			rest = skipWords(rest, "if", "not", "exists")
+		}
+	case "truncate":
+		rest, ok = skipWords(rest, "table", "only"), true
+	}
+	if !ok {
+		return UnknownTable
+	}
+	if table := identifier(rest); table != "" {
+		return table
+	}
+	return UnknownTable
+}
+
+// topLevelKeyword returns query after the first occurrence of keyword
+// outside of parentheses and quotes
+func topLevelKeyword(query, keyword string) (string, bool) {
+	depth := 0
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				return "", false
+			}
+			i += end + 2
+		case isWordByte(c):
+			j := i
+			for j < len(query) && isWordByte(query[j]) {
+				j++
+			}
+			if depth == 0 && strings.EqualFold(query[i:j], keyword) {
+				return query[j:], true
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return "", false
+}
+
+// skipWords returns query without the leading words that are among words
+func skipWords(query string, words ...string) string {
+	for {
+		trimmed := strings.TrimLeft(query, " \t\r\n")
+		j := 0
+		for j < len(trimmed) && isWordByte(trimmed[j]) {
+			j++
+		}
+		skip := false
+		for _, w := range words {
+			if strings.EqualFold(trimmed[:j], w) {
+				skip = true
+				break
+			}
+		}
+		if j == 0 || !skip {
+			return trimmed
+		}
+		query = trimmed[j:]
+	}
+}
+
+// identifier returns the possibly quoted and schema qualified identifier
+// query starts with, after whitespace, unquoted and with unquoted parts
+// lowercased, or "" if it doesn't start with one
+func identifier(query string) string {
+	query = strings.TrimLeft(query, " \t\r\n")
+	var parts []string
+	for {
+		if query == "" {
+			return ""
+		}
+		var part string
+		switch c := query[0]; c {
+		case '"', '`', '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			end := strings.IndexByte(query[1:], closing)
+			if end < 0 {
+				return ""
+			}
+			part, query = query[1:end+1], query[end+2:]
+		default:
+			j := 0
+			for j < len(query) && isWordByte(query[j]) {
+				j++
+			}
+			part, query = strings.ToLower(query[:j]), query[j:]
+		}
+		if part == "" {
+			return ""
+		}
+		parts = append(parts, part)
+		if !strings.HasPrefix(query, ".") {
+			return strings.Join(parts, ".")
+		}
+		query = query[1:]
+	}
+}
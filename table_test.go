@@ -0,0 +1,54 @@
+package sqlmetrics
+
+import "testing"
+
+func TestTableName(t *testing.T) {
+	for _, test := range []struct {
+		query, want string
+	}{
+		{"SELECT * FROM users WHERE id = 1", "users"},
+		{"select id from Users", "users"},
+		// Quoted, backticked and bracketed identifiers keep their case
+		{`SELECT * FROM "UserAccounts"`, "UserAccounts"},
+		{"SELECT * FROM `Orders` LIMIT 1", "Orders"},
+		{"SELECT * FROM [Audit Log]", "Audit Log"},
+		// Schema qualified names keep their schema
+		{"SELECT * FROM public.users", "public.users"},
+		{`SELECT * FROM "App"."Users"`, "App.Users"},
+		{"SELECT * FROM `shop`.orders", "shop.orders"},
+		// JOINs are of the first table
+		{"SELECT * FROM orders o JOIN users u ON u.id = o.user_id", "orders"},
+		{"SELECT * FROM orders, users WHERE orders.user_id = users.id", "orders"},
+		// FROMs in subqueries and literals aren't the statement's
+		{"SELECT (SELECT count(*) FROM items) AS n FROM carts", "carts"},
+		{"SELECT 'from nowhere' AS s FROM logs", "logs"},
+		{"SELECT * FROM users WHERE id IN (SELECT user_id FROM bans)", "users"},
+		{"SELECT * FROM (SELECT * FROM users) AS u", UnknownTable},
+		// Writes
+		{"INSERT INTO events (id) VALUES (1)", "events"},
+		{"insert into app.events select * from staging", "app.events"},
+		{"REPLACE INTO kv VALUES ('a', 1)", "kv"},
+		{"UPDATE users SET name = 'bob'", "users"},
+		{"UPDATE ONLY users SET name = 'bob'", "users"},
+		{"UPDATE LOW_PRIORITY IGNORE `Users` SET a = 1", "Users"},
+		{"DELETE FROM sessions WHERE expired", "sessions"},
+		{"delete from public.sessions", "public.sessions"},
+		// DDL
+		{"CREATE TABLE IF NOT EXISTS audit (id int)", "audit"},
+		{"ALTER TABLE users ADD COLUMN email text", "users"},
+		{"DROP TABLE IF EXISTS tmp", "tmp"},
+		{"TRUNCATE TABLE logs", "logs"},
+		// Leading comments
+		{"/* app=api */ SELECT * FROM users", "users"},
+		// No table
+		{"", ""},
+		{"SELECT 1", UnknownTable},
+		{"WITH r AS (SELECT 1) SELECT * FROM r", UnknownTable},
+		{"BEGIN", UnknownTable},
+		{`SELECT * FROM "unterminated`, UnknownTable},
+	} {
+		if got := TableName(test.query); got != test.want {
+			t.Errorf("TableName(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}